@@ -0,0 +1,168 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.ibm.com/Blue-Horizon/aural2/boltstore"
+	"github.ibm.com/Blue-Horizon/aural2/features"
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+	"github.ibm.com/Blue-Horizon/aural2/tftrain"
+)
+
+// clipScore is how useful it would be to label one clip, as judged by the current model.
+type clipScore struct {
+	ID           libaural2.ClipID
+	Labeled      bool    // does the clip already have labels for this vocab?
+	Entropy      float64 // mean entropy of the softmax over the clip, normalized to be betwene 0 and 1.
+	Margin       float64 // mean margin betwene the two most likely states.
+	Disagreement float64 // fraction of strides where the argmax differs from the labels. 0 if not labeled.
+}
+
+// Usefulness combines the uncertainty and disagreement of the model into one number. Larger is more useful.
+func (score clipScore) Usefulness() float64 {
+	return score.Entropy + (1 - score.Margin) + score.Disagreement
+}
+
+// scoreClip computes the clipScore of one clip from the outputs of the model and the existing labels.
+func scoreClip(probsList [][]float32, labelSet libaural2.LabelSet) (score clipScore) {
+	score.ID = labelSet.ID
+	score.Labeled = len(labelSet.Labels) > 0
+	if len(probsList) == 0 {
+		return
+	}
+	stateArray := labelSet.ToStateArray()
+	var disagreements int
+	for i, probs := range probsList {
+		output := libaural2.Output(probs)
+		score.Entropy += output.Entropy() / math.Log(float64(len(output))) // normalize by the max possible entropy
+		score.Margin += float64(output.Margin())
+		if state, _ := argmax(probs); score.Labeled && i < len(stateArray) && state != stateArray[i] {
+			disagreements++
+		}
+	}
+	score.Entropy /= float64(len(probsList))
+	score.Margin /= float64(len(probsList))
+	if score.Labeled {
+		score.Disagreement = float64(disagreements) / float64(len(probsList))
+	}
+	return
+}
+
+// clipScorer holds the latest scores of all the clips for each vocab, and the outputs of the model they were scored from.
+type clipScorer struct {
+	mutex   sync.Mutex
+	scores  map[libaural2.VocabName]map[libaural2.ClipID]clipScore
+	outputs map[libaural2.VocabName]map[libaural2.ClipID][][]float32
+}
+
+// put scores the clip of the labelSet from the outputs of the model on it.
+func (cs *clipScorer) put(vocabName libaural2.VocabName, probsList [][]float32, labelSet libaural2.LabelSet) {
+	score := scoreClip(probsList, labelSet)
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if cs.scores[vocabName] == nil {
+		cs.scores[vocabName] = map[libaural2.ClipID]clipScore{}
+		cs.outputs[vocabName] = map[libaural2.ClipID][][]float32{}
+	}
+	cs.scores[vocabName][score.ID] = score
+	cs.outputs[vocabName][score.ID] = probsList
+}
+
+// markLabeled rescores a clip which has just been labeled against its new labels, so that it will not be offered again, and its disagreement is known before it is next scored.
+func (cs *clipScorer) markLabeled(labelSet libaural2.LabelSet) {
+	cs.mutex.Lock()
+	probsList, prs := cs.outputs[labelSet.VocabName][labelSet.ID]
+	cs.mutex.Unlock()
+	if prs {
+		cs.put(labelSet.VocabName, probsList, labelSet)
+	}
+}
+
+// ranked returns the scores of the vocab, most useful first.
+func (cs *clipScorer) ranked(vocabName libaural2.VocabName) (scores []clipScore) {
+	cs.mutex.Lock()
+	for _, score := range cs.scores[vocabName] {
+		scores = append(scores, score)
+	}
+	cs.mutex.Unlock()
+	sort.Slice(scores, func(i, j int) bool {
+		return scores[i].Usefulness() > scores[j].Usefulness()
+	})
+	return
+}
+
+// byDisagreement returns the scores of the labeled clips of the vocab, the clips on which the model most disagrees with the labels first.
+func (cs *clipScorer) byDisagreement(vocabName libaural2.VocabName) (scores []clipScore) {
+	cs.mutex.Lock()
+	for _, score := range cs.scores[vocabName] {
+		if score.Labeled {
+			scores = append(scores, score)
+		}
+	}
+	cs.mutex.Unlock()
+	sort.Slice(scores, func(i, j int) bool {
+		return scores[i].Disagreement > scores[j].Disagreement
+	})
+	return
+}
+
+// next returns the most useful clip which has not yet been labeled.
+func (cs *clipScorer) next(vocabName libaural2.VocabName) (score clipScore, ok bool) {
+	for _, score = range cs.ranked(vocabName) {
+		if !score.Labeled {
+			return score, true
+		}
+	}
+	return
+}
+
+// startScoringLoop scores every clip with the current model of each vocab, over and over, as the models train.
+func startScoringLoop(
+	db boltstore.DB,
+	onlineSessions map[libaural2.VocabName]*tftrain.OnlineSess,
+	featureCaches map[libaural2.VocabName]*features.Cache,
+) (scorer *clipScorer, err error) {
+	audioClipToMFCCtensors, err := makeAudioClipToMFCCtensors(featureCaches)
+	if err != nil {
+		return
+	}
+	scorer = &clipScorer{
+		scores:  map[libaural2.VocabName]map[libaural2.ClipID]clipScore{},
+		outputs: map[libaural2.VocabName]map[libaural2.ClipID][][]float32{},
+	}
+	go func() {
+		for {
+			for _, clipID := range db.ListAudioClips() {
+				clip, err := getAudioClipFromFS(clipID)
+				if err != nil {
+					logger.Println(err)
+					continue
+				}
+				for vocabName, oSess := range onlineSessions {
+					labelSet, err := db.GetLabelSet(clipID, vocabName)
+					if err != nil {
+						logger.Println(err)
+						continue
+					}
+					mfccTensor, err := audioClipToMFCCtensors[vocabName](clip)
+					if err != nil {
+						logger.Println(err)
+						continue
+					}
+					probsTensor, err := oSess.Infer(mfccTensor)
+					if err != nil {
+						logger.Println(err)
+						continue
+					}
+					scorer.put(vocabName, probsTensor.Value().([][]float32), labelSet)
+				}
+				time.Sleep(50 * time.Millisecond) // don't starve the training loop of CPU time.
+			}
+			time.Sleep(time.Minute) // give the models time to learn before scoring again.
+		}
+	}()
+	return
+}
@@ -0,0 +1,228 @@
+// Package audioconv converts audio of other sample rates, channel counts and encodings into the 16 kHz mono S16_LE audio aural2 works on.
+package audioconv
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+)
+
+// Encoding is the encoding of each sample, named as arecord names it.
+type Encoding string
+
+// Encodings which can be converted.
+const (
+	S16LE   Encoding = "S16_LE"   // signed 16 bit little endian
+	S32LE   Encoding = "S32_LE"   // signed 32 bit little endian
+	FloatLE Encoding = "FLOAT_LE" // 32 bit little endian float, from -1 to 1
+)
+
+// Size is the number of bytes in one sample, or 0 if the encoding is not known.
+func (encoding Encoding) Size() int {
+	switch encoding {
+	case S16LE:
+		return 2
+	case S32LE, FloatLE:
+		return 4
+	}
+	return 0
+}
+
+// Format describes raw audio.
+type Format struct {
+	SampleRate int
+	Channels   int
+	Encoding   Encoding
+}
+
+// Native is the format aural2 works on.
+var Native = Format{SampleRate: libaural2.SampleRate, Channels: 1, Encoding: S16LE}
+
+// Validate checks that the format can be converted.
+func (format Format) Validate() (err error) {
+	if format.SampleRate < 1 {
+		err = errors.New("bad sample rate " + strconv.Itoa(format.SampleRate))
+		return
+	}
+	if format.Channels < 1 {
+		err = errors.New("bad number of channels " + strconv.Itoa(format.Channels))
+		return
+	}
+	if format.Encoding.Size() == 0 {
+		err = errors.New("unknown encoding " + string(format.Encoding))
+	}
+	return
+}
+
+// String formats the format as it is parsed by ParseFormat, such as "48000:2:S32_LE".
+func (format Format) String() string {
+	return strconv.Itoa(format.SampleRate) + ":" + strconv.Itoa(format.Channels) + ":" + string(format.Encoding)
+}
+
+// ParseFormat parses a format of the form "<sample rate>:<channels>:<encoding>", such as "44100:2:S16_LE".
+func ParseFormat(formatString string) (format Format, err error) {
+	parts := strings.Split(formatString, ":")
+	if len(parts) != 3 {
+		err = errors.New("format must be of the form <sample rate>:<channels>:<encoding>, not " + formatString)
+		return
+	}
+	if format.SampleRate, err = strconv.Atoi(parts[0]); err != nil {
+		return
+	}
+	if format.Channels, err = strconv.Atoi(parts[1]); err != nil {
+		return
+	}
+	format.Encoding = Encoding(strings.ToUpper(parts[2]))
+	err = format.Validate()
+	return
+}
+
+// frameSize is the number of bytes in one sample of all the channels.
+func (format Format) frameSize() int {
+	return format.Encoding.Size() * format.Channels
+}
+
+// decodeSample decodes one sample, scaled to betwene -1 and 1.
+func (encoding Encoding) decodeSample(raw []byte) float32 {
+	switch encoding {
+	case S16LE:
+		return float32(int16(binary.LittleEndian.Uint16(raw))) / (1 << 15)
+	case S32LE:
+		return float32(float64(int32(binary.LittleEndian.Uint32(raw))) / (1 << 31))
+	case FloatLE:
+		return math.Float32frombits(binary.LittleEndian.Uint32(raw))
+	}
+	return 0
+}
+
+// Decode whole frames of raw audio into mono samples betwene -1 and 1, averaging the channels.
+func (format Format) Decode(raw []byte) (mono []float32) {
+	sampleSize := format.Encoding.Size()
+	mono = make([]float32, len(raw)/format.frameSize())
+	for i := range mono {
+		frame := raw[i*format.frameSize():]
+		var sum float32
+		for c := 0; c < format.Channels; c++ {
+			sum += format.Encoding.decodeSample(frame[c*sampleSize:])
+		}
+		mono[i] = sum / float32(format.Channels)
+	}
+	return
+}
+
+// EncodeNative encodes mono samples betwene -1 and 1 as S16_LE, clipping any outside that range.
+func EncodeNative(mono []float32) (raw []byte) {
+	raw = make([]byte, len(mono)*2)
+	for i, sample := range mono {
+		value := math.Floor(float64(sample)*(1<<15) + 0.5)
+		value = math.Max(math.Min(value, math.MaxInt16), math.MinInt16)
+		binary.LittleEndian.PutUint16(raw[i*2:], uint16(int16(value)))
+	}
+	return
+}
+
+// Converter converts a stream of raw audio of some format into Native audio.
+// It carries state from one call to the next, so each stream needs its own.
+type Converter struct {
+	format    Format
+	resampler *Resampler // nil if the sample rate is already native
+	remainder []byte     // the bytes of a partial frame left over from the last call
+}
+
+// NewConverter makes a Converter from the format.
+func NewConverter(format Format) (converter *Converter, err error) {
+	if err = format.Validate(); err != nil {
+		return
+	}
+	converter = &Converter{format: format}
+	if format.SampleRate != Native.SampleRate {
+		converter.resampler = NewResampler(format.SampleRate, Native.SampleRate)
+	}
+	return
+}
+
+// Convert the next bytes of the stream. Reads need not be whole frames.
+// The resampler looks a little ahead, so the Native audio lags the input by about a millisecond.
+func (converter *Converter) Convert(raw []byte) (native []byte) {
+	if converter.format == Native { // nothing to do.
+		return append([]byte{}, raw...)
+	}
+	raw = append(converter.remainder, raw...)
+	whole := len(raw) / converter.format.frameSize() * converter.format.frameSize()
+	converter.remainder = append([]byte{}, raw[whole:]...)
+	mono := converter.format.Decode(raw[:whole])
+	if converter.resampler != nil {
+		mono = converter.resampler.Write(mono)
+	}
+	native = EncodeNative(mono)
+	return
+}
+
+// Flush returns the last of the Native audio, at the end of the stream.
+func (converter *Converter) Flush() (native []byte) {
+	if converter.resampler != nil {
+		native = EncodeNative(converter.resampler.Flush())
+	}
+	return
+}
+
+// reader converts the audio read from source.
+type reader struct {
+	source    io.Reader
+	converter *Converter
+	readBuf   []byte
+	converted []byte // converted audio not yet read.
+	err       error  // the error returned by source, to be returned once the converted audio has all been read.
+}
+
+// NewReader returns a reader of Native audio, converted from the audio of the format read from source.
+// If the format is already Native, source is returned as it is.
+func NewReader(source io.Reader, format Format) (nativeReader io.Reader, err error) {
+	if format == Native {
+		nativeReader = source
+		return
+	}
+	converter, err := NewConverter(format)
+	if err != nil {
+		return
+	}
+	nativeReader = &reader{
+		source:    source,
+		converter: converter,
+		readBuf:   make([]byte, 4096),
+	}
+	return
+}
+
+func (r *reader) Read(p []byte) (n int, err error) {
+	for len(r.converted) == 0 && r.err == nil {
+		var read int
+		read, r.err = r.source.Read(r.readBuf)
+		r.converted = append(r.converted, r.converter.Convert(r.readBuf[:read])...)
+		if r.err == io.EOF {
+			r.converted = append(r.converted, r.converter.Flush()...)
+		}
+	}
+	if len(r.converted) == 0 {
+		err = r.err
+		return
+	}
+	n = copy(p, r.converted)
+	r.converted = r.converted[n:]
+	return
+}
+
+// ConvertAll converts all of some raw audio into Native audio.
+func ConvertAll(raw []byte, format Format) (native []byte, err error) {
+	converter, err := NewConverter(format)
+	if err != nil {
+		return
+	}
+	native = append(converter.Convert(raw), converter.Flush()...)
+	return
+}
@@ -0,0 +1,214 @@
+package audioconv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"testing"
+	"testing/iotest"
+)
+
+// makeTone makes seconds of a sine wave of freq Hz at sampleRate.
+func makeTone(freq float64, sampleRate int, seconds float64) (samples []float32) {
+	samples = make([]float32, int(seconds*float64(sampleRate)))
+	for i := range samples {
+		samples[i] = float32(0.5 * math.Sin(2*math.Pi*freq*float64(i)/float64(sampleRate)))
+	}
+	return
+}
+
+// encode mono samples in the format, with the same samples in every channel.
+func encode(samples []float32, format Format) (raw []byte) {
+	sampleSize := format.Encoding.Size()
+	raw = make([]byte, len(samples)*format.frameSize())
+	for i, sample := range samples {
+		for c := 0; c < format.Channels; c++ {
+			buf := raw[i*format.frameSize()+c*sampleSize:]
+			switch format.Encoding {
+			case S16LE:
+				binary.LittleEndian.PutUint16(buf, uint16(int16(sample*(1<<15))))
+			case S32LE:
+				binary.LittleEndian.PutUint32(buf, uint32(int32(float64(sample)*(1<<31))))
+			case FloatLE:
+				binary.LittleEndian.PutUint32(buf, math.Float32bits(sample))
+			}
+		}
+	}
+	return
+}
+
+func TestParseFormat(t *testing.T) {
+	format, err := ParseFormat("48000:2:s32_le")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != (Format{SampleRate: 48000, Channels: 2, Encoding: S32LE}) {
+		t.Fatal("wrong format", format)
+	}
+	parsed, err := ParseFormat(format.String())
+	if err != nil || parsed != format {
+		t.Fatal("format should survive a round trip through String()")
+	}
+	for _, bad := range []string{"48000:2", "48000:0:S16_LE", "fast:1:S16_LE", "16000:1:U8"} {
+		if _, err = ParseFormat(bad); err == nil {
+			t.Fatal(bad, "should not parse")
+		}
+	}
+}
+
+func TestResampleTone(t *testing.T) {
+	for _, inRate := range []int{48000, 44100, 22050, 8000} {
+		output := Resample(makeTone(440, inRate, 1), inRate, Native.SampleRate)
+		if len(output) != Native.SampleRate {
+			t.Fatal(inRate, "expected", Native.SampleRate, "samples, got", len(output))
+		}
+		expected := makeTone(440, Native.SampleRate, 1)
+		for i := 100; i < len(output)-100; i++ { // the ends are faded by the filter.
+			if math.Abs(float64(output[i]-expected[i])) > 2e-3 {
+				t.Fatal(inRate, "sample", i, "expected", expected[i], "got", output[i])
+			}
+		}
+	}
+}
+
+func TestResampleAliasing(t *testing.T) {
+	output := Resample(makeTone(10000, 48000, 1), 48000, Native.SampleRate) // 10 kHz is above the Nyquist frequency of 16 kHz audio,
+	var energy float64
+	for _, sample := range output[100 : len(output)-100] {
+		energy += float64(sample * sample)
+	}
+	energy /= float64(len(output) - 200)
+	if energy > 0.125*1e-4 { // so it should be at least 40 dB down on the 0.125 of the input.
+		t.Fatal("tone above the Nyquist frequency should be filtered out, energy is", energy)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	for _, encoding := range []Encoding{S16LE, S32LE, FloatLE} {
+		format := Format{SampleRate: Native.SampleRate, Channels: 2, Encoding: encoding}
+		mono := format.Decode(encode([]float32{0.25, -0.5}, format))
+		if len(mono) != 2 || math.Abs(float64(mono[0]-0.25)) > 1e-4 || math.Abs(float64(mono[1]+0.5)) > 1e-4 {
+			t.Fatal(encoding, "decoded wrongly:", mono)
+		}
+	}
+	stereo := Format{SampleRate: Native.SampleRate, Channels: 2, Encoding: S16LE}
+	raw := encode([]float32{0.5}, Format{SampleRate: Native.SampleRate, Channels: 1, Encoding: S16LE})
+	raw = append(raw, 0, 0) // the right channel is silent,
+	if mono := stereo.Decode(raw); mono[0] != 0.25 {
+		t.Fatal("channels should be averaged, got", mono[0])
+	}
+}
+
+func TestNativeIsUnchanged(t *testing.T) {
+	raw := encode(makeTone(440, Native.SampleRate, 0.1), Native)
+	native, err := ConvertAll(raw, Native)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, native) {
+		t.Fatal("native audio should not be changed")
+	}
+	if !bytes.Equal(EncodeNative(Native.Decode(raw)), raw) {
+		t.Fatal("decoding and encoding native audio should not change it")
+	}
+}
+
+func TestStreamMatchesWhole(t *testing.T) {
+	format := Format{SampleRate: 44100, Channels: 2, Encoding: S32LE}
+	raw := encode(makeTone(300, format.SampleRate, 0.5), format)
+	expected, err := ConvertAll(raw, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewReader(iotest.OneByteReader(bytes.NewReader(raw)), format) // reads which split frames must still work.
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Fatal("streamed conversion differs from whole conversion", len(actual), len(expected))
+	}
+	if len(expected) != 2*Native.SampleRate/2 {
+		t.Fatal("expected half a second of audio, got", len(expected), "bytes")
+	}
+}
+
+// makeWav makes a WAV file of the format, as a WAVE_FORMAT_EXTENSIBLE if extensible is true.
+func makeWav(data []byte, format Format, extensible bool) []byte {
+	code := wavPCM
+	if format.Encoding == FloatLE {
+		code = wavFloat
+	}
+	fmtChunk := make([]byte, 16, 40)
+	binary.LittleEndian.PutUint16(fmtChunk[0:], uint16(code))
+	binary.LittleEndian.PutUint16(fmtChunk[2:], uint16(format.Channels))
+	binary.LittleEndian.PutUint32(fmtChunk[4:], uint32(format.SampleRate))
+	binary.LittleEndian.PutUint32(fmtChunk[8:], uint32(format.SampleRate*format.frameSize()))
+	binary.LittleEndian.PutUint16(fmtChunk[12:], uint16(format.frameSize()))
+	binary.LittleEndian.PutUint16(fmtChunk[14:], uint16(format.Encoding.Size()*8))
+	if extensible {
+		binary.LittleEndian.PutUint16(fmtChunk[0:], wavExtensible)
+		extension := make([]byte, 24)
+		binary.LittleEndian.PutUint16(extension[0:], 22)
+		binary.LittleEndian.PutUint16(extension[8:], uint16(code))
+		fmtChunk = append(fmtChunk, extension...)
+	}
+	chunk := func(id string, body []byte) []byte {
+		header := make([]byte, 8)
+		copy(header, id)
+		binary.LittleEndian.PutUint32(header[4:], uint32(len(body)))
+		if len(body)%2 == 1 {
+			body = append(body, 0)
+		}
+		return append(header, body...)
+	}
+	body := append([]byte("WAVE"), chunk("fmt ", fmtChunk)...)
+	body = append(body, chunk("LIST", []byte("odd"))...) // other chunks should be skipped.
+	body = append(body, chunk("data", data)...)
+	return append(chunk("RIFF", body)[:8], body...)
+}
+
+func TestWav(t *testing.T) {
+	for _, format := range []Format{
+		{SampleRate: 44100, Channels: 2, Encoding: FloatLE},
+		{SampleRate: 48000, Channels: 1, Encoding: S32LE},
+		Native,
+	} {
+		for _, extensible := range []bool{false, true} {
+			data := encode(makeTone(440, format.SampleRate, 0.25), format)
+			parsedFormat, parsedData, err := ParseWav(makeWav(data, format, extensible))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsedFormat != format || !bytes.Equal(parsedData, data) {
+				t.Fatal("parsed wrongly:", parsedFormat)
+			}
+			native, err := WavToNative(makeWav(data, format, extensible))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(native) != 2*Native.SampleRate/4 {
+				t.Fatal(format, "expected a quarter of a second of audio, got", len(native), "bytes")
+			}
+			parsedFormat, parsedData, err = ParseWav(EncodeWav(native))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsedFormat != Native || !bytes.Equal(parsedData, native) {
+				t.Fatal("EncodeWav should make a native WAV")
+			}
+		}
+	}
+	if _, _, err := ParseWav([]byte("some bytes which are not a wav file")); err == nil {
+		t.Fatal("should not parse")
+	}
+	unsupported := makeWav(make([]byte, 30), Format{SampleRate: 16000, Channels: 1, Encoding: S16LE}, false)
+	binary.LittleEndian.PutUint16(unsupported[34:], 24) // 24 bit samples
+	if _, _, err := ParseWav(unsupported); err == nil {
+		t.Fatal("24 bit WAVs are not supported")
+	}
+}
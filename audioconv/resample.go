@@ -0,0 +1,133 @@
+package audioconv
+
+import (
+	"math"
+)
+
+// zeroCrossings is the number of zero crossings of the sinc on each side of the filter. More is sharper, but slower.
+const zeroCrossings = 16
+
+// rolloff puts the cutoff of the filter a little below the Nyquist frequency of the output, so that it has room to roll off before aliasing.
+const rolloff = 0.95
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// Resampler converts a stream of samples from one sample rate to another, with a windowed sinc filter.
+// The filter for each of the phases at which an output sample can fall betwene input samples is computed once, up front.
+type Resampler struct {
+	inRate    int         // input and output rates, divided by their greatest common divisor.
+	outRate   int         // there is one phase for each output sample in outRate.
+	halfWidth int         // number of input samples on each side of an output sample which the filter covers.
+	filters   [][]float32 // the taps of the filter of each phase.
+	history   []float32   // the input samples which are still needed.
+	start     int64       // the index in the input of history[0].
+	written   int64       // the number of input samples written.
+	n         int64       // the index of the next output sample.
+}
+
+// NewResampler makes a Resampler from inRate to outRate.
+func NewResampler(inRate, outRate int) (resampler *Resampler) {
+	divisor := gcd(inRate, outRate)
+	resampler = &Resampler{
+		inRate:  inRate / divisor,
+		outRate: outRate / divisor,
+	}
+	cutoff := 1.0 // relative to the Nyquist frequency of the input.
+	if outRate < inRate {
+		cutoff = rolloff * float64(outRate) / float64(inRate)
+	}
+	resampler.halfWidth = int(math.Ceil(zeroCrossings / cutoff))
+	resampler.filters = make([][]float32, resampler.outRate)
+	for phase := range resampler.filters {
+		frac := float64(phase) / float64(resampler.outRate)
+		taps := make([]float32, 2*resampler.halfWidth)
+		for j := range taps {
+			distance := frac + float64(resampler.halfWidth-1-j) // from the output sample to the input sample of the tap.
+			taps[j] = float32(cutoff * sinc(cutoff*distance) * blackman(distance/float64(resampler.halfWidth)))
+		}
+		resampler.filters[phase] = taps
+	}
+	return
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// blackman is the Blackman window, from -1 to 1.
+func blackman(x float64) float64 {
+	if x <= -1 || x >= 1 {
+		return 0
+	}
+	return 0.42 + 0.5*math.Cos(math.Pi*x) + 0.08*math.Cos(2*math.Pi*x)
+}
+
+// position returns the index of the input sample at or before output sample n, and the phase of n.
+func (resampler *Resampler) position(n int64) (index int64, phase int) {
+	scaled := n * int64(resampler.inRate)
+	return scaled / int64(resampler.outRate), int(scaled % int64(resampler.outRate))
+}
+
+// compute the output sample n. Input samples outside the input so far are taken to be 0.
+func (resampler *Resampler) compute(n int64) (sample float32) {
+	index, phase := resampler.position(n)
+	first := index - int64(resampler.halfWidth) + 1 // the input sample of the first tap.
+	for j, tap := range resampler.filters[phase] {
+		i := first + int64(j) - resampler.start
+		if i < 0 || i >= int64(len(resampler.history)) {
+			continue
+		}
+		sample += tap * resampler.history[i]
+	}
+	return
+}
+
+// Write the next input samples, returning as many output samples as can be computed from them.
+func (resampler *Resampler) Write(input []float32) (output []float32) {
+	resampler.history = append(resampler.history, input...)
+	resampler.written += int64(len(input))
+	for {
+		index, _ := resampler.position(resampler.n)
+		if index+int64(resampler.halfWidth) >= resampler.written { // wait for the last tap to be written.
+			break
+		}
+		output = append(output, resampler.compute(resampler.n))
+		resampler.n++
+	}
+	index, _ := resampler.position(resampler.n)
+	if drop := index - int64(resampler.halfWidth) + 1 - resampler.start; drop > 0 { // forget input no longer needed by any tap.
+		if drop > int64(len(resampler.history)) {
+			drop = int64(len(resampler.history))
+		}
+		resampler.history = append(resampler.history[:0], resampler.history[drop:]...)
+		resampler.start += drop
+	}
+	return
+}
+
+// Flush returns the output samples which fall within the input but were waiting for input after it, taking that input to be silence.
+func (resampler *Resampler) Flush() (output []float32) {
+	for {
+		index, _ := resampler.position(resampler.n)
+		if index >= resampler.written {
+			break
+		}
+		output = append(output, resampler.compute(resampler.n))
+		resampler.n++
+	}
+	return
+}
+
+// Resample all of the samples from inRate to outRate.
+func Resample(samples []float32, inRate, outRate int) []float32 {
+	resampler := NewResampler(inRate, outRate)
+	return append(resampler.Write(samples), resampler.Flush()...)
+}
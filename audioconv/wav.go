@@ -0,0 +1,101 @@
+package audioconv
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// WAV format codes.
+const (
+	wavPCM        = 1
+	wavFloat      = 3
+	wavExtensible = 0xFFFE // the real format code is the first 2 bytes of the sub format GUID.
+)
+
+// ParseWav reads the format and the raw audio of a WAV file.
+func ParseWav(wavBytes []byte) (format Format, data []byte, err error) {
+	if len(wavBytes) < 12 || string(wavBytes[0:4]) != "RIFF" || string(wavBytes[8:12]) != "WAVE" {
+		err = errors.New("not a WAV file")
+		return
+	}
+	var fmtChunk []byte
+	for rest := wavBytes[12:]; len(rest) >= 8; {
+		id := string(rest[0:4])
+		size := int(binary.LittleEndian.Uint32(rest[4:8]))
+		rest = rest[8:]
+		if size > len(rest) { // files written as a stream may not know the size of the data, so take what there is.
+			size = len(rest)
+		}
+		switch id {
+		case "fmt ":
+			fmtChunk = rest[:size]
+		case "data":
+			data = rest[:size]
+		}
+		if size%2 == 1 && size < len(rest) { // chunks are padded to an even length.
+			size++
+		}
+		rest = rest[size:]
+	}
+	if fmtChunk == nil || data == nil {
+		err = errors.New("WAV file is missing its fmt or data chunk")
+		return
+	}
+	if len(fmtChunk) < 16 {
+		err = errors.New("WAV fmt chunk is too short")
+		return
+	}
+	code := int(binary.LittleEndian.Uint16(fmtChunk[0:2]))
+	format.Channels = int(binary.LittleEndian.Uint16(fmtChunk[2:4]))
+	format.SampleRate = int(binary.LittleEndian.Uint32(fmtChunk[4:8]))
+	bits := int(binary.LittleEndian.Uint16(fmtChunk[14:16]))
+	if code == wavExtensible {
+		if len(fmtChunk) < 26 {
+			err = errors.New("WAV fmt chunk is too short for WAVE_FORMAT_EXTENSIBLE")
+			return
+		}
+		code = int(binary.LittleEndian.Uint16(fmtChunk[24:26]))
+	}
+	switch {
+	case code == wavPCM && bits == 16:
+		format.Encoding = S16LE
+	case code == wavPCM && bits == 32:
+		format.Encoding = S32LE
+	case code == wavFloat && bits == 32:
+		format.Encoding = FloatLE
+	default:
+		err = errors.New("unsupported WAV format " + strconv.Itoa(code) + " of " + strconv.Itoa(bits) + " bits")
+		return
+	}
+	err = format.Validate()
+	return
+}
+
+// EncodeWav wraps Native audio in a WAV header.
+func EncodeWav(native []byte) (wavBytes []byte) {
+	header := make([]byte, 44)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(36+len(native)))
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], wavPCM)
+	binary.LittleEndian.PutUint16(header[22:], uint16(Native.Channels))
+	binary.LittleEndian.PutUint32(header[24:], uint32(Native.SampleRate))
+	binary.LittleEndian.PutUint32(header[28:], uint32(Native.SampleRate*Native.frameSize())) // bytes per second
+	binary.LittleEndian.PutUint16(header[32:], uint16(Native.frameSize()))
+	binary.LittleEndian.PutUint16(header[34:], uint16(Native.Encoding.Size()*8))
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], uint32(len(native)))
+	return append(header, native...)
+}
+
+// WavToNative converts a WAV file of any supported format into Native audio.
+func WavToNative(wavBytes []byte) (native []byte, err error) {
+	format, data, err := ParseWav(wavBytes)
+	if err != nil {
+		return
+	}
+	native, err = ConvertAll(data, format)
+	return
+}
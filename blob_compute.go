@@ -2,14 +2,18 @@ package main
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	tf "github.com/tensorflow/tensorflow/tensorflow/go"
 	"github.com/tensorflow/tensorflow/tensorflow/go/op"
+	"github.ibm.com/Blue-Horizon/aural2/features"
 	"github.ibm.com/Blue-Horizon/aural2/libaural2"
 	"github.ibm.com/Blue-Horizon/aural2/tfutils"
 	"github.ibm.com/Blue-Horizon/aural2/tfutils/lstmutils"
 	"github.ibm.com/Blue-Horizon/aural2/tftrain"
+	"github.ibm.com/Blue-Horizon/aural2/vad"
 	"image"
+	"image/color"
 	"bytes"
 	"image/png"
 	"io/ioutil"
@@ -32,6 +36,31 @@ func getAudioClipFromFS(id libaural2.ClipID) (audioClip *libaural2.AudioClip, er
 	return
 }
 
+// makeAudioClipToMFCCtensors makes a func for each vocab which gets the features its model takes from the feature cache.
+func makeAudioClipToMFCCtensors(
+	featureCaches map[libaural2.VocabName]*features.Cache,
+) (
+	audioClipToMFCCtensors map[libaural2.VocabName]func(*libaural2.AudioClip) (*tf.Tensor, error),
+	err error,
+) {
+	audioClipToMFCCtensors = map[libaural2.VocabName]func(*libaural2.AudioClip) (*tf.Tensor, error){}
+	for vocabName, cache := range featureCaches {
+		clipToMFCC, err := makeClipToMFCC(cache)
+		if err != nil {
+			return nil, err
+		}
+		audioClipToMFCCtensors[vocabName] = func(clip *libaural2.AudioClip) (mfccTensor *tf.Tensor, err error) {
+			mfccs, err := clipToMFCC(clip)
+			if err != nil {
+				return
+			}
+			mfccTensor, err = tf.NewTensor([][][]float32{mfccs})
+			return
+		}
+	}
+	return
+}
+
 func makeAddRIFF() (addRIFF clipToBlob, err error) {
 	headerString := "5249464624e2040057415645666d74201000000001000100803e0000007d0000020010006461746100e20400"
 	header, err := hex.DecodeString(headerString)
@@ -102,12 +131,13 @@ func makeRenderMFCC() (renderMFCC clipToBlob, err error) {
 
 func makeRenderProbs(
 	onlineSessions map[libaural2.VocabName]*tftrain.OnlineSess, // takes a map of savedModels,
+	featureCaches map[libaural2.VocabName]*features.Cache, // and the cache of the features each takes,
 	) (
 		renderProbs func(*libaural2.AudioClip, libaural2.VocabName, // returns a func that takes a clip and a vocabName
 			) ([]byte, error),
 			err error,
 			) {
-	audioClipToMFCCtensor, err := tfutils.MakeAudioClipToMFCCtensor()
+	audioClipToMFCCtensors, err := makeAudioClipToMFCCtensors(featureCaches)
 	if err != nil {
 		return
 	}
@@ -121,7 +151,7 @@ func makeRenderProbs(
 			err = errors.New("don't have oSess for " + string(vocabName))
 			return
 		}
-		mfccTensor, err := audioClipToMFCCtensor(clip)
+		mfccTensor, err := audioClipToMFCCtensors[vocabName](clip)
 		if err != nil {
 			return
 		}
@@ -142,11 +172,12 @@ func makeRenderProbs(
 
 func makeRenderArgmaxedStates(
 	onlineSessions map[libaural2.VocabName]*tftrain.OnlineSess,
+	featureCaches map[libaural2.VocabName]*features.Cache,
 	) (
 		renderProbs func(*libaural2.AudioClip, libaural2.VocabName) ([]byte, error),
 		err error,
 		) {
-	audioClipToMFCCtensor, err := tfutils.MakeAudioClipToMFCCtensor()
+	audioClipToMFCCtensors, err := makeAudioClipToMFCCtensors(featureCaches)
 	if err != nil {
 		return
 	}
@@ -157,7 +188,7 @@ func makeRenderArgmaxedStates(
 			return
 		}
 
-		mfccTensor, err := audioClipToMFCCtensor(clip)
+		mfccTensor, err := audioClipToMFCCtensors[vocabName](clip)
 		if err != nil {
 			return
 		}
@@ -183,13 +214,49 @@ func makeRenderArgmaxedStates(
 	return
 }
 
+// makeRenderDraftLabelSet returns a func which drafts a serialized LabelSet from the outputs of the current model.
+func makeRenderDraftLabelSet(
+	onlineSessions map[libaural2.VocabName]*tftrain.OnlineSess,
+	featureCaches map[libaural2.VocabName]*features.Cache,
+	params libaural2.DraftParams,
+) (
+	renderDraft func(*libaural2.AudioClip, libaural2.VocabName) ([]byte, error),
+	err error,
+) {
+	audioClipToMFCCtensors, err := makeAudioClipToMFCCtensors(featureCaches)
+	if err != nil {
+		return
+	}
+	renderDraft = func(clip *libaural2.AudioClip, vocabName libaural2.VocabName) (serialized []byte, err error) {
+		oSess, prs := onlineSessions[vocabName]
+		if !prs {
+			err = errors.New("don't have oSess for " + string(vocabName))
+			return
+		}
+		mfccTensor, err := audioClipToMFCCtensors[vocabName](clip)
+		if err != nil {
+			return
+		}
+		probsTensor, err := oSess.Infer(mfccTensor)
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+		labelSet := libaural2.DraftLabelSet(vocabName, clip.ID(), probsTensor.Value().([][]float32), params)
+		serialized, err = labelSet.Serialize()
+		return
+	}
+	return
+}
+
 func makeRenderLSTMstate(
 	onlineSessions map[libaural2.VocabName]*tftrain.OnlineSess,
+	featureCaches map[libaural2.VocabName]*features.Cache,
 	) (
 		renderState func(*libaural2.AudioClip, libaural2.VocabName) ([]byte, error),
 		err error,
 		) {
-	audioClipToMFCCtensor, err := tfutils.MakeAudioClipToMFCCtensor()
+	audioClipToMFCCtensors, err := makeAudioClipToMFCCtensors(featureCaches)
 	if err != nil {
 		return
 	}
@@ -206,7 +273,7 @@ func makeRenderLSTMstate(
 			err = errors.New("don't have renderLSTMstates for " + string(vocabName))
 			return
 		}
-		mfccTensor, err := audioClipToMFCCtensor(clip)
+		mfccTensor, err := audioClipToMFCCtensors[vocabName](clip)
 		if err != nil {
 			return
 		}
@@ -219,6 +286,48 @@ func makeRenderLSTMstate(
 	return
 }
 
+// makeRenderVAD returns a func which renders which strides of a clip are speech, as found by the default energy VAD.
+// Speech is green, brighter the more likely it is to be speech, silence is grey.
+func makeRenderVAD() (renderVAD clipToBlob, err error) {
+	renderVAD = func(clip *libaural2.AudioClip, vocabName libaural2.VocabName) (imageBytes []byte, err error) {
+		_, speech, probs, err := vad.DefaultGate().Segments(features.PCMFromInt16LE(clip[:]))
+		if err != nil {
+			return
+		}
+		image := image.NewRGBA(image.Rect(0, 0, libaural2.StridesPerClip, 1))
+		for x, isSpeech := range speech {
+			if isSpeech {
+				image.Set(x, 0, colorful.Hsv(120, 1, 0.5+0.5*float64(probs[x])))
+				continue
+			}
+			image.Set(x, 0, color.Gray{Y: uint8(32 + 64*probs[x])})
+		}
+		buff := bytes.Buffer{}
+		if err = png.Encode(&buff, image); err != nil {
+			return
+		}
+		imageBytes = buff.Bytes()
+		return
+	}
+	return
+}
+
+// makeRenderVADsegments returns a func which lists the spans of speech in a clip as JSON, to help split it up for labeling.
+func makeRenderVADsegments() (renderSegments clipToBlob, err error) {
+	renderSegments = func(clip *libaural2.AudioClip, vocabName libaural2.VocabName) (serialized []byte, err error) {
+		segments, _, _, err := vad.DefaultGate().Segments(features.PCMFromInt16LE(clip[:]))
+		if err != nil {
+			return
+		}
+		if segments == nil {
+			segments = []vad.Segment{}
+		}
+		serialized, err = json.Marshal(segments)
+		return
+	}
+	return
+}
+
 // argmax returns the index and prob of the largest elements of the list.
 func argmax(probs []float32) (cmd libaural2.State, prob float32) {
 	for i, val := range probs {
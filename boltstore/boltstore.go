@@ -1,14 +1,25 @@
 package boltstore
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.ibm.com/Blue-Horizon/aural2/libaural2"
 )
 
 var clipBucketName = []byte("clips")
+var featuresBucketName = []byte("features")
+var importsBucketName = []byte("imports")
+
+// ImportInfo records where an imported clip came from.
+type ImportInfo struct {
+	Source   string    `json:"source"`   // name of the recording the clip was cut from
+	Offset   float64   `json:"offset"`   // seconds into the recording at which the clip starts
+	Imported time.Time `json:"imported"` // when the clip was imported
+}
 
 // DB holds
 type DB struct {
@@ -26,6 +37,14 @@ func Init(path string, vocabNames []libaural2.VocabName) (db DB, err error) {
 		if err != nil {
 			return fmt.Errorf("create bucket: %s", err)
 		}
+		_, err = tx.CreateBucketIfNotExists(featuresBucketName)
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		_, err = tx.CreateBucketIfNotExists(importsBucketName)
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
 		for _, vocabName := range vocabNames {
 			_, err = tx.CreateBucketIfNotExists([]byte(vocabName))
 			if err != nil {
@@ -127,3 +146,73 @@ func (db DB) ListAudioClips() (ids []libaural2.ClipID) {
 	})
 	return
 }
+
+// PutImportInfo records where an imported clip came from.
+func (db DB) PutImportInfo(id libaural2.ClipID, info ImportInfo) (err error) {
+	serialized, err := json.Marshal(info)
+	if err != nil {
+		return
+	}
+	err = db.boltConn.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(importsBucketName)
+		return b.Put(id[:], serialized)
+	})
+	return
+}
+
+// GetImportInfo gets where a clip came from. prs is false if the clip was not imported.
+func (db DB) GetImportInfo(id libaural2.ClipID) (info ImportInfo, prs bool, err error) {
+	err = db.boltConn.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(importsBucketName)
+		serialized := b.Get(id[:])
+		if serialized == nil {
+			return nil
+		}
+		prs = true
+		return json.Unmarshal(serialized, &info)
+	})
+	return
+}
+
+// GetFeatures gets cached features, or nil if they are not in the DB.
+func (db DB) GetFeatures(key []byte) (value []byte, err error) {
+	err = db.boltConn.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(featuresBucketName)
+		if stored := b.Get(key); stored != nil {
+			value = append([]byte{}, stored...) // bolt only owns the stored bytes for the life of the transaction.
+		}
+		return nil
+	})
+	return
+}
+
+// PutFeatures inserts cached features into the DB.
+func (db DB) PutFeatures(key, value []byte) (err error) {
+	err = db.boltConn.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(featuresBucketName)
+		return b.Put(key, value)
+	})
+	return
+}
+
+// PruneFeatures deletes all cached features whose key keep returns false for, such as the features of configs no longer used.
+func (db DB) PruneFeatures(keep func(key []byte) bool) (pruned int, err error) {
+	err = db.boltConn.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(featuresBucketName)
+		var stale [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if !keep(k) {
+				stale = append(stale, append([]byte{}, k...)) // deleting while iterating confuses the cursor, so delete afterwards.
+			}
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		pruned = len(stale)
+		return nil
+	})
+	return
+}
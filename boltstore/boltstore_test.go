@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"os"
 	"testing"
+	"time"
 
 	"github.ibm.com/Blue-Horizon/aural2/libaural2"
 )
@@ -100,3 +101,80 @@ func TestGetLabelSet(t *testing.T) {
 	}
 	os.Remove("test.db")
 }
+
+func TestFeatures(t *testing.T) {
+	db, err := Init("test.db", []libaural2.VocabName{"intent"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer db.Close()
+	value, err := db.GetFeatures([]byte("missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != nil {
+		t.Fatal("missing features should be nil")
+	}
+	for _, key := range []string{"a-old", "b-new", "c-old", "d-new"} {
+		if err = db.PutFeatures([]byte(key), []byte("features of "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	value, err = db.GetFeatures([]byte("b-new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "features of b-new" {
+		t.Fatal("wrong features:", string(value))
+	}
+	pruned, err := db.PruneFeatures(func(key []byte) bool {
+		return string(key[1:]) == "-new"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 2 {
+		t.Fatal("expected to prune 2, pruned", pruned)
+	}
+	for key, present := range map[string]bool{"a-old": false, "b-new": true, "c-old": false, "d-new": true} {
+		if value, err = db.GetFeatures([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		if (value != nil) != present {
+			t.Fatal(key, "should be present:", present)
+		}
+	}
+}
+
+func TestImportInfo(t *testing.T) {
+	db, err := Init("test.db", []libaural2.VocabName{"word", "intent", "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer db.Close()
+	id := libaural2.ClipID(sha256.Sum256([]byte("some fake raw data")))
+	_, prs, err := db.GetImportInfo(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prs {
+		t.Fatal("clip has not been imported")
+	}
+	info := ImportInfo{
+		Source:   "meeting.wav",
+		Offset:   5,
+		Imported: time.Unix(1500000000, 0).UTC(),
+	}
+	if err = db.PutImportInfo(id, info); err != nil {
+		t.Fatal(err)
+	}
+	got, prs, err := db.GetImportInfo(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !prs || got != info {
+		t.Fatal("expected", info, "got", got)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.ibm.com/Blue-Horizon/aural2/calibrate"
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+	"github.ibm.com/Blue-Horizon/aural2/vsh"
+)
+
+// defaultResetProb is the reset prob of states which no rule is for.
+const defaultResetProb float32 = 0.2
+
+// calibrationSequences replays the labeled clips of the vocab, returning the decoded probs and labels of each stride of each.
+// Decoders with a lag give the probs of each stride that many results late, so the probs are moved back to line up with the labels.
+func calibrationSequences(rp *replayer, vocab *libaural2.Vocabulary) (sequences []calibrate.Sequence, err error) {
+	decoders, err := loadDecoders(rp.decodingPath, rp.vocabs)
+	if err != nil {
+		return
+	}
+	var lag int
+	if decoder, prs := decoders[vocab.Name]; prs {
+		lag = decoder.Lag()
+	}
+	recs, err := readLabeledClips(vocab)
+	if err != nil {
+		return
+	}
+	if len(recs) == 0 {
+		return nil, errors.New("no labeled clips of " + string(vocab.Name))
+	}
+	for _, rec := range recs {
+		var probs [][]float32
+		err = rp.run(rec, func(now time.Time, decoded vsh.Result, utterances []vsh.Utterance) {
+			probs = append(probs, decoded.Probs[vocab.Name])
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", rec.source, err)
+		}
+		labels := (&libaural2.LabelSet{Labels: rec.labels}).ToStateArray()
+		sequence := calibrate.Sequence{Labels: labels[:]}
+		for i := range labels {
+			var strideProbs []float32
+			if i+lag < len(probs) {
+				strideProbs = probs[i+lag]
+			}
+			sequence.Probs = append(sequence.Probs, strideProbs)
+		}
+		sequences = append(sequences, sequence)
+	}
+	return
+}
+
+// resetProbOf returns the reset prob of the first rule for the state, as the firings of the state are found as that rule would find them.
+func resetProbOf(rules []vsh.Rule, vocab *libaural2.Vocabulary, state libaural2.State) float32 {
+	for _, rule := range rules {
+		if rule.Vocab == vocab.Name && rule.State == vocab.Names[state] {
+			return rule.ResetProb
+		}
+	}
+	return defaultResetProb
+}
+
+// writeThresholds sets the threshold of each rule for a recommended state, and writes the rules to rulesPath, if they are still good, telling w what it changed.
+// Rules with more then one threshold are left as they are, as each threshold has an action of its own.
+// A changed rule keeps the name of its action, so that clients which look for it keep working.
+// Recommendations which miss the targets are only written if unmet.
+func writeThresholds(rp *replayer, vocab *libaural2.Vocabulary, recs []calibrate.Recommendation, rulesPath string, unmet bool, w io.Writer) (err error) {
+	rules := append([]vsh.Rule{}, rp.rules...)
+	byName := map[string]calibrate.Recommendation{}
+	for _, rec := range recs {
+		byName[rec.Name] = rec
+	}
+	for i, rule := range rules {
+		rec, prs := byName[rule.State]
+		if rule.Vocab != vocab.Name || !prs {
+			continue
+		}
+		if len(rule.Thresholds) != 1 {
+			fmt.Fprintln(w, "not changing rule", rule.Name, "as it has", len(rule.Thresholds), "thresholds")
+			continue
+		}
+		if !rec.Met && !unmet {
+			fmt.Fprintln(w, "not changing rule", rule.Name, "as", rec.Threshold, "misses the targets, give -write-unmet to write it anyway")
+			continue
+		}
+		if rec.Threshold == rule.Thresholds[0] {
+			fmt.Fprintln(w, "not changing rule", rule.Name, "as its threshold is already", rec.Threshold)
+			continue
+		}
+		if rules[i].Action == "" {
+			rules[i].Action = rule.ActionName(rule.Thresholds[0])
+		}
+		fmt.Fprintln(w, "changing the threshold of rule", rule.Name, "from", rule.Thresholds[0], "to", rec.Threshold, "keeping the name of its action", rules[i].Action)
+		rules[i].Thresholds = []float32{rec.Threshold}
+	}
+	rulesBytes, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return
+	}
+	if _, err = vsh.ParseRules(rulesBytes, rp.vocabs, rp.makers); err != nil { // a bad rules file would keep aural2 from starting.
+		return fmt.Errorf("not writing the new rules: %v", err)
+	}
+	err = ioutil.WriteFile(rulesPath, append(rulesBytes, '\n'), 0644)
+	return
+}
+
+// runCalibrate replays the labeled clips of a vocab through its model and decoder, such as `aural2 calibrate -fa-per-hour 0.5 intent`, and recommends a threshold for each state.
+// Like replay, it opens the DB and models of persist/, so aural2 must not be running.
+func runCalibrate(args []string, w io.Writer) (err error) {
+	flags := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	faPerHour := flags.Float64("fa-per-hour", 1, "most false accepts per hour of audio to accept")
+	missRate := flags.Float64("miss-rate", 0.1, "largest fraction of utterances to miss")
+	tolerance := flags.Int("tolerance", 10, "strides before or after a labeled utterance in which the action may still fire for it")
+	jsonOutput := flags.Bool("json", false, "write the recommendations as JSON lines")
+	curvesPath := flags.String("curves", "", "write the ROC and DET curve of each state to this file as JSON")
+	write := flags.Bool("write", false, "write the recommended thresholds into the rules file")
+	writeUnmet := flags.Bool("write-unmet", false, "with -write, also write recommendations which miss the targets")
+	rulesPath := flags.String("rules", envPath("RULES", "persist/rules.json"), "rules file")
+	decodingPath := flags.String("decoding", envPath("DECODING", "persist/decoding.json"), "decoding file")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: aural2 calibrate [-fa-per-hour n] [-miss-rate n] [-tolerance strides] [-json] [-curves file] [-write [-write-unmet]] [-rules file] [-decoding file] vocab")
+	}
+	rp, err := newReplayer(*rulesPath, *decodingPath)
+	if err != nil {
+		return
+	}
+	vocab, prs := rp.vocabs[libaural2.VocabName(flags.Arg(0))]
+	if !prs {
+		return errors.New("unknown vocab " + flags.Arg(0))
+	}
+	sequences, err := calibrationSequences(rp, vocab)
+	if err != nil {
+		return
+	}
+	targets := calibrate.Targets{FalseAcceptsPerHour: *faPerHour, MissRate: *missRate}
+	var curves []calibrate.Curve
+	var recs []calibrate.Recommendation
+	for state := libaural2.State(1); int(state) < vocab.Size; state++ { // Nil is what the other states are told apart from.
+		config := calibrate.Config{ResetProb: resetProbOf(rp.rules, vocab, state), Tolerance: *tolerance, StrideDuration: strideDuration}
+		curve := calibrate.Compute(sequences, vocab, state, config)
+		if curve.Utterances == 0 {
+			logger.Println("no labeled utterances of", curve.Name)
+			continue
+		}
+		if len(curve.Points) == 0 {
+			logger.Println("no thresholds above the reset prob of", curve.Name, config.ResetProb)
+			continue
+		}
+		curves = append(curves, curve)
+		recs = append(recs, curve.Recommend(targets))
+	}
+	encoder := json.NewEncoder(w)
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(table, "state\tutterances\tthreshold\tmiss rate\tfalse accepts/hour\tmet\n")
+	for i, rec := range recs {
+		if *jsonOutput {
+			if err = encoder.Encode(rec); err != nil {
+				return
+			}
+			continue
+		}
+		fmt.Fprintf(table, "%s\t%d\t%v\t%.3f\t%.2f\t%v\n", rec.Name, curves[i].Utterances, rec.Threshold, rec.MissRate, rec.FalseAcceptsPerHour, rec.Met)
+	}
+	if !*jsonOutput {
+		if err = table.Flush(); err != nil {
+			return
+		}
+	}
+	if *curvesPath != "" {
+		curvesBytes, err := json.MarshalIndent(curves, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(*curvesPath, curvesBytes, 0644); err != nil {
+			return err
+		}
+	}
+	if *write {
+		notes := w
+		if *jsonOutput { // so that the notes don't break the JSON lines.
+			notes = os.Stderr
+		}
+		err = writeThresholds(rp, vocab, recs, *rulesPath, *writeUnmet, notes)
+	}
+	return
+}
@@ -0,0 +1,201 @@
+// Package calibrate measures how well the probs of a state find labeled utterances of it, at each of many thresholds, so that the thresholds of rules need not be guessed.
+package calibrate
+
+import (
+	"time"
+
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+)
+
+// Thresholds are the thresholds at which curves are computed, finer near 1 where most rules are.
+var Thresholds = []float32{
+	0.05, 0.1, 0.15, 0.2, 0.25, 0.3, 0.35, 0.4, 0.45, 0.5, 0.55, 0.6, 0.65, 0.7, 0.75, 0.8, 0.85, 0.9,
+	0.91, 0.92, 0.93, 0.94, 0.95, 0.96, 0.97, 0.98, 0.99, 0.995, 0.999,
+}
+
+// Sequence is the probs of each stride of one labeled clip, and the labeled state of each stride.
+type Sequence struct {
+	Probs  [][]float32       // probs of the vocab, nil for strides the model gave none for
+	Labels []libaural2.State // must be as long as Probs
+}
+
+// Point is how well the prob of a state finds its utterances at one threshold.
+type Point struct {
+	Threshold           float32 `json:"threshold"`
+	MissRate            float64 `json:"miss_rate"`              // fraction of labeled utterances which the action did not fire for
+	FalseAcceptsPerHour float64 `json:"false_accepts_per_hour"` // firings which were not the first of a labeled utterance, per hour of audio
+	TruePositiveRate    float64 `json:"true_positive_rate"`     // fraction of strides labeled the state whose prob is above the threshold
+	FalsePositiveRate   float64 `json:"false_positive_rate"`    // fraction of strides not labeled the state whose prob is above the threshold
+}
+
+// Curve is the points of one state, in order of threshold. Plotting TruePositiveRate against FalsePositiveRate gives the ROC curve, and MissRate against FalseAcceptsPerHour the DET curve.
+type Curve struct {
+	State      libaural2.State `json:"state"`
+	Name       string          `json:"name"`
+	Utterances int             `json:"utterances"` // number of labeled utterances
+	Hours      float64         `json:"hours"`      // hours of audio
+	Points     []Point         `json:"points"`
+}
+
+// Config is how firings are found and matched to utterances.
+type Config struct {
+	ResetProb      float32       // the prob must fall below this before the action can fire again, as in the broker
+	Tolerance      int           // a firing this many strides before or after an utterance still counts for it
+	StrideDuration time.Duration // time one stride lasts
+}
+
+// span is a run of strides, [start, end).
+type span struct {
+	start, end int
+}
+
+// utterances finds the runs of strides labeled state.
+func utterances(labels []libaural2.State, state libaural2.State) (spans []span) {
+	for i := 0; i < len(labels); i++ {
+		if labels[i] != state {
+			continue
+		}
+		start := i
+		for i < len(labels) && labels[i] == state {
+			i++
+		}
+		spans = append(spans, span{start: start, end: i})
+	}
+	return
+}
+
+// probOf returns the prob of the state, or 0 if the stride has none.
+func probOf(probs []float32, state libaural2.State) float32 {
+	if int(state) >= len(probs) {
+		return 0
+	}
+	return probs[state]
+}
+
+// firings finds the strides at which an action with the threshold would fire, as Action.step does, but without a cooldown.
+func firings(sequence Sequence, state libaural2.State, threshold float32, resetProb float32) (strides []int) {
+	ended := true
+	for i, probs := range sequence.Probs {
+		prob := probOf(probs, state)
+		if prob > threshold && ended {
+			ended = false
+			strides = append(strides, i)
+		}
+		if prob < resetProb {
+			ended = true
+		}
+	}
+	return
+}
+
+// Compute computes the curve of the state over the sequences, at each of Thresholds above the reset prob, as a rule can have no other.
+func Compute(sequences []Sequence, vocab *libaural2.Vocabulary, state libaural2.State, config Config) (curve Curve) {
+	curve = Curve{State: state, Name: vocab.Names[state]}
+	var strides int
+	for _, sequence := range sequences {
+		strides += len(sequence.Labels)
+		curve.Utterances += len(utterances(sequence.Labels, state))
+	}
+	curve.Hours = (time.Duration(strides) * config.StrideDuration).Hours()
+	for _, threshold := range Thresholds {
+		if threshold <= config.ResetProb {
+			continue
+		}
+		var missed, falseAccepts, truePositives, positives, falsePositives, negatives int
+		for _, sequence := range sequences {
+			spans := utterances(sequence.Labels, state)
+			found := make([]bool, len(spans))
+			for _, stride := range firings(sequence, state, threshold, config.ResetProb) {
+				hit := false
+				for i, utterance := range spans {
+					if !found[i] && stride >= utterance.start-config.Tolerance && stride < utterance.end+config.Tolerance {
+						found[i] = true
+						hit = true
+						break
+					}
+				}
+				if !hit { // a firing outside any utterance, or a second firing for one, would run the action again.
+					falseAccepts++
+				}
+			}
+			for _, isFound := range found {
+				if !isFound {
+					missed++
+				}
+			}
+			for i, label := range sequence.Labels {
+				above := probOf(sequence.Probs[i], state) > threshold
+				if label == state {
+					positives++
+					if above {
+						truePositives++
+					}
+				} else {
+					negatives++
+					if above {
+						falsePositives++
+					}
+				}
+			}
+		}
+		point := Point{Threshold: threshold}
+		if curve.Utterances > 0 {
+			point.MissRate = float64(missed) / float64(curve.Utterances)
+		}
+		if curve.Hours > 0 {
+			point.FalseAcceptsPerHour = float64(falseAccepts) / curve.Hours
+		}
+		if positives > 0 {
+			point.TruePositiveRate = float64(truePositives) / float64(positives)
+		}
+		if negatives > 0 {
+			point.FalsePositiveRate = float64(falsePositives) / float64(negatives)
+		}
+		curve.Points = append(curve.Points, point)
+	}
+	return
+}
+
+// Targets are the most false accepts and misses which are acceptable.
+type Targets struct {
+	FalseAcceptsPerHour float64
+	MissRate            float64
+}
+
+// Recommendation is the threshold recommended for a state.
+type Recommendation struct {
+	Point
+	State libaural2.State `json:"state"`
+	Name  string          `json:"name"`
+	Met   bool            `json:"met"` // false if no threshold meets both targets
+}
+
+// Recommend picks the threshold which misses the fewest utterances while keeping false accepts within the target.
+// If no threshold keeps false accepts within the target, the one with the fewest is picked.
+// Ties go to the highest threshold, which is likely to give fewer false accepts on audio unlike the clips.
+func (curve Curve) Recommend(targets Targets) (rec Recommendation) {
+	rec = Recommendation{State: curve.State, Name: curve.Name}
+	best := -1
+	for i, point := range curve.Points { // the points are in order of threshold, so a later point which is as good is at a higher threshold.
+		if point.FalseAcceptsPerHour > targets.FalseAcceptsPerHour {
+			continue
+		}
+		if best == -1 || point.MissRate < curve.Points[best].MissRate ||
+			(point.MissRate == curve.Points[best].MissRate && point.FalseAcceptsPerHour <= curve.Points[best].FalseAcceptsPerHour) {
+			best = i
+		}
+	}
+	if best == -1 {
+		for i, point := range curve.Points {
+			if best == -1 || point.FalseAcceptsPerHour <= curve.Points[best].FalseAcceptsPerHour {
+				best = i
+			}
+		}
+	}
+	if best == -1 {
+		return
+	}
+	rec.Point = curve.Points[best]
+	rec.Met = rec.FalseAcceptsPerHour <= targets.FalseAcceptsPerHour && rec.MissRate <= targets.MissRate
+	return
+}
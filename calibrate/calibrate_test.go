@@ -0,0 +1,97 @@
+package calibrate
+
+import (
+	"testing"
+	"time"
+
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+)
+
+const play libaural2.State = 1
+
+var testVocab = libaural2.Vocabulary{
+	Name:  "test",
+	Size:  2,
+	Names: map[libaural2.State]string{libaural2.Nil: "Nil", play: "Play"},
+}
+
+// testConfig makes 40 strides last an hour, so that false accepts per hour are counts.
+var testConfig = Config{ResetProb: 0.2, Tolerance: 2, StrideDuration: 90 * time.Second}
+
+// twoPlays is a sure Play which dips for a stride, a less sure Play, and a spike of Play in silence.
+func twoPlays() (sequence Sequence) {
+	playProbs := map[int]float32{10: 0.97, 11: 0.97, 12: 0.1, 13: 0.97, 14: 0.97, 25: 0.85, 26: 0.85, 27: 0.85, 28: 0.85, 29: 0.85, 35: 0.92}
+	for i := 0; i < 40; i++ {
+		prob := playProbs[i]
+		sequence.Probs = append(sequence.Probs, []float32{1 - prob, prob})
+		label := libaural2.Nil
+		if (i >= 10 && i < 15) || (i >= 25 && i < 30) {
+			label = play
+		}
+		sequence.Labels = append(sequence.Labels, label)
+	}
+	return
+}
+
+// pointAt finds the point of the curve at the threshold.
+func pointAt(t *testing.T, curve Curve, threshold float32) Point {
+	for _, point := range curve.Points {
+		if point.Threshold == threshold {
+			return point
+		}
+	}
+	t.Fatal("no point at", threshold)
+	return Point{}
+}
+
+func TestCompute(t *testing.T) {
+	curve := Compute([]Sequence{twoPlays()}, &testVocab, play, testConfig)
+	if curve.Utterances != 2 || curve.Hours != 1 || curve.Name != "Play" {
+		t.Fatal("expected 2 utterances in an hour of Play, got", curve.Utterances, curve.Hours, curve.Name)
+	}
+	var above int
+	for _, threshold := range Thresholds {
+		if threshold > testConfig.ResetProb {
+			above++
+		}
+	}
+	if len(curve.Points) != above || curve.Points[0].Threshold <= testConfig.ResetProb {
+		t.Fatal("expected a point for each threshold above the reset prob, got", len(curve.Points), "from", curve.Points[0].Threshold)
+	}
+	expected := []Point{
+		{Threshold: 0.8, MissRate: 0, FalseAcceptsPerHour: 2}, // the second firing of the dip, and the spike.
+		{Threshold: 0.9, MissRate: 0.5, FalseAcceptsPerHour: 2},
+		{Threshold: 0.95, MissRate: 0.5, FalseAcceptsPerHour: 1},
+		{Threshold: 0.97, MissRate: 1, FalseAcceptsPerHour: 0},
+	}
+	for _, want := range expected {
+		got := pointAt(t, curve, want.Threshold)
+		if got.MissRate != want.MissRate || got.FalseAcceptsPerHour != want.FalseAcceptsPerHour {
+			t.Fatal("at", want.Threshold, "expected", want, "got", got)
+		}
+	}
+	point := pointAt(t, curve, 0.9)
+	if point.TruePositiveRate != 0.4 || point.FalsePositiveRate != 1.0/30 {
+		t.Fatal("wrong rates of strides at 0.9", point)
+	}
+}
+
+func TestRecommend(t *testing.T) {
+	curve := Compute([]Sequence{twoPlays()}, &testVocab, play, testConfig)
+	rec := curve.Recommend(Targets{FalseAcceptsPerHour: 1, MissRate: 0.5})
+	if rec.Threshold != 0.96 || !rec.Met || rec.Name != "Play" {
+		t.Fatal("expected 0.96, the highest threshold which still finds the sure Play, got", rec)
+	}
+	rec = curve.Recommend(Targets{FalseAcceptsPerHour: 0.5, MissRate: 0.5})
+	if rec.Threshold != Thresholds[len(Thresholds)-1] || rec.Met {
+		t.Fatal("expected the highest threshold, as all which meet the false accepts miss everything, got", rec)
+	}
+	rec = curve.Recommend(Targets{FalseAcceptsPerHour: 2, MissRate: 0})
+	if rec.Threshold != 0.8 || !rec.Met {
+		t.Fatal("expected 0.8, the highest threshold which finds both Plays, got", rec)
+	}
+	clean := Compute([]Sequence{twoPlays()}, &testVocab, play, Config{ResetProb: 0.5, Tolerance: 2, StrideDuration: 90 * time.Second})
+	if rec = clean.Recommend(Targets{FalseAcceptsPerHour: 100, MissRate: 1}); rec.Threshold <= 0.5 {
+		t.Fatal("should never recommend a threshold at or below the reset prob, got", rec)
+	}
+}
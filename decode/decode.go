@@ -0,0 +1,383 @@
+// Package decode turns the probabilities a model gives each stride into decisions about which state is being said,
+// smoothing away the flicker of the raw softmax, and into utterances with a start, an end and a confidence.
+package decode
+
+import (
+	"errors"
+	"math"
+
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+)
+
+// Strategies of decoding.
+const (
+	None          = "none"       // act on the raw probs.
+	MovingAverage = "average"    // average the probs over a window of strides.
+	Hysteresis    = "hysteresis" // a state starts when its prob rises above On, and ends when it falls below Off.
+	HMM           = "hmm"        // find the most likely sequence of states with the Viterbi algorithm, with minimum durations and a penalty for switching states.
+)
+
+// Decision is what a Decoder decided about one stride.
+type Decision struct {
+	Stride int             // index of the stride, counting from the first stride the decoder was given.
+	Probs  []float32       // the probs to act on.
+	State  libaural2.State // the state being said, Nil if none.
+	Prob   float32         // the raw prob of the state.
+}
+
+// Decoder decides which state is being said at each stride.
+// Decoders which need to see the strides after a stride to decide on it, decide Lag() strides late.
+type Decoder interface {
+	Step(probs []float32) (decision Decision, ok bool) // ok is false until the first stride has been decided.
+	Lag() int
+}
+
+// Config configures a Decoder, such as {"strategy": "hmm", "min_duration": 3, "min_durations": {"ShutDown": 10}, "switch_penalty": 8, "lag": 10}.
+type Config struct {
+	Strategy      string         `json:"strategy"`
+	Window        int            `json:"window"`         // MovingAverage: number of strides to average, default 5
+	Threshold     float32        `json:"threshold"`      // MovingAverage: the average prob above which a state is being said, default 0.5
+	On            float32        `json:"on"`             // Hysteresis: prob above which a state starts, default 0.8
+	Off           float32        `json:"off"`            // Hysteresis: prob below which it ends, default 0.3
+	MinDuration   int            `json:"min_duration"`   // HMM: fewest strides any state but Nil may last, default 3
+	MinDurations  map[string]int `json:"min_durations"`  // HMM: fewest strides named states may last
+	SwitchPenalty float64        `json:"switch_penalty"` // HMM: log prob lost by switching state, default 5
+	Lag           int            `json:"lag"`            // HMM: strides to wait before deciding on a stride, default 10
+}
+
+// New makes a Decoder for a vocabulary.
+func New(config Config, vocab libaural2.Vocabulary) (decoder Decoder, err error) {
+	switch config.Strategy {
+	case "", None:
+		decoder = &passThrough{}
+	case MovingAverage:
+		window, threshold := config.Window, config.Threshold
+		if window == 0 {
+			window = 5
+		}
+		if threshold == 0 {
+			threshold = 0.5
+		}
+		if window < 1 || threshold >= 1 {
+			err = errors.New("window must be at least 1, and threshold less then 1")
+			return
+		}
+		decoder = &movingAverage{window: window, threshold: threshold}
+	case Hysteresis:
+		on, off := config.On, config.Off
+		if on == 0 {
+			on = 0.8
+		}
+		if off == 0 {
+			off = 0.3
+		}
+		if off < 0 || on <= off || on >= 1 {
+			err = errors.New("on must be above off, and less then 1")
+			return
+		}
+		decoder = &hysteresis{on: on, off: off}
+	case HMM:
+		decoder, err = newViterbi(config, vocab)
+	default:
+		err = errors.New("unknown decoding strategy " + config.Strategy)
+	}
+	return
+}
+
+// argmax returns the most likely state.
+func argmax(probs []float32) (state libaural2.State) {
+	for i, prob := range probs {
+		if prob > probs[state] {
+			state = libaural2.State(i)
+		}
+	}
+	return
+}
+
+// oneHot returns probs which are 1 for the state, and 0 for the rest.
+func oneHot(size int, state libaural2.State) (probs []float32) {
+	probs = make([]float32, size)
+	probs[state] = 1
+	return
+}
+
+// passThrough decides on the most likely state, and leaves the probs alone.
+type passThrough struct {
+	stride int
+}
+
+func (decoder *passThrough) Step(probs []float32) (decision Decision, ok bool) {
+	state := argmax(probs)
+	decision = Decision{Stride: decoder.stride, Probs: probs, State: state, Prob: probs[state]}
+	decoder.stride++
+	return decision, true
+}
+
+func (decoder *passThrough) Lag() int { return 0 }
+
+// movingAverage averages the probs of the last window strides.
+type movingAverage struct {
+	window    int
+	threshold float32
+	history   [][]float32
+	stride    int
+}
+
+func (decoder *movingAverage) Step(probs []float32) (decision Decision, ok bool) {
+	decoder.history = append(decoder.history, probs)
+	if len(decoder.history) > decoder.window {
+		decoder.history = decoder.history[1:]
+	}
+	smoothed := make([]float32, len(probs))
+	for _, past := range decoder.history {
+		for i, prob := range past {
+			if i < len(smoothed) {
+				smoothed[i] += prob / float32(len(decoder.history))
+			}
+		}
+	}
+	state := argmax(smoothed)
+	if smoothed[state] < decoder.threshold {
+		state = libaural2.Nil
+	}
+	decision = Decision{Stride: decoder.stride, Probs: smoothed, State: state, Prob: probs[state]}
+	decoder.stride++
+	return decision, true
+}
+
+func (decoder *movingAverage) Lag() int { return 0 }
+
+// hysteresis holds a state from when its prob rises above on until it falls below off.
+type hysteresis struct {
+	on, off float32
+	state   libaural2.State
+	stride  int
+}
+
+func (decoder *hysteresis) Step(probs []float32) (decision Decision, ok bool) {
+	if decoder.state != libaural2.Nil && probs[decoder.state] < decoder.off {
+		decoder.state = libaural2.Nil
+	}
+	if best := argmax(probs); best != decoder.state && probs[best] > decoder.on { // another state may take over, but only if it is sure.
+		decoder.state = best
+	}
+	decision = Decision{Stride: decoder.stride, Probs: oneHot(len(probs), decoder.state), State: decoder.state, Prob: probs[decoder.state]}
+	decoder.stride++
+	return decision, true
+}
+
+func (decoder *hysteresis) Lag() int { return 0 }
+
+// probFloor keeps the log of a prob of 0 finite.
+const probFloor = 1e-6
+
+// viterbi finds the most likely sequence of states, treating the softmax of the model as the emission probs of an HMM.
+// To give each state a minimum duration, state s is expanded into a chain of minDurations[s] substates, which must be passed through in order,
+// the last of which may repeat, or switch to the first substate of another state at the cost of the switch penalty.
+// The decision on each stride is made lag strides later, from the best path at that time.
+type viterbi struct {
+	numStates   int
+	first       []int             // index of the first substate of each state
+	stateOf     []libaural2.State // the state of each substate
+	penalty     float64
+	lag         int
+	scores      []float64 // log prob of the best path ending in each substate
+	backPtrs    [][]int32 // for the last lag+1 strides, the substate before each substate on its best path.
+	rawProbs    [][]float32
+	stride      int
+	initialized bool
+}
+
+func newViterbi(config Config, vocab libaural2.Vocabulary) (decoder *viterbi, err error) {
+	minDuration, penalty, lag := config.MinDuration, config.SwitchPenalty, config.Lag
+	if minDuration == 0 {
+		minDuration = 3
+	}
+	if penalty == 0 {
+		penalty = 5
+	}
+	if lag == 0 {
+		lag = 10
+	}
+	if minDuration < 1 || penalty < 0 || lag < 0 {
+		err = errors.New("min_duration must be at least 1, and switch_penalty and lag can't be negative")
+		return
+	}
+	durations := make([]int, vocab.Size)
+	for i := range durations {
+		durations[i] = minDuration
+	}
+	durations[libaural2.Nil] = 1 // silence may be as short as it likes.
+	for name, duration := range config.MinDurations {
+		state, prs := vocab.StateByName(name)
+		if !prs {
+			err = errors.New(string(vocab.Name) + " has no state " + name)
+			return
+		}
+		if duration < 1 {
+			err = errors.New("min duration of " + name + " must be at least 1")
+			return
+		}
+		durations[state] = duration
+	}
+	decoder = &viterbi{numStates: vocab.Size, penalty: penalty, lag: lag}
+	for state, duration := range durations {
+		decoder.first = append(decoder.first, len(decoder.stateOf))
+		for i := 0; i < duration; i++ {
+			decoder.stateOf = append(decoder.stateOf, libaural2.State(state))
+		}
+	}
+	decoder.scores = make([]float64, len(decoder.stateOf))
+	return
+}
+
+// last returns the index of the last substate of a state.
+func (decoder *viterbi) last(state int) int {
+	if state+1 < decoder.numStates {
+		return decoder.first[state+1] - 1
+	}
+	return len(decoder.stateOf) - 1
+}
+
+func (decoder *viterbi) Step(probs []float32) (decision Decision, ok bool) {
+	emit := make([]float64, decoder.numStates)
+	for state := range emit {
+		var prob float32
+		if state < len(probs) {
+			prob = probs[state]
+		}
+		emit[state] = math.Log(float64(prob) + probFloor)
+	}
+	backPtr := make([]int32, len(decoder.stateOf))
+	scores := make([]float64, len(decoder.stateOf))
+	if !decoder.initialized { // paths may start in the first substate of any state.
+		for i := range scores {
+			scores[i] = math.Inf(-1)
+			backPtr[i] = -1
+		}
+		for state, first := range decoder.first {
+			scores[first] = emit[state]
+		}
+		decoder.initialized = true
+	} else {
+		// the best and second best states to leave, so that the best state to switch from is known for every state to switch to.
+		best, second := -1, -1
+		for state := 0; state < decoder.numStates; state++ {
+			score := decoder.scores[decoder.last(state)]
+			if best < 0 || score > decoder.scores[decoder.last(best)] {
+				best, second = state, best
+			} else if second < 0 || score > decoder.scores[decoder.last(second)] {
+				second = state
+			}
+		}
+		for state := 0; state < decoder.numStates; state++ {
+			first, last := decoder.first[state], decoder.last(state)
+			from := best
+			if from == state {
+				from = second
+			}
+			// the first substate is entered from the end of another state,
+			scores[first], backPtr[first] = math.Inf(-1), -1
+			if from >= 0 {
+				scores[first], backPtr[first] = decoder.scores[decoder.last(from)]-decoder.penalty, int32(decoder.last(from))
+			}
+			switchScore := scores[first]
+			if first == last && decoder.scores[last] >= switchScore { // or, for a state with no minimum duration, repeated.
+				scores[first], backPtr[first] = decoder.scores[last], int32(last)
+			}
+			for i := first + 1; i <= last; i++ { // the rest are entered from the substate before,
+				scores[i], backPtr[i] = decoder.scores[i-1], int32(i-1)
+			}
+			if last > first && decoder.scores[last] > scores[last] { // and the last may also repeat.
+				scores[last], backPtr[last] = decoder.scores[last], int32(last)
+			}
+			for i := first; i <= last; i++ {
+				scores[i] += emit[state]
+			}
+		}
+	}
+	max := math.Inf(-1)
+	bestSubstate := 0
+	for i, score := range scores {
+		if score > max {
+			max, bestSubstate = score, i
+		}
+	}
+	for i := range scores { // keep the scores from drifting off to -Inf.
+		scores[i] -= max
+	}
+	decoder.scores = scores
+	decoder.backPtrs = append(decoder.backPtrs, backPtr)
+	decoder.rawProbs = append(decoder.rawProbs, probs)
+	if len(decoder.backPtrs) <= decoder.lag {
+		return
+	}
+	substate := bestSubstate
+	for i := len(decoder.backPtrs) - 1; i > 0; i-- { // trace the best path back lag strides.
+		substate = int(decoder.backPtrs[i][substate])
+	}
+	state := decoder.stateOf[substate]
+	raw := decoder.rawProbs[0]
+	decision = Decision{Stride: decoder.stride, Probs: oneHot(decoder.numStates, state), State: state}
+	if int(state) < len(raw) {
+		decision.Prob = raw[state]
+	}
+	decoder.backPtrs = decoder.backPtrs[1:]
+	decoder.rawProbs = decoder.rawProbs[1:]
+	decoder.stride++
+	return decision, true
+}
+
+func (decoder *viterbi) Lag() int { return decoder.lag }
+
+// Utterance is a run of strides decided to be the same state, other then Nil.
+type Utterance struct {
+	State libaural2.State
+	Start int     // first stride
+	End   int     // the stride after the last stride
+	Peak  float32 // highest raw prob of the state
+	Mean  float32 // mean raw prob of the state
+}
+
+// Tracker finds the utterances in a sequence of decisions.
+type Tracker struct {
+	current *Utterance
+	sum     float32
+}
+
+// Step takes the next decision, returning the utterance which it ended, if any.
+func (tracker *Tracker) Step(decision Decision) (ended *Utterance) {
+	if tracker.current != nil && tracker.current.State != decision.State {
+		ended = tracker.Flush()
+	}
+	if decision.State == libaural2.Nil {
+		return
+	}
+	if tracker.current == nil {
+		tracker.current = &Utterance{State: decision.State, Start: decision.Stride}
+		tracker.sum = 0
+	}
+	tracker.current.End = decision.Stride + 1
+	tracker.sum += decision.Prob
+	if decision.Prob > tracker.current.Peak {
+		tracker.current.Peak = decision.Prob
+	}
+	tracker.current.Mean = tracker.sum / float32(tracker.current.End-tracker.current.Start)
+	return
+}
+
+// Current returns the utterance in progress, if any.
+func (tracker *Tracker) Current() (current *Utterance) {
+	if tracker.current != nil {
+		copied := *tracker.current
+		current = &copied
+	}
+	return
+}
+
+// Flush ends the utterance in progress, returning it if there is one.
+func (tracker *Tracker) Flush() (ended *Utterance) {
+	ended = tracker.current
+	tracker.current = nil
+	return
+}
@@ -0,0 +1,183 @@
+package decode
+
+import (
+	"testing"
+
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+)
+
+const (
+	play  libaural2.State = 1
+	pause libaural2.State = 2
+)
+
+var testVocab = libaural2.Vocabulary{
+	Name:  "test",
+	Size:  3,
+	Names: map[libaural2.State]string{libaural2.Nil: "Nil", play: "Play", pause: "Pause"},
+}
+
+// probsOf makes probs in which the state has prob, and Nil has the rest.
+func probsOf(state libaural2.State, prob float32) (probs []float32) {
+	probs = make([]float32, testVocab.Size)
+	probs[libaural2.Nil] = 1 - prob
+	probs[state] = prob
+	return
+}
+
+// flickering is Nil, then Play which briefly flickers to Nil, then a spike of Pause too short to be real, then Nil.
+func flickering() (sequence [][]float32) {
+	for i := 0; i < 10; i++ {
+		sequence = append(sequence, probsOf(libaural2.Nil, 1))
+	}
+	for _, prob := range []float32{0.7, 0.9, 0.95, 0.2, 0.9, 0.95, 0.9, 0.7} {
+		sequence = append(sequence, probsOf(play, prob))
+	}
+	for i := 0; i < 10; i++ {
+		sequence = append(sequence, probsOf(libaural2.Nil, 1))
+	}
+	sequence = append(sequence, probsOf(pause, 0.9))
+	for i := 0; i < 20; i++ {
+		sequence = append(sequence, probsOf(libaural2.Nil, 1))
+	}
+	return
+}
+
+// decodeAll decodes the sequence, returning the decisions and utterances.
+func decodeAll(t *testing.T, decoder Decoder, sequence [][]float32) (decisions []Decision, utterances []Utterance) {
+	tracker := Tracker{}
+	for _, probs := range sequence {
+		decision, ok := decoder.Step(probs)
+		if !ok {
+			continue
+		}
+		if decision.Stride != len(decisions) {
+			t.Fatal("expected stride", len(decisions), "got", decision.Stride)
+		}
+		decisions = append(decisions, decision)
+		if ended := tracker.Step(decision); ended != nil {
+			utterances = append(utterances, *ended)
+		}
+	}
+	if ended := tracker.Flush(); ended != nil {
+		utterances = append(utterances, *ended)
+	}
+	return
+}
+
+func TestViterbi(t *testing.T) {
+	decoder, err := New(Config{Strategy: HMM, MinDuration: 3, Lag: 5}, testVocab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sequence := flickering()
+	decisions, utterances := decodeAll(t, decoder, sequence)
+	if len(decisions) != len(sequence)-decoder.Lag() {
+		t.Fatal("expected", len(sequence)-decoder.Lag(), "decisions, got", len(decisions))
+	}
+	if len(utterances) != 1 {
+		t.Fatal("expected one utterance, the flicker and spike should be smoothed away, got", utterances)
+	}
+	utterance := utterances[0]
+	if utterance.State != play || utterance.Start != 10 || utterance.End != 18 {
+		t.Fatal("expected Play from stride 10 to 18, got", utterance)
+	}
+	if utterance.Peak != 0.95 || utterance.Mean < 0.77 || utterance.Mean > 0.78 {
+		t.Fatal("wrong confidence", utterance.Peak, utterance.Mean)
+	}
+	for _, decision := range decisions {
+		if decision.Probs[decision.State] != 1 {
+			t.Fatal("the probs of the HMM should be all on the decided state")
+		}
+	}
+}
+
+func TestMinDurations(t *testing.T) {
+	decoder, err := New(Config{Strategy: HMM, MinDuration: 1, MinDurations: map[string]int{"Pause": 3}, SwitchPenalty: 2, Lag: 5}, testVocab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sequence := [][]float32{probsOf(libaural2.Nil, 1)}
+	for i := 0; i < 2; i++ { // too short for Pause,
+		sequence = append(sequence, probsOf(pause, 0.99))
+	}
+	sequence = append(sequence, probsOf(libaural2.Nil, 1), probsOf(libaural2.Nil, 1))
+	for i := 0; i < 2; i++ { // but long enough for Play.
+		sequence = append(sequence, probsOf(play, 0.99))
+	}
+	for i := 0; i < 10; i++ {
+		sequence = append(sequence, probsOf(libaural2.Nil, 1))
+	}
+	_, utterances := decodeAll(t, decoder, sequence)
+	if len(utterances) != 1 || utterances[0].State != play {
+		t.Fatal("expected only Play, got", utterances)
+	}
+}
+
+func TestMovingAverage(t *testing.T) {
+	decoder, err := New(Config{Strategy: MovingAverage, Window: 3, Threshold: 0.5}, testVocab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, utterances := decodeAll(t, decoder, flickering())
+	if len(utterances) != 1 || utterances[0].State != play {
+		t.Fatal("expected one Play, got", utterances)
+	}
+	if utterances[0].Start != 11 { // the average lags behind the probs.
+		t.Fatal("expected Play to start at stride 11, got", utterances[0].Start)
+	}
+}
+
+func TestHysteresis(t *testing.T) {
+	decoder, err := New(Config{Strategy: Hysteresis, On: 0.8, Off: 0.3}, testVocab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sequence := [][]float32{
+		probsOf(play, 0.7), // not sure enough to start,
+		probsOf(play, 0.9), // starts,
+		probsOf(play, 0.5), // still going,
+		probsOf(play, 0.2), // ends.
+		probsOf(pause, 0.85),
+		probsOf(play, 0.85), // Play takes over from Pause.
+		probsOf(play, 0.5),
+	}
+	decisions, utterances := decodeAll(t, decoder, sequence)
+	expected := []libaural2.State{libaural2.Nil, play, play, libaural2.Nil, pause, play, play}
+	for i, decision := range decisions {
+		if decision.State != expected[i] {
+			t.Fatal("stride", i, "expected", expected[i], "got", decision.State)
+		}
+	}
+	if len(utterances) != 3 || utterances[0].End != 3 || utterances[0].Peak != 0.9 || utterances[0].Mean != 0.7 {
+		t.Fatal("wrong utterances", utterances)
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	decoder, err := New(Config{}, testVocab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	probs := probsOf(play, 0.6)
+	decision, ok := decoder.Step(probs)
+	if !ok || decision.State != play || decision.Probs[play] != 0.6 {
+		t.Fatal("the probs should be passed through, got", decision)
+	}
+}
+
+func TestBadConfigs(t *testing.T) {
+	for _, config := range []Config{
+		{Strategy: "guess"},
+		{Strategy: MovingAverage, Window: -1},
+		{Strategy: MovingAverage, Threshold: 1},
+		{Strategy: Hysteresis, On: 0.3, Off: 0.8},
+		{Strategy: HMM, MinDuration: -1},
+		{Strategy: HMM, MinDurations: map[string]int{"Dance": 3}},
+		{Strategy: HMM, MinDurations: map[string]int{"Play": 0}},
+	} {
+		if _, err := New(config, testVocab); err == nil {
+			t.Fatal(config, "should not be allowed")
+		}
+	}
+}
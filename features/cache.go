@@ -0,0 +1,118 @@
+package features
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+)
+
+// Version must be incremented whenever a change to this package changes the features computed by some config, so that features cached by the old code are not used.
+const Version = 1
+
+// HashSize is the number of bytes in a config hash.
+const HashSize = 8
+
+// Hash identifies the features the config computes. Configs computing different features have different hashes.
+func (config Config) Hash() (hash []byte, err error) {
+	serialized, err := config.Serialize()
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(append([]byte{Version}, serialized...))
+	hash = sum[:HashSize]
+	return
+}
+
+// Store is somewhere to keep cached features, such as a bucket of a bolt DB.
+type Store interface {
+	GetFeatures(key []byte) ([]byte, error) // returns nil if the key is not present
+	PutFeatures(key, value []byte) error
+}
+
+// Cache computes the features of audio clips, keeping them in a Store so that each clip need only be computed once.
+// Features are keyed by the ID of the clip and the hash of the config, so changing the config never gives stale features.
+type Cache struct {
+	config Config
+	hash   []byte
+	store  Store
+}
+
+// NewCache makes a new Cache for features of the config.
+func NewCache(config Config, store Store) (cache *Cache, err error) {
+	if err = config.Validate(); err != nil {
+		return
+	}
+	hash, err := config.Hash()
+	if err != nil {
+		return
+	}
+	cache = &Cache{
+		config: config,
+		hash:   hash,
+		store:  store,
+	}
+	return
+}
+
+// Config returns the config of the features in the cache.
+func (cache *Cache) Config() Config {
+	return cache.config
+}
+
+// Key returns the key of the features of a clip.
+func (cache *Cache) Key(clipID libaural2.ClipID) []byte {
+	return append(append([]byte{}, clipID[:]...), cache.hash...)
+}
+
+// IsCurrent returns true if key is the key of features of this config, false if the features are of some other config.
+func (cache *Cache) IsCurrent(key []byte) bool {
+	return len(key) == len(libaural2.ClipID{})+HashSize && string(key[len(libaural2.ClipID{}):]) == string(cache.hash)
+}
+
+// AudioClipToFeatures returns the features of the clip, from the store if they are there, otherwise computing and storing them.
+func (cache *Cache) AudioClipToFeatures(clip *libaural2.AudioClip) (features [][]float32, err error) {
+	key := cache.Key(clip.ID())
+	encoded, err := cache.store.GetFeatures(key)
+	if err != nil {
+		return
+	}
+	if encoded != nil {
+		features, err = decode(encoded, cache.config.InputSize())
+		if err == nil {
+			return
+		}
+	}
+	features = cache.config.AudioClipToFeatures(clip) // if the features are missing, or were corrupt, compute them again.
+	err = cache.store.PutFeatures(key, encode(features))
+	return
+}
+
+// encode features as little endian float32s.
+func encode(features [][]float32) (encoded []byte) {
+	for _, frame := range features {
+		for _, value := range frame {
+			encoded = append(encoded, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint32(encoded[len(encoded)-4:], math.Float32bits(value))
+		}
+	}
+	return
+}
+
+// decode features encoded by encode, of size features per stride.
+func decode(encoded []byte, size int) (features [][]float32, err error) {
+	if len(encoded)%(size*4) != 0 {
+		err = errors.New("encoded features are the wrong length")
+		return
+	}
+	features = make([][]float32, len(encoded)/(size*4))
+	for i := range features {
+		features[i] = make([]float32, size)
+		for j := range features[i] {
+			features[i][j] = math.Float32frombits(binary.LittleEndian.Uint32(encoded[(i*size+j)*4:]))
+		}
+	}
+	return
+}
@@ -0,0 +1,258 @@
+package features
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+)
+
+// Normalization is a kind of cepstral mean and variance normalization, to make features less sensitive to microphone gain.
+type Normalization string
+
+const (
+	// NoNormalization leaves the features as they are.
+	NoNormalization Normalization = ""
+	// UtteranceNormalization normalizes each clip by its own mean and variance.
+	// A stream has no end, so it can't be used by models which are run live, see Config.ValidateStream().
+	UtteranceNormalization Normalization = "utterance"
+	// RunningNormalization normalizes by a mean and variance which decay over a few seconds.
+	RunningNormalization Normalization = "running"
+)
+
+// runningDecay is how much of the running mean and variance is kept each stride. 0.99 is a time constant of about 3 seconds.
+const runningDecay = 0.99
+
+// varianceFloor keeps normalization from dividing by zero on silence.
+const varianceFloor = 1e-6
+
+// Config describes the features fed to a model.
+type Config struct {
+	NumMFCC       int           `json:"num_mfcc"`      // number of cepstral coefficients
+	LogMel        bool          `json:"log_mel"`       // use the log mel filterbank energies rather then MFCCs. NumMFCC is then ignored.
+	Deltas        int           `json:"deltas"`        // 0 for none, 1 for deltas, 2 for deltas and delta-deltas.
+	Normalization Normalization `json:"normalization"` // applied to the base features, before deltas are taken.
+	WindowSize    int           `json:"window_size"`   // samples in each spectrogram window, ending at the end of the stride. 0 for libaural2.StrideWidth, the window of tfutils.ComputeMFCC.
+}
+
+// DefaultConfig is 13 MFCCs without deltas or normalization, the features aural2 has always used.
+var DefaultConfig = Config{NumMFCC: DCTcoefficientCount}
+
+// Validate checks that the config makes sense.
+func (config Config) Validate() (err error) {
+	if !config.LogMel && (config.NumMFCC < 1 || config.NumMFCC > FilterbankChannelCount) {
+		err = errors.New("num_mfcc must be betwene 1 and " + strconv.Itoa(FilterbankChannelCount))
+		return
+	}
+	if config.Deltas < 0 || config.Deltas > 2 {
+		err = errors.New("deltas must be 0, 1 or 2")
+		return
+	}
+	if config.WindowSize != 0 && config.WindowSize < libaural2.StrideWidth {
+		err = errors.New("window_size must be at least " + strconv.Itoa(libaural2.StrideWidth))
+		return
+	}
+	switch config.Normalization {
+	case NoNormalization, UtteranceNormalization, RunningNormalization:
+	default:
+		err = errors.New("unknown normalization " + string(config.Normalization))
+	}
+	return
+}
+
+// ValidateStream checks that a Stream computes the same features as Config.Compute(), as it must for a model which is trained on clips and run live.
+func (config Config) ValidateStream() (err error) {
+	if err = config.Validate(); err != nil {
+		return
+	}
+	if config.Normalization == UtteranceNormalization {
+		err = errors.New("utterance normalization can't be used live, as a stream has no end to normalize over. Use running normalization")
+	}
+	return
+}
+
+// windowSize is the number of samples in each spectrogram window.
+func (config Config) windowSize() int {
+	if config.WindowSize == 0 {
+		return libaural2.StrideWidth
+	}
+	return config.WindowSize
+}
+
+// context is the number of samples before each stride which its window also covers.
+func (config Config) context() int {
+	return config.windowSize() - libaural2.StrideWidth
+}
+
+// baseSize is the number of features per stride before deltas are added.
+func (config Config) baseSize() int {
+	if config.LogMel {
+		return FilterbankChannelCount
+	}
+	return config.NumMFCC
+}
+
+// InputSize is the number of features per stride, and so the input size the model must have.
+func (config Config) InputSize() int {
+	return config.baseSize() * (1 + config.Deltas)
+}
+
+// Serialize the config to JSON, to be stored with the model.
+func (config Config) Serialize() ([]byte, error) {
+	return json.Marshal(config)
+}
+
+// ParseConfig parses a config serialized by Config.Serialize().
+func ParseConfig(serialized []byte) (config Config, err error) {
+	if err = json.Unmarshal(serialized, &config); err != nil {
+		return
+	}
+	err = config.Validate()
+	return
+}
+
+// base computes the base features of one spectrum.
+func (config Config) base(mfcc *MFCC, spectrum []float64) (features []float32) {
+	if !config.LogMel {
+		return mfcc.Compute(spectrum)
+	}
+	for _, value := range mfcc.LogMel(spectrum) {
+		features = append(features, float32(value))
+	}
+	return
+}
+
+// Stream computes features one stride at a time, carrying the state needed for overlapping windows, deltas and running normalization.
+// The features of a clip computed by a stream are the same as those computed by Config.Compute(), except that utterance normalization is replaced by running normalization, which is why Config.ValidateStream() rejects it.
+type Stream struct {
+	config      Config
+	spectrogram *Spectrogram
+	mfcc        *MFCC
+	window      []float32 // the context samples of the previous strides, followed by the current stride
+	n           int       // number of strides seen
+	mean        []float64 // running mean of each base feature
+	variance    []float64 // running variance of each base feature
+	prev        []float32 // base features of the previous stride
+	prevDelta   []float32 // deltas of the previous stride
+}
+
+// NewStream makes a new Stream.
+func (config Config) NewStream() (stream *Stream) {
+	spectrogram := NewSpectrogram(config.windowSize(), libaural2.StrideWidth)
+	return &Stream{
+		config:      config,
+		spectrogram: spectrogram,
+		window:      make([]float32, config.windowSize()), // the stream starts with silence before it.
+		mfcc:        NewMFCC(spectrogram.Channels(), libaural2.SampleRate, config.NumMFCC),
+		mean:        make([]float64, config.baseSize()),
+		variance:    make([]float64, config.baseSize()),
+	}
+}
+
+// Step computes the features of one stride of libaural2.StrideWidth samples.
+func (stream *Stream) Step(samples []float32) (features []float32) {
+	copy(stream.window, stream.window[libaural2.StrideWidth:]) // slide the window along by one stride,
+	copy(stream.window[stream.config.context():], samples[:libaural2.StrideWidth])
+	base := stream.config.base(stream.mfcc, stream.spectrogram.Frame(stream.window))
+	if stream.config.Normalization != NoNormalization {
+		base = stream.normalize(base)
+	}
+	features = stream.addDeltas(base)
+	return
+}
+
+// normalize the base features by their running mean and variance.
+func (stream *Stream) normalize(base []float32) (normalized []float32) {
+	stream.n++
+	rate := math.Max(1/float64(stream.n), 1-runningDecay) // exact mean and variance of the first strides, so the start is not skewed.
+	normalized = make([]float32, len(base))
+	for i, value := range base {
+		diff := float64(value) - stream.mean[i]
+		stream.mean[i] += rate * diff
+		stream.variance[i] = (1 - rate) * (stream.variance[i] + rate*diff*diff)
+		normalized[i] = float32((float64(value) - stream.mean[i]) / math.Sqrt(stream.variance[i]+varianceFloor))
+	}
+	return
+}
+
+// addDeltas appends the deltas, and delta-deltas, if the config asks for them.
+// Deltas are simple backward differences, so that they can be computed as the stream arrives.
+func (stream *Stream) addDeltas(base []float32) (features []float32) {
+	features = base
+	if stream.config.Deltas == 0 {
+		return
+	}
+	if stream.prev == nil { // the first stride has no previous stride, so its deltas are 0.
+		stream.prev = base
+		stream.prevDelta = make([]float32, len(base))
+	}
+	delta := make([]float32, len(base))
+	for i := range base {
+		delta[i] = base[i] - stream.prev[i]
+	}
+	features = append(append([]float32{}, base...), delta...)
+	if stream.config.Deltas == 2 {
+		for i := range delta {
+			features = append(features, delta[i]-stream.prevDelta[i])
+		}
+	}
+	stream.prev = base
+	stream.prevDelta = delta
+	return
+}
+
+// Compute the features of the PCM, one for each whole stride.
+// The window of the first strides reaches back before the start of the PCM, which is taken to be silence, just as a Stream does.
+func (config Config) Compute(pcm []float32) (features [][]float32) {
+	stream := config.NewStream()
+	if config.Normalization != UtteranceNormalization {
+		for start := 0; start+libaural2.StrideWidth <= len(pcm); start += libaural2.StrideWidth {
+			features = append(features, stream.Step(pcm[start:start+libaural2.StrideWidth]))
+		}
+		return
+	}
+	var bases [][]float32
+	padded := append(make([]float32, config.context()), pcm...)
+	for _, spectrum := range stream.spectrogram.Compute(padded) {
+		bases = append(bases, config.base(stream.mfcc, spectrum))
+	}
+	for _, base := range normalizeUtterance(bases) {
+		features = append(features, stream.addDeltas(base))
+	}
+	return
+}
+
+// normalizeUtterance normalizes each feature by its mean and variance over the whole utterance.
+func normalizeUtterance(bases [][]float32) (normalized [][]float32) {
+	if len(bases) == 0 {
+		return
+	}
+	mean := make([]float64, len(bases[0]))
+	variance := make([]float64, len(bases[0]))
+	for _, base := range bases {
+		for i, value := range base {
+			mean[i] += float64(value) / float64(len(bases))
+		}
+	}
+	for _, base := range bases {
+		for i, value := range base {
+			diff := float64(value) - mean[i]
+			variance[i] += diff * diff / float64(len(bases))
+		}
+	}
+	normalized = make([][]float32, len(bases))
+	for t, base := range bases {
+		normalized[t] = make([]float32, len(base))
+		for i, value := range base {
+			normalized[t][i] = float32((float64(value) - mean[i]) / math.Sqrt(variance[i]+varianceFloor))
+		}
+	}
+	return
+}
+
+// AudioClipToFeatures computes the features of an audio clip.
+func (config Config) AudioClipToFeatures(clip *libaural2.AudioClip) [][]float32 {
+	return config.Compute(PCMFromInt16LE(clip[:]))
+}
@@ -0,0 +1,276 @@
+// Package features computes spectrograms and MFCCs in pure Go.
+// It reproduces the AudioSpectrogram and Mfcc TensorFlow ops used by tfutils.ComputeMFCC, with the same parameters,
+// so that features can be computed without cgo, and models trained on one can be run on the other.
+package features
+
+import (
+	"encoding/binary"
+	"math"
+	"math/cmplx"
+
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+)
+
+// Parameters of the Mfcc TF op, which tfutils.ComputeMFCC leaves at their defaults.
+const (
+	LowerFrequencyLimit    float64 = 20
+	UpperFrequencyLimit    float64 = 4000
+	FilterbankChannelCount int     = 40
+	DCTcoefficientCount    int     = 13
+	filterbankFloor        float64 = 1e-12 // log of the filterbank output is taken, so it must not be 0.
+)
+
+// PCMFromInt16LE converts raw int16le audio to float PCM, scaled as tfutils.ParseRawBytesToPCM scales it.
+func PCMFromInt16LE(raw []byte) (pcm []float32) {
+	pcm = make([]float32, len(raw)/2)
+	for i := range pcm {
+		pcm[i] = float32(int16(binary.LittleEndian.Uint16(raw[i*2:]))) / 65536
+	}
+	return
+}
+
+// nextPowerOfTwo returns the smallest power of two not less then n.
+func nextPowerOfTwo(n int) (p int) {
+	p = 1
+	for p < n {
+		p *= 2
+	}
+	return
+}
+
+// fft computes the discrete Fourier transform of x in place. len(x) must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ { // reorder into bit reversed order,
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size *= 2 { // and combine ever larger transforms.
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even := x[start+k]
+				odd := x[start+k+size/2] * w
+				x[start+k] = even + odd
+				x[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
+
+// Spectrogram computes squared magnitude spectrograms, as the AudioSpectrogram TF op with magnitude_squared set.
+type Spectrogram struct {
+	WindowSize int
+	Stride     int
+	fftLength  int
+	window     []float64
+}
+
+// NewSpectrogram makes a Spectrogram with a periodic Hann window of windowSize samples.
+func NewSpectrogram(windowSize, stride int) (spectrogram *Spectrogram) {
+	spectrogram = &Spectrogram{
+		WindowSize: windowSize,
+		Stride:     stride,
+		fftLength:  nextPowerOfTwo(windowSize),
+		window:     make([]float64, windowSize),
+	}
+	for i := range spectrogram.window {
+		spectrogram.window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(windowSize))
+	}
+	return
+}
+
+// Channels is the number of frequency channels in each frame of output.
+func (spectrogram *Spectrogram) Channels() int {
+	return spectrogram.fftLength/2 + 1
+}
+
+// Frame computes the spectrum of one window of samples. len(samples) must be WindowSize.
+func (spectrogram *Spectrogram) Frame(samples []float32) (spectrum []float64) {
+	buff := make([]complex128, spectrogram.fftLength) // zero padded up to the fft length
+	for i, sample := range samples[:spectrogram.WindowSize] {
+		buff[i] = complex(float64(sample)*spectrogram.window[i], 0)
+	}
+	fft(buff)
+	spectrum = make([]float64, spectrogram.Channels())
+	for i := range spectrum {
+		magnitude := real(buff[i])*real(buff[i]) + imag(buff[i])*imag(buff[i])
+		spectrum[i] = float64(float32(magnitude)) // TF passes the spectrogram to Mfcc as float32, so round as it would.
+	}
+	return
+}
+
+// Compute the spectrogram of the PCM. As with TF, trailing samples which do not fill a whole window are ignored.
+func (spectrogram *Spectrogram) Compute(pcm []float32) (frames [][]float64) {
+	for start := 0; start+spectrogram.WindowSize <= len(pcm); start += spectrogram.Stride {
+		frames = append(frames, spectrogram.Frame(pcm[start:start+spectrogram.WindowSize]))
+	}
+	return
+}
+
+// freqToMel converts a frequency in Hz to the mel scale.
+func freqToMel(freq float64) float64 {
+	return 1127.0 * math.Log1p(freq/700.0)
+}
+
+// MelFilterbank sums the square root of a spectrum into triangular mel spaced channels, as HTK does.
+type MelFilterbank struct {
+	numChannels int
+	startIndex  int
+	endIndex    int
+	bandMapper  []int     // for each spectrum bin, the channel it contributes to on the right side of the triangle. -2 if unused.
+	weights     []float64 // for each spectrum bin, how much it contributes to that channel. The rest goes to the next channel.
+}
+
+// NewMelFilterbank makes a MelFilterbank for spectra of inputLength bins, covering lowerFrequency to upperFrequency Hz.
+func NewMelFilterbank(inputLength, sampleRate, numChannels int, lowerFrequency, upperFrequency float64) (filterbank *MelFilterbank) {
+	filterbank = &MelFilterbank{
+		numChannels: numChannels,
+		bandMapper:  make([]int, inputLength),
+		weights:     make([]float64, inputLength),
+	}
+	melLow := freqToMel(lowerFrequency)
+	melSpacing := (freqToMel(upperFrequency) - melLow) / float64(numChannels+1)
+	centers := make([]float64, numChannels+1) // an extra center at the top gives the upper limit of the final triangle.
+	for i := range centers {
+		centers[i] = melLow + melSpacing*float64(i+1)
+	}
+	hzPerBin := 0.5 * float64(sampleRate) / float64(inputLength-1)
+	filterbank.startIndex = int(1.5 + lowerFrequency/hzPerBin) // always exclude DC.
+	filterbank.endIndex = int(upperFrequency / hzPerBin)
+	channel := 0
+	for i := range filterbank.bandMapper {
+		mel := freqToMel(float64(i) * hzPerBin)
+		if i < filterbank.startIndex || i > filterbank.endIndex {
+			filterbank.bandMapper[i] = -2
+			continue
+		}
+		for channel < numChannels && centers[channel] < mel {
+			channel++
+		}
+		filterbank.bandMapper[i] = channel - 1
+		if channel-1 >= 0 {
+			filterbank.weights[i] = (centers[channel] - mel) / (centers[channel] - centers[channel-1])
+		} else {
+			filterbank.weights[i] = (centers[0] - mel) / (centers[0] - melLow)
+		}
+	}
+	return
+}
+
+// Compute the filterbank channels of one spectrum of squared magnitudes.
+func (filterbank *MelFilterbank) Compute(spectrum []float64) (channels []float64) {
+	channels = make([]float64, filterbank.numChannels)
+	for i := filterbank.startIndex; i <= filterbank.endIndex && i < len(spectrum); i++ {
+		value := math.Sqrt(spectrum[i])
+		weighted := value * filterbank.weights[i]
+		channel := filterbank.bandMapper[i]
+		if channel >= 0 {
+			channels[channel] += weighted // right side of the triangle, downward slope
+		}
+		channel++
+		if channel < filterbank.numChannels {
+			channels[channel] += value - weighted // left side of the triangle, upward slope
+		}
+	}
+	return
+}
+
+// DCT is a type II discrete cosine transform, keeping only the first few coefficients.
+type DCT struct {
+	cosines [][]float64
+}
+
+// NewDCT makes a DCT of inputLength inputs to numCoefficients outputs.
+func NewDCT(inputLength, numCoefficients int) (dct *DCT) {
+	dct = &DCT{cosines: make([][]float64, numCoefficients)}
+	fnorm := math.Sqrt(2 / float64(inputLength))
+	arg := math.Pi / float64(inputLength)
+	for i := range dct.cosines {
+		dct.cosines[i] = make([]float64, inputLength)
+		for j := range dct.cosines[i] {
+			dct.cosines[i][j] = fnorm * math.Cos(float64(i)*arg*(float64(j)+0.5))
+		}
+	}
+	return
+}
+
+// Compute the DCT of the input.
+func (dct *DCT) Compute(input []float64) (output []float64) {
+	output = make([]float64, len(dct.cosines))
+	for i, cosines := range dct.cosines {
+		for j, value := range input {
+			if j < len(cosines) {
+				output[i] += value * cosines[j]
+			}
+		}
+	}
+	return
+}
+
+// MFCC computes Mel-frequency cepstral coefficients from spectra, as the Mfcc TF op does.
+type MFCC struct {
+	filterbank *MelFilterbank
+	dct        *DCT
+}
+
+// NewMFCC makes an MFCC for spectra of spectrumLength bins, with the default filterbank of the Mfcc TF op, and numCoefficients coefficients.
+func NewMFCC(spectrumLength, sampleRate, numCoefficients int) *MFCC {
+	return &MFCC{
+		filterbank: NewMelFilterbank(spectrumLength, sampleRate, FilterbankChannelCount, LowerFrequencyLimit, UpperFrequencyLimit),
+		dct:        NewDCT(FilterbankChannelCount, numCoefficients),
+	}
+}
+
+// LogMel computes the log of the mel filterbank channels of one spectrum.
+func (mfcc *MFCC) LogMel(spectrum []float64) (channels []float64) {
+	channels = mfcc.filterbank.Compute(spectrum)
+	for i, value := range channels {
+		channels[i] = math.Log(math.Max(value, filterbankFloor))
+	}
+	return
+}
+
+// Compute the MFCC of one spectrum.
+func (mfcc *MFCC) Compute(spectrum []float64) (coefficients []float32) {
+	for _, value := range mfcc.dct.Compute(mfcc.LogMel(spectrum)) {
+		coefficients = append(coefficients, float32(value))
+	}
+	return
+}
+
+// Extractor computes MFCCs from PCM with the same parameters as tfutils.ComputeMFCC.
+type Extractor struct {
+	spectrogram *Spectrogram
+	mfcc        *MFCC
+}
+
+// NewExtractor makes an Extractor with windows and strides of libaural2.StrideWidth samples.
+func NewExtractor() (extractor *Extractor) {
+	spectrogram := NewSpectrogram(libaural2.StrideWidth, libaural2.StrideWidth)
+	return &Extractor{
+		spectrogram: spectrogram,
+		mfcc:        NewMFCC(spectrogram.Channels(), libaural2.SampleRate, DCTcoefficientCount),
+	}
+}
+
+// Compute the MFCCs of the PCM, one for each whole stride.
+func (extractor *Extractor) Compute(pcm []float32) (mfccs [][]float32) {
+	for _, spectrum := range extractor.spectrogram.Compute(pcm) {
+		mfccs = append(mfccs, extractor.mfcc.Compute(spectrum))
+	}
+	return
+}
+
+// AudioClipToMFCCs computes the MFCCs of an audio clip, as tfutils.ComputeMFCC does.
+func (extractor *Extractor) AudioClipToMFCCs(clip *libaural2.AudioClip) (mfccs [][]float32) {
+	return extractor.Compute(PCMFromInt16LE(clip[:]))
+}
@@ -0,0 +1,283 @@
+package features
+
+import (
+	"encoding/binary"
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+)
+
+func TestFFT(t *testing.T) {
+	x := make([]complex128, 16)
+	for i := range x {
+		x[i] = complex(math.Sin(float64(i)*0.7)+float64(i%3), 0)
+	}
+	expected := make([]complex128, len(x)) // naive DFT
+	for k := range expected {
+		for n, value := range x {
+			expected[k] += value * cmplx.Exp(complex(0, -2*math.Pi*float64(k*n)/float64(len(x))))
+		}
+	}
+	fft(x)
+	for k := range x {
+		if cmplx.Abs(x[k]-expected[k]) > 1e-9 {
+			t.Fatal("bin", k, "fft:", x[k], "dft:", expected[k])
+		}
+	}
+}
+
+func TestSpectrogramSine(t *testing.T) {
+	spectrogram := NewSpectrogram(512, 512)
+	if spectrogram.Channels() != 257 {
+		t.Fatal("wrong number of channels", spectrogram.Channels())
+	}
+	pcm := make([]float32, 512*3+100)
+	for i := range pcm {
+		pcm[i] = float32(math.Sin(2 * math.Pi * 1000 * float64(i) / 16000)) // 1000Hz is exactly bin 32.
+	}
+	frames := spectrogram.Compute(pcm)
+	if len(frames) != 3 {
+		t.Fatal("expected 3 frames, got", len(frames))
+	}
+	var maxBin int
+	for i, value := range frames[0] {
+		if value > frames[0][maxBin] {
+			maxBin = i
+		}
+	}
+	if maxBin != 32 {
+		t.Fatal("expected peak at bin 32, got", maxBin)
+	}
+}
+
+func TestDCT(t *testing.T) {
+	dct := NewDCT(40, 13)
+	input := make([]float64, 40)
+	for i := range input {
+		input[i] = 2
+	}
+	output := dct.Compute(input)
+	if math.Abs(output[0]-2*40*math.Sqrt(2.0/40)) > 1e-9 {
+		t.Fatal("wrong DC coefficient", output[0])
+	}
+	for _, value := range output[1:] {
+		if math.Abs(value) > 1e-9 {
+			t.Fatal("constant input should only have a DC coefficient", output)
+		}
+	}
+}
+
+// makeTestPCM makes a few seconds of a warbling tone in noise.
+func makeTestPCM() (pcm []float32) {
+	r := rand.New(rand.NewSource(42))
+	pcm = make([]float32, 16000*3)
+	for i := range pcm {
+		freq := 500 + 300*math.Sin(float64(i)/4000)
+		pcm[i] = float32(0.2*math.Sin(2*math.Pi*freq*float64(i)/16000) + 0.01*r.NormFloat64())
+	}
+	return
+}
+
+func TestDefaultConfig(t *testing.T) {
+	if DefaultConfig.InputSize() != 13 {
+		t.Fatal("default config should be 13 MFCCs")
+	}
+	pcm := makeTestPCM()
+	expected := NewExtractor().Compute(pcm)
+	actual := DefaultConfig.Compute(pcm)
+	if len(actual) != len(expected) {
+		t.Fatal("wrong number of strides")
+	}
+	for i := range expected {
+		for j := range expected[i] {
+			if actual[i][j] != expected[i][j] {
+				t.Fatal("default config should give plain MFCCs")
+			}
+		}
+	}
+}
+
+func TestConfigInputSize(t *testing.T) {
+	configs := map[Config]int{
+		Config{NumMFCC: 13, Deltas: 2}:                            39,
+		Config{NumMFCC: 20, Deltas: 1}:                            40,
+		Config{LogMel: true}:                                      FilterbankChannelCount,
+		Config{LogMel: true, Deltas: 1, Normalization: "running"}: 2 * FilterbankChannelCount,
+	}
+	pcm := makeTestPCM()
+	for config, size := range configs {
+		if err := config.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if config.InputSize() != size {
+			t.Fatal(config, "expected input size", size, "got", config.InputSize())
+		}
+		for _, features := range config.Compute(pcm) {
+			if len(features) != size {
+				t.Fatal(config, "computed", len(features), "features, expected", size)
+			}
+		}
+	}
+	for _, config := range []Config{{}, {NumMFCC: 13, Deltas: 3}, {NumMFCC: 13, Normalization: "global"}} {
+		if config.Validate() == nil {
+			t.Fatal(config, "should not be valid")
+		}
+	}
+}
+
+func TestSerializeConfig(t *testing.T) {
+	config := Config{NumMFCC: 20, Deltas: 2, Normalization: UtteranceNormalization}
+	serialized, err := config.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseConfig(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != config {
+		t.Fatal("expected", config, "got", parsed)
+	}
+}
+
+func TestUtteranceNormalization(t *testing.T) {
+	config := Config{NumMFCC: 13, Normalization: UtteranceNormalization}
+	pcm := makeTestPCM()
+	quiet := make([]float32, len(pcm))
+	for i := range pcm {
+		quiet[i] = pcm[i] / 10
+	}
+	loud := config.Compute(pcm)
+	soft := config.Compute(quiet)
+	for i := range loud {
+		for j := range loud[i] { // gain shifts the log energy, which normalization removes.
+			if math.Abs(float64(loud[i][j]-soft[i][j])) > 0.05 {
+				t.Fatal("normalized features should not depend on gain", i, j, loud[i][j], soft[i][j])
+			}
+		}
+	}
+}
+
+func TestValidateStream(t *testing.T) {
+	if err := (Config{NumMFCC: 13, Normalization: UtteranceNormalization}).ValidateStream(); err == nil {
+		t.Fatal("utterance normalization should not be allowed live")
+	}
+	if err := (Config{NumMFCC: 13, Deltas: 2, Normalization: RunningNormalization}).ValidateStream(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (Config{NumMFCC: 0}).ValidateStream(); err == nil {
+		t.Fatal("should also validate the config")
+	}
+}
+
+func TestStreamMatchesCompute(t *testing.T) {
+	config := Config{NumMFCC: 13, Deltas: 2, Normalization: RunningNormalization}
+	pcm := makeTestPCM()
+	expected := config.Compute(pcm)
+	stream := config.NewStream()
+	for i := range expected {
+		actual := stream.Step(pcm[i*512 : (i+1)*512])
+		for j := range actual {
+			if actual[j] != expected[i][j] {
+				t.Fatal("stream differs from compute at stride", i)
+			}
+		}
+	}
+}
+
+func TestOverlappingWindows(t *testing.T) {
+	pcm := makeTestPCM()
+	for _, config := range []Config{
+		{NumMFCC: 13, WindowSize: 1024},
+		{NumMFCC: 13, Deltas: 2, WindowSize: 1536, Normalization: RunningNormalization},
+	} {
+		if err := config.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		expected := config.Compute(pcm)
+		if len(expected) != len(pcm)/512 {
+			t.Fatal(config, "should give one frame per stride, got", len(expected))
+		}
+		truncated := config.Compute(pcm[:10*512])
+		for i := range truncated {
+			if truncated[i][0] != expected[i][0] {
+				t.Fatal(config, "frame", i, "depends on samples after its stride")
+			}
+		}
+		stream := config.NewStream()
+		for i := range expected {
+			actual := stream.Step(pcm[i*512 : (i+1)*512])
+			for j := range actual {
+				if actual[j] != expected[i][j] {
+					t.Fatal(config, "stream differs from compute at stride", i)
+				}
+			}
+		}
+	}
+	utterance := Config{NumMFCC: 13, WindowSize: 1024, Normalization: UtteranceNormalization}
+	if len(utterance.Compute(pcm)) != len(pcm)/512 {
+		t.Fatal("utterance normalization should give one frame per stride")
+	}
+	if (Config{NumMFCC: 13, WindowSize: 256}).Validate() == nil {
+		t.Fatal("window smaller then a stride should not be valid")
+	}
+}
+
+// mapStore is a Store in memory, which counts how often features are put.
+type mapStore struct {
+	values map[string][]byte
+	puts   int
+}
+
+func (store *mapStore) GetFeatures(key []byte) ([]byte, error) {
+	return store.values[string(key)], nil
+}
+
+func (store *mapStore) PutFeatures(key, value []byte) error {
+	store.values[string(key)] = value
+	store.puts++
+	return nil
+}
+
+func TestCache(t *testing.T) {
+	clip := &libaural2.AudioClip{}
+	for i, sample := range makeTestPCM() {
+		binary.LittleEndian.PutUint16(clip[i*2:], uint16(int16(sample*30000)))
+	}
+	store := &mapStore{values: map[string][]byte{}}
+	config := Config{NumMFCC: 13, Deltas: 1}
+	cache, err := NewCache(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := config.AudioClipToFeatures(clip)
+	for i := 0; i < 2; i++ {
+		actual, err := cache.AudioClipToFeatures(clip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(actual) != len(expected) || actual[3][20] != expected[3][20] || actual[len(actual)-1][0] != expected[len(expected)-1][0] {
+			t.Fatal("cached features differ")
+		}
+	}
+	if store.puts != 1 {
+		t.Fatal("features should be computed once, were put", store.puts, "times")
+	}
+	other, err := NewCache(Config{NumMFCC: 13, Deltas: 2}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.IsCurrent(cache.Key(clip.ID())) || !cache.IsCurrent(cache.Key(clip.ID())) {
+		t.Fatal("key should only be current for its own config")
+	}
+	features, err := other.AudioClipToFeatures(clip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(features[0]) != 39 || store.puts != 2 {
+		t.Fatal("a new config should not use the features of the old config")
+	}
+}
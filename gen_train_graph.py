@@ -17,19 +17,24 @@ import tensorflow as tf
 
 
 def main():
+    parser = argparse.ArgumentParser(description='Generate the untrained aural2 training graph.')
+    parser.add_argument('--output_size', type=int, default=50, help='number of states the model can output')
+    parser.add_argument('--input_size', type=int, default=13, help='number of features per stride, see features.Config.InputSize()')
+    parser.add_argument('--out', default='target/train_graph.pb', help='path to write the graph to')
+    args = parser.parse_args()
     params = {
             "batch_size": 7,
             "dropout": 0.0,
             "embedding_size": 0,
             "hidden_size": 64,
             "input_dropout": 0.0,
-            "input_size": 13,
+            "input_size": args.input_size,
             "learning_rate": 0.0003,
             "max_grad_norm": 5.0,
             "num_layers": 2,
             "num_unrollings": 100,
             "full_seq_len": 312,
-            "output_size": 50,
+            "output_size": args.output_size,
             }
 
     # Create graphs
@@ -54,6 +59,20 @@ def main():
             step_initialStateConst = tf.constant(initialStateNames, name="initial_state_names")
             step_finalStateNamesConst = tf.constant(finalStateNames, name="final_state_names")
 
+        # make graph for doing inference one mfcc at a time on many streams at once.
+        with tf.name_scope('multi_step_inference'):
+            multi_step_inference_model = CharRNN(params, is_training=False, use_batch=False, seq_len=1, dynamic_batch=True)
+            initialStateNames = []
+            finalStateNames = []
+            for i in multi_step_inference_model.initial_state:
+                initialStateNames.append(i.c.op.name)
+                initialStateNames.append(i.h.op.name)
+            for i in multi_step_inference_model.final_state:
+                finalStateNames.append(i.c.op.name)
+                finalStateNames.append(i.h.op.name)
+            multi_step_initialStateConst = tf.constant(initialStateNames, name="initial_state_names")
+            multi_step_finalStateNamesConst = tf.constant(finalStateNames, name="final_state_names")
+
         # make graph for doing inference on a full length sequence
         with tf.name_scope('seq_inference'):
             seq_inference_model = CharRNN(params, is_training=False, use_batch=False, seq_len=params['full_seq_len'])
@@ -89,7 +108,7 @@ def main():
         #print(train_model.initial_state.name)
 
         zeros = tf.zeros([1, params['hidden_size']], dtype=tf.float32, name="zeros")
-        tf.train.write_graph(tf.get_default_graph().as_graph_def(), 'target', 'train_graph.pb', as_text=False)
+        tf.train.write_graph(tf.get_default_graph().as_graph_def(), os.path.dirname(args.out), os.path.basename(args.out), as_text=False)
 
 
 
@@ -99,11 +118,14 @@ logging.getLogger('tensorflow').setLevel(logging.WARNING)
 class CharRNN(object):
   """Character RNN model."""
 
-  def __init__(self, params, is_training=True, use_batch=True, seq_len=7):
+  def __init__(self, params, is_training=True, use_batch=True, seq_len=7, dynamic_batch=False):
     batch_size = params['batch_size']
     num_unrollings = seq_len
     if not use_batch:
       batch_size = 1
+    if dynamic_batch:
+      # batch size is set by the size of the inputs fed in.
+      batch_size = None
     hidden_size = params['hidden_size']
     max_grad_norm = params['max_grad_norm']
     num_layers = params['num_layers']
@@ -121,6 +143,10 @@ class CharRNN(object):
                                   [batch_size, num_unrollings,],
                                   name='targets')
 
+    state_batch_size = batch_size
+    if dynamic_batch:
+      state_batch_size = tf.shape(self.input_data)[0]
+
     cell_fn = tf.contrib.rnn.BasicLSTMCell
 
     cell = cell_fn(hidden_size, reuse=tf.get_variable_scope().reuse, forget_bias=0.0, state_is_tuple=True)
@@ -140,7 +166,7 @@ class CharRNN(object):
 
     with tf.name_scope('initial_state'):
       # zero_state is used to compute the intial state for cell.
-      self.zero_state = multi_cell.zero_state(batch_size, tf.float32)
+      self.zero_state = multi_cell.zero_state(state_batch_size, tf.float32)
       # Placeholder to feed in initial state.
       # self.initial_state = tf.placeholder(
       #   tf.float32,
@@ -148,7 +174,7 @@ class CharRNN(object):
       #   'initial_state')
 
       self.initial_state = create_tuple_placeholders_with_default(
-        multi_cell.zero_state(batch_size, tf.float32),
+        multi_cell.zero_state(state_batch_size, tf.float32),
         extra_dims=(None,),
         shape=multi_cell.state_size)
 
@@ -0,0 +1,307 @@
+// Package golstm runs inference on trained aural2 LSTM models in pure Go, so that edge binaries do not need the TensorFlow C library.
+package golstm
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	pbtf "github.ibm.com/Blue-Horizon/aural2/tfutils/demo/protobuf/tensorflow/core/framework"
+)
+
+// names of the variables of the output projection.
+const (
+	softmaxWname = "softmax/softmax_w"
+	softmaxBname = "softmax/softmax_b"
+)
+
+// lstmVarPattern matches the kernel and bias variables of each LSTM layer, capturing the layer number.
+var lstmVarPattern = regexp.MustCompile(`^(.*cell_([0-9]+)/basic_lstm_cell)/(kernel|bias)$`)
+
+// Layer is the weights of one BasicLSTMCell.
+type Layer struct {
+	Kernel [][]float32 // [input size + hidden size][4 * hidden size]
+	Bias   []float32   // [4 * hidden size]
+}
+
+// HiddenSize is the size of the state of the layer.
+func (layer Layer) HiddenSize() int {
+	return len(layer.Bias) / 4
+}
+
+// Model is a stack of LSTM layers with a softmax on top.
+// It is not modified by inference, so can be used by many goroutines at once.
+type Model struct {
+	Layers     []Layer
+	SoftmaxW   [][]float32 // [hidden size][output size]
+	SoftmaxB   []float32   // [output size]
+	ForgetBias float32     // added to the forget gate. aural2 graphs use 0.
+}
+
+// LayerState is the state of one layer.
+type LayerState struct {
+	C []float32
+	H []float32
+}
+
+// State is the state of all the layers of a model.
+type State []LayerState
+
+// Load reads a model from the bytes of a GraphDef written by tftrain.OnlineSess.Save() or tftrain.Freeze().
+func Load(graphBytes []byte) (model *Model, err error) {
+	graphDef := &pbtf.GraphDef{}
+	if err = proto.Unmarshal(graphBytes, graphDef); err != nil {
+		return
+	}
+	model, err = LoadGraphDef(graphDef)
+	return
+}
+
+// LoadGraphDef reads a model from a GraphDef.
+// The values of the variables are looked for first in the frozen/ consts written by tftrain.OnlineSess.Save(),
+// then in consts of the same name as the variable, as written by tftrain.Freeze().
+func LoadGraphDef(graphDef *pbtf.GraphDef) (model *Model, err error) {
+	consts := map[string]*pbtf.TensorProto{}
+	for _, node := range graphDef.GetNode() {
+		if node.GetOp() == "Const" {
+			consts[node.GetName()] = node.GetAttr()["value"].GetTensor()
+		}
+	}
+	getVar := func(name string) (values []float32, shape []int, err error) {
+		tensor, prs := consts["frozen/"+name]
+		if !prs {
+			tensor, prs = consts[name]
+		}
+		if !prs {
+			err = errors.New("can't find value of variable " + name)
+			return
+		}
+		values, shape, err = decodeFloats(tensor)
+		if err != nil {
+			err = errors.New(name + ": " + err.Error())
+		}
+		return
+	}
+	layerScopes := map[int]string{} // the scope of the variables of each layer, by layer number.
+	for name := range consts {
+		match := lstmVarPattern.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		layer, _ := strconv.Atoi(match[2])
+		scope := match[1]
+		if len(scope) > len("frozen/") && scope[:len("frozen/")] == "frozen/" {
+			scope = scope[len("frozen/"):]
+		}
+		layerScopes[layer] = scope
+	}
+	if len(layerScopes) == 0 {
+		err = errors.New("can't find any LSTM layers")
+		return
+	}
+	layerNums := []int{}
+	for layer := range layerScopes {
+		layerNums = append(layerNums, layer)
+	}
+	sort.Ints(layerNums)
+	model = &Model{}
+	for i, layerNum := range layerNums {
+		if layerNum != i {
+			err = errors.New("missing LSTM layer " + strconv.Itoa(i))
+			return
+		}
+		var kernel, bias []float32
+		var kernelShape []int
+		kernel, kernelShape, err = getVar(layerScopes[layerNum] + "/kernel")
+		if err != nil {
+			return
+		}
+		bias, _, err = getVar(layerScopes[layerNum] + "/bias")
+		if err != nil {
+			return
+		}
+		if len(kernelShape) != 2 || kernelShape[1] != len(bias) || len(bias)%4 != 0 {
+			err = errors.New("bad shape of LSTM layer " + strconv.Itoa(i))
+			return
+		}
+		model.Layers = append(model.Layers, Layer{Kernel: reshape(kernel, kernelShape), Bias: bias})
+	}
+	softmaxW, softmaxWshape, err := getVar(softmaxWname)
+	if err != nil {
+		return
+	}
+	model.SoftmaxB, _, err = getVar(softmaxBname)
+	if err != nil {
+		return
+	}
+	if len(softmaxWshape) != 2 || softmaxWshape[1] != len(model.SoftmaxB) || softmaxWshape[0] != model.Layers[len(model.Layers)-1].HiddenSize() {
+		err = errors.New("bad shape of softmax")
+		return
+	}
+	model.SoftmaxW = reshape(softmaxW, softmaxWshape)
+	return
+}
+
+// decodeFloats reads the values and shape of a float32 TensorProto.
+func decodeFloats(tensor *pbtf.TensorProto) (values []float32, shape []int, err error) {
+	if tensor.GetDtype() != pbtf.DataType_DT_FLOAT {
+		err = errors.New("not a float32 tensor")
+		return
+	}
+	size := 1
+	for _, dim := range tensor.GetTensorShape().GetDim() {
+		shape = append(shape, int(dim.GetSize()))
+		size *= int(dim.GetSize())
+	}
+	if content := tensor.GetTensorContent(); len(content) > 0 { // values are usually packed as little endian bytes,
+		if len(content) != size*4 {
+			err = errors.New("tensor content is the wrong size")
+			return
+		}
+		values = make([]float32, size)
+		for i := range values {
+			values[i] = math.Float32frombits(binary.LittleEndian.Uint32(content[i*4:]))
+		}
+		return
+	}
+	floatVal := tensor.GetFloatVal() // but may be in float_val, in which case the last value is repeated to fill the tensor.
+	if len(floatVal) == 0 {
+		err = errors.New("tensor has no values")
+		return
+	}
+	values = make([]float32, size)
+	for i := range values {
+		if i < len(floatVal) {
+			values[i] = floatVal[i]
+		} else {
+			values[i] = floatVal[len(floatVal)-1]
+		}
+	}
+	return
+}
+
+// reshape a flat slice into a matrix.
+func reshape(values []float32, shape []int) (matrix [][]float32) {
+	matrix = make([][]float32, shape[0])
+	for i := range matrix {
+		matrix[i] = values[i*shape[1] : (i+1)*shape[1]]
+	}
+	return
+}
+
+// InputSize is the size of each input to the model.
+func (model *Model) InputSize() int {
+	return len(model.Layers[0].Kernel) - model.Layers[0].HiddenSize()
+}
+
+// OutputSize is the number of states the model outputs.
+func (model *Model) OutputSize() int {
+	return len(model.SoftmaxB)
+}
+
+// ZeroState returns a new state of zeros.
+func (model *Model) ZeroState() (state State) {
+	state = make(State, len(model.Layers))
+	for i, layer := range model.Layers {
+		state[i] = LayerState{
+			C: make([]float32, layer.HiddenSize()),
+			H: make([]float32, layer.HiddenSize()),
+		}
+	}
+	return
+}
+
+func sigmoid(x float32) float32 {
+	return float32(1 / (1 + math.Exp(-float64(x))))
+}
+
+func tanh(x float32) float32 {
+	return float32(math.Tanh(float64(x)))
+}
+
+// step runs one BasicLSTMCell, updating state in place, and returns the new h.
+func (layer Layer) step(state LayerState, input []float32, forgetBias float32) []float32 {
+	hidden := layer.HiddenSize()
+	gates := make([]float32, len(layer.Bias)) // the concatenation of input and h, times the kernel, plus the bias.
+	copy(gates, layer.Bias)
+	for i, x := range input {
+		row := layer.Kernel[i]
+		for j := range gates {
+			gates[j] += x * row[j]
+		}
+	}
+	for i, x := range state.H {
+		row := layer.Kernel[len(input)+i]
+		for j := range gates {
+			gates[j] += x * row[j]
+		}
+	}
+	// the gates are in the order input, new input, forget, output.
+	for k := 0; k < hidden; k++ {
+		i := sigmoid(gates[k])
+		j := tanh(gates[hidden+k])
+		f := sigmoid(gates[2*hidden+k] + forgetBias)
+		o := sigmoid(gates[3*hidden+k])
+		state.C[k] = state.C[k]*f + i*j
+		state.H[k] = tanh(state.C[k]) * o
+	}
+	return state.H
+}
+
+// softmax projects the output of the top layer onto the output states.
+func (model *Model) softmax(h []float32) (probs []float32) {
+	logits := make([]float64, len(model.SoftmaxB))
+	max := math.Inf(-1)
+	for j := range logits {
+		logits[j] = float64(model.SoftmaxB[j])
+		for i, x := range h {
+			logits[j] += float64(x * model.SoftmaxW[i][j])
+		}
+		max = math.Max(max, logits[j])
+	}
+	var sum float64
+	for j := range logits {
+		logits[j] = math.Exp(logits[j] - max) // subtract the max for numerical stability.
+		sum += logits[j]
+	}
+	probs = make([]float32, len(logits))
+	for j := range logits {
+		probs[j] = float32(logits[j] / sum)
+	}
+	return
+}
+
+// Step feeds one input through the model, updating state in place, and returns the probabilities of each output state.
+func (model *Model) Step(state State, input []float32) (probs []float32, err error) {
+	if len(input) != model.InputSize() {
+		err = errors.New("input is of size " + strconv.Itoa(len(input)) + ", expected " + strconv.Itoa(model.InputSize()))
+		return
+	}
+	if len(state) != len(model.Layers) {
+		err = errors.New("state does not match model")
+		return
+	}
+	x := input
+	for i, layer := range model.Layers {
+		x = layer.step(state[i], x, model.ForgetBias)
+	}
+	probs = model.softmax(x)
+	return
+}
+
+// Seq runs a whole sequence of inputs through the model from zero state, and returns the probabilities for each input.
+func (model *Model) Seq(inputs [][]float32) (probsList [][]float32, err error) {
+	state := model.ZeroState()
+	probsList = make([][]float32, len(inputs))
+	for i, input := range inputs {
+		probsList[i], err = model.Step(state, input)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
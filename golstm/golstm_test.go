@@ -0,0 +1,157 @@
+package golstm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"testing"
+
+	tf "github.com/tensorflow/tensorflow/tensorflow/go"
+	"github.ibm.com/Blue-Horizon/aural2/features"
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+	"github.ibm.com/Blue-Horizon/aural2/tfutils"
+	pbtf "github.ibm.com/Blue-Horizon/aural2/tfutils/demo/protobuf/tensorflow/core/framework"
+	"github.ibm.com/Blue-Horizon/aural2/tfutils/lstmutils"
+)
+
+// makeConst makes a Const node of a float32 tensor, packed as tensor content.
+func makeConst(name string, values []float32, shape ...int64) *pbtf.NodeDef {
+	content := make([]byte, len(values)*4)
+	for i, value := range values {
+		binary.LittleEndian.PutUint32(content[i*4:], math.Float32bits(value))
+	}
+	dims := []*pbtf.TensorShapeProto_Dim{}
+	for _, size := range shape {
+		dims = append(dims, &pbtf.TensorShapeProto_Dim{Size: size})
+	}
+	return &pbtf.NodeDef{
+		Name: name,
+		Op:   "Const",
+		Attr: map[string]*pbtf.AttrValue{
+			"value": &pbtf.AttrValue{Value: &pbtf.AttrValue_Tensor{Tensor: &pbtf.TensorProto{
+				Dtype:         pbtf.DataType_DT_FLOAT,
+				TensorShape:   &pbtf.TensorShapeProto{Dim: dims},
+				TensorContent: content,
+			}}},
+		},
+	}
+}
+
+func TestStep(t *testing.T) {
+	// one layer, one input, one hidden unit, two outputs.
+	graphDef := &pbtf.GraphDef{Node: []*pbtf.NodeDef{
+		makeConst("frozen/rnn/multi_rnn_cell/cell_0/basic_lstm_cell/kernel", []float32{1, 2, 3, 4, 0.5, 0.5, 0.5, 0.5}, 2, 4),
+		makeConst("frozen/rnn/multi_rnn_cell/cell_0/basic_lstm_cell/bias", []float32{0, 0, 0, 0}, 4),
+		makeConst("frozen/softmax/softmax_w", []float32{1, -1}, 1, 2),
+		makeConst("frozen/softmax/softmax_b", []float32{0, 0}, 2),
+	}}
+	model, err := LoadGraphDef(graphDef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.InputSize() != 1 || model.OutputSize() != 2 || len(model.Layers) != 1 {
+		t.Fatal("wrong size of model")
+	}
+	state := model.ZeroState()
+	probs, err := model.Step(state, []float32{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := func(x float64) float64 { return 1 / (1 + math.Exp(-x)) }
+	c := sig(1) * math.Tanh(2) // the forget gate has nothing to forget in the first step.
+	h := math.Tanh(c) * sig(4)
+	if math.Abs(float64(state[0].C[0])-c) > 1e-6 || math.Abs(float64(state[0].H[0])-h) > 1e-6 {
+		t.Fatal("wrong state:", state[0], c, h)
+	}
+	expected := math.Exp(h) / (math.Exp(h) + math.Exp(-h))
+	if math.Abs(float64(probs[0])-expected) > 1e-6 || math.Abs(float64(probs[0]+probs[1])-1) > 1e-6 {
+		t.Fatal("wrong probs:", probs, expected)
+	}
+	if _, err = model.Step(state, []float32{1, 2}); err == nil {
+		t.Fatal("should not accept input of the wrong size")
+	}
+	probsList, err := model.Seq([][]float32{{1}, {0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probsList[0][0] != probs[0] {
+		t.Fatal("seq should start from zero state")
+	}
+}
+
+func TestLoadMissingSoftmax(t *testing.T) {
+	graphDef := &pbtf.GraphDef{Node: []*pbtf.NodeDef{
+		makeConst("rnn/multi_rnn_cell/cell_0/basic_lstm_cell/kernel", []float32{1, 2, 3, 4, 0.5, 0.5, 0.5, 0.5}, 2, 4),
+		makeConst("rnn/multi_rnn_cell/cell_0/basic_lstm_cell/bias", []float32{0, 0, 0, 0}, 4),
+	}}
+	if _, err := LoadGraphDef(graphDef); err == nil {
+		t.Fatal("should not load a model without a softmax")
+	}
+}
+
+// TestAgreesWithTF checks that golstm gives the same outputs as TensorFlow for a saved model.
+func TestAgreesWithTF(t *testing.T) {
+	rawBytes, err := ioutil.ReadFile("../tfutils/lstmutils/testaudio2.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audioClip := &libaural2.AudioClip{}
+	copy(audioClip[:], rawBytes)
+	graphBytes, err := ioutil.ReadFile("../tfutils/lstmutils/intent.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph := tf.NewGraph()
+	if err := graph.Import(graphBytes, ""); err != nil {
+		t.Fatal(err)
+	}
+	oSess, err := lstmutils.NewOnlineSess(graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := oSess.Save() // save the model just as aural2 would.
+	if err != nil {
+		t.Fatal(err)
+	}
+	buff := bytes.Buffer{}
+	if _, err = saved.WriteTo(&buff); err != nil {
+		t.Fatal(err)
+	}
+	model, err := Load(buff.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stepInference, err := lstmutils.MakeStepInference(oSess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audioClipToMFCCtensor, err := tfutils.MakeAudioClipToMFCCtensor(features.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfccTensor, err := audioClipToMFCCtensor(audioClip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := model.ZeroState()
+	for i, mfcc := range mfccTensor.Value().([][][]float32)[0] {
+		stepTensor, err := tf.NewTensor([][][]float32{[][]float32{mfcc}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := stepInference(stepTensor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		probs, err := model.Step(state, mfcc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range expected {
+			if math.Abs(float64(probs[j]-expected[j])) > 1e-4 {
+				t.Fatal("step", i, "state", j, "golstm:", probs[j], "tf:", expected[j])
+			}
+		}
+	}
+}
@@ -17,6 +17,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.ibm.com/Blue-Horizon/aural2/boltstore"
+	"github.ibm.com/Blue-Horizon/aural2/features"
 	"github.ibm.com/Blue-Horizon/aural2/libaural2"
 	"github.ibm.com/Blue-Horizon/aural2/tftrain"
 	"github.ibm.com/Blue-Horizon/aural2/urbitname"
@@ -197,6 +198,90 @@ func makeServeIndex(list func() []libaural2.ClipID, vocabPrs map[libaural2.Vocab
 	}
 }
 
+func makeServeQueue(scorer *clipScorer, vocabPrs map[libaural2.VocabName]bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vocabName := libaural2.VocabName(mux.Vars(r)["vocab"])
+		if !vocabPrs[vocabName] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var queueTemplate = template.Must(template.ParseFiles("webgui/templates/queue.html"))
+		params := struct {
+			Scores    []clipScore
+			VocabName libaural2.VocabName
+		}{
+			Scores:    scorer.ranked(vocabName),
+			VocabName: vocabName,
+		}
+		err := queueTemplate.Execute(w, params)
+		if err != nil {
+			logger.Println(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// makeServeReview makes a handler for a page comparing the labels of each clip with the predictions of the model.
+func makeServeReview(scorer *clipScorer, vocabPrs map[libaural2.VocabName]bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vocabName := libaural2.VocabName(mux.Vars(r)["vocab"])
+		if !vocabPrs[vocabName] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var reviewTemplate = template.Must(template.ParseFiles("webgui/templates/review.html"))
+		scores := scorer.byDisagreement(vocabName)
+		if r.URL.Query().Get("order") == "asc" { // least disagreement first
+			for i, j := 0, len(scores)-1; i < j; i, j = i+1, j-1 {
+				scores[i], scores[j] = scores[j], scores[i]
+			}
+		}
+		params := struct {
+			Scores    []clipScore
+			VocabName libaural2.VocabName
+		}{
+			Scores:    scores,
+			VocabName: vocabName,
+		}
+		err := reviewTemplate.Execute(w, params)
+		if err != nil {
+			logger.Println(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// makeServeLive makes a handler for the page which shows the live input and what the models make of it.
+func makeServeLive() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var liveTemplate = template.Must(template.ParseFiles("webgui/templates/live.html"))
+		if err := liveTemplate.Execute(w, nil); err != nil {
+			logger.Println(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// makeServeNextClip makes a handler which redirects to the tag UI of the most useful unlabeled clip.
+func makeServeNextClip(scorer *clipScorer, vocabPrs map[libaural2.VocabName]bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vocabName := libaural2.VocabName(mux.Vars(r)["vocab"])
+		if !vocabPrs[vocabName] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		score, ok := scorer.next(vocabName)
+		if !ok {
+			http.Error(w, "no unlabeled clips have been scored yet", http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, "/tagui/"+string(vocabName)+"/"+score.ID.FSsafeString(), http.StatusFound)
+	}
+}
+
 func makeServeTagUI(vocabPrs map[libaural2.VocabName]bool) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		audioIDstring := mux.Vars(r)["sampleID"]
@@ -333,10 +418,13 @@ type clipToBlob func(*libaural2.AudioClip, libaural2.VocabName) ([]byte, error)
 func serve(
 	db boltstore.DB,
 	onlineSessions map[libaural2.VocabName]*tftrain.OnlineSess,
+	featureCaches map[libaural2.VocabName]*features.Cache,
 	namesPrs map[libaural2.VocabName]bool,
 	dumpClip func() *libaural2.AudioClip,
 	tdmMap map[libaural2.VocabName]*trainingDataMaps,
 	sleepms *int32,
+	scorer *clipScorer,
+	hub *liveHub,
 ) {
 	defer db.Close()
 	makeServeAudioDerivedBlob := makeMakeServeAudioDerivedBlob(namesPrs)
@@ -353,15 +441,27 @@ func serve(
 	if err != nil {
 		logger.Fatalln(err)
 	}
-	renderProbs, err := makeRenderProbs(onlineSessions)
+	renderProbs, err := makeRenderProbs(onlineSessions, featureCaches)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	renderArgmaxedStates, err := makeRenderArgmaxedStates(onlineSessions, featureCaches)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	renderStates, err := makeRenderLSTMstate(onlineSessions, featureCaches)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	renderDraft, err := makeRenderDraftLabelSet(onlineSessions, featureCaches, libaural2.DefaultDraftParams)
 	if err != nil {
 		logger.Fatalln(err)
 	}
-	renderArgmaxedStates, err := makeRenderArgmaxedStates(onlineSessions)
+	renderVAD, err := makeRenderVAD()
 	if err != nil {
 		logger.Fatalln(err)
 	}
-	renderStates, err := makeRenderLSTMstate(onlineSessions)
+	renderVADsegments, err := makeRenderVADsegments()
 	if err != nil {
 		logger.Fatalln(err)
 	}
@@ -379,6 +479,7 @@ func serve(
 			err = errors.New("can't find training data map for " + string(labelSet.VocabName))
 		}
 		err = tdm.addClip(labelSet.ID)
+		scorer.markLabeled(labelSet)
 		return
 	}
 	r := mux.NewRouter()
@@ -388,15 +489,25 @@ func serve(
 	r.HandleFunc("/images/probs/{vocab}/{sampleID}.jpeg", makeServeAudioDerivedBlob(renderProbs))
 	r.HandleFunc("/images/argmax/{vocab}/{sampleID}.png", makeServeAudioDerivedBlob(renderArgmaxedStates))
 	r.HandleFunc("/images/states/{vocab}/{sampleID}.png", makeServeAudioDerivedBlob(renderStates))
+	r.HandleFunc("/images/vad/{vocab}/{sampleID}.png", makeServeAudioDerivedBlob(renderVAD))
 	r.HandleFunc("/images/labelset/{vocab}/{sampleID}.png", makeServeLabelsSetDerivedBlob(namesPrs, db.GetLabelSet, renderColorLabelSetImage))
 	r.HandleFunc("/audio/{vocab}/{sampleID}.wav", makeServeAudioDerivedBlob(computeWav))
 	r.HandleFunc("/tagui/{vocab}/{sampleID}", makeServeTagUI(namesPrs))
 	r.HandleFunc("/{vocab}/index", makeServeIndex(db.ListAudioClips, namesPrs))
+	r.HandleFunc("/{vocab}/queue", makeServeQueue(scorer, namesPrs))
+	r.HandleFunc("/{vocab}/next", makeServeNextClip(scorer, namesPrs))
+	r.HandleFunc("/{vocab}/review", makeServeReview(scorer, namesPrs))
 	r.HandleFunc("/labelsset/{vocab}/{sampleID}", makeWriteLabelsSet(putLabelSets, namesPrs)).Methods("POST")
 	r.HandleFunc("/labelsset/{vocab}/{sampleID}", makeServeLabelsSetDerivedBlob(namesPrs, db.GetLabelSet, serializeLabelSet)).Methods("GET")
+	r.HandleFunc("/draft/{vocab}/{sampleID}", makeServeAudioDerivedBlob(renderDraft)).Methods("GET")
+	r.HandleFunc("/vad/{vocab}/{sampleID}", makeServeAudioDerivedBlob(renderVADsegments)).Methods("GET")
 	r.HandleFunc("/saveclip", makeSampleHandler(db.PutClipID, dumpClip))
+	r.HandleFunc("/sample/upload", makeUploadHandler(makeImportAudio(db))).Methods("POST")
 	r.HandleFunc("/sleepms", makeSetSleepms(sleepms))
 	r.HandleFunc("/savemodels", makeSaveModel(onlineSessions))
+	r.HandleFunc("/live", makeServeLive()).Methods("GET")
+	r.HandleFunc("/live/events", makeServeLiveEvents(hub)).Methods("GET")
+	r.HandleFunc("/live/ws", makeServeLiveWS(hub)).Methods("GET")
 	fs := http.FileServer(http.Dir("webgui/static"))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
 	http.Handle("/", r)
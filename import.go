@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.ibm.com/Blue-Horizon/aural2/audioconv"
+	"github.ibm.com/Blue-Horizon/aural2/boltstore"
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+)
+
+// maxUploadBytes is the largest recording which may be POSTed to /sample/upload, about an hour of 48 kHz stereo S32_LE WAV.
+const maxUploadBytes = 1 << 30
+
+// badAudioError is an error in the audio given to import, rather than in saving it.
+type badAudioError struct {
+	error
+}
+
+// toNative converts an uploaded recording into 16 kHz mono S16_LE audio. WAV files may be of any supported format, anything else must already be raw 16 kHz mono S16_LE.
+func toNative(upload []byte) (rawBytes []byte, err error) {
+	if bytes.HasPrefix(upload, []byte("RIFF")) {
+		rawBytes, err = audioconv.WavToNative(upload)
+		return
+	}
+	if len(upload)%2 != 0 {
+		err = errors.New("raw audio must be whole 16 bit samples")
+		return
+	}
+	rawBytes = upload
+	return
+}
+
+// makeImportAudio makes a func which splits a recording of any length into clips which overlap by overlap seconds,
+// saves them like the clips from vsh, and records where each one came from, if source is not empty.
+// Errors in the recording itself are badAudioErrors.
+func makeImportAudio(db boltstore.DB) func(string, []byte, float64) ([]libaural2.ClipID, error) {
+	return func(source string, upload []byte, overlap float64) (ids []libaural2.ClipID, err error) {
+		rawBytes, err := toNative(upload)
+		if err != nil {
+			err = badAudioError{err}
+			return
+		}
+		clips, offsets, err := libaural2.SplitIntoClips(rawBytes, int(overlap*float64(libaural2.SampleRate)))
+		if err != nil {
+			err = badAudioError{err}
+			return
+		}
+		imported := time.Now()
+		for i := range clips {
+			id := clips[i].ID()
+			if err = ioutil.WriteFile("persist/audio/"+id.FSsafeString()+".raw", clips[i][:], 0777); err != nil {
+				return
+			}
+			if err = db.PutClipID(id); err != nil {
+				return
+			}
+			ids = append(ids, id)
+			if source == "" { // clips saved by vsh come from the microphone, not from a recording.
+				continue
+			}
+			info := boltstore.ImportInfo{
+				Source:   source,
+				Offset:   float64(offsets[i]) / float64(libaural2.SampleRate),
+				Imported: imported,
+			}
+			if err = db.PutImportInfo(id, info); err != nil {
+				return
+			}
+		}
+		return
+	}
+}
+
+// makeUploadHandler makes a handler which imports the WAV or raw audio in the body of the request, and writes the IDs of the resulting clips as a JSON list.
+// The overlap query param is the seconds by which clips overlap, and source is the name to record the clips as coming from.
+// Without a source, such as for the clips POSTed by vsh, where the clips came from is not recorded.
+func makeUploadHandler(importAudio func(string, []byte, float64) ([]libaural2.ClipID, error)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var overlap float64
+		if overlapString := r.URL.Query().Get("overlap"); overlapString != "" {
+			var err error
+			overlap, err = strconv.ParseFloat(overlapString, 64)
+			if err != nil {
+				logger.Println(err)
+				http.Error(w, "overlap must be a number of seconds", http.StatusBadRequest)
+				return
+			}
+		}
+		source := r.URL.Query().Get("source")
+		upload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadBytes))
+		if err != nil {
+			logger.Println(err)
+			http.Error(w, "recording is too large or could not be read", http.StatusRequestEntityTooLarge)
+			return
+		}
+		ids, err := importAudio(source, upload, overlap)
+		if _, bad := err.(badAudioError); bad {
+			logger.Println(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			logger.Println(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		logger.Println("imported", len(ids), "clips from", source)
+		idStrings := []string{}
+		for _, id := range ids {
+			idStrings = append(idStrings, id.FSsafeString())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(idStrings)
+	}
+}
+
+// runImport imports WAV files given on the command line, such as `aural2 import -overlap 2 meeting.wav`.
+// Bolt allows only one process to open the DB, so aural2 must not be running.
+func runImport(args []string) (err error) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	overlap := flags.Float64("overlap", 0, "seconds by which clips overlap")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		err = errors.New("usage: aural2 import [-overlap seconds] file.wav...")
+		return
+	}
+	db, err := boltstore.Init("persist/label_store.db", []libaural2.VocabName{"word", "intent"})
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	importAudio := makeImportAudio(db)
+	for _, path := range flags.Args() {
+		wavBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		ids, err := importAudio(filepath.Base(path), wavBytes, *overlap)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		for _, id := range ids {
+			fmt.Println(path, id.FSsafeString())
+		}
+	}
+	return
+}
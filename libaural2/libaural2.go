@@ -7,8 +7,11 @@ import (
 	"encoding/base32"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"image/color"
+	"math"
+	"strconv"
 
 	"github.com/lucasb-eyer/go-colorful"
 
@@ -54,6 +57,31 @@ type InputSet [StridesPerClip]Input
 // Output is one output, the softmax array of States.
 type Output []float32
 
+// Entropy returns the entropy of the softmax in nats. High entropy means the model is unsure which state it is in.
+func (output Output) Entropy() (entropy float64) {
+	for _, prob := range output {
+		if prob > 0 {
+			entropy -= float64(prob) * math.Log(float64(prob))
+		}
+	}
+	return
+}
+
+// Margin returns the difference betwene the probabilities of the two most likely states. A low margin means the model can't decide betwene them.
+func (output Output) Margin() (margin float32) {
+	var first, second float32
+	for _, prob := range output {
+		if prob > first {
+			second = first
+			first = prob
+		} else if prob > second {
+			second = prob
+		}
+	}
+	margin = first - second
+	return
+}
+
 // OutputSet is the set of outputs for one clip.
 type OutputSet [StridesPerClip]Output
 
@@ -79,6 +107,30 @@ func (rawBytes *AudioClip) ID() ClipID {
 	return sha256.Sum256(rawBytes[:])
 }
 
+// SplitIntoClips splits raw audio of any length into clips which overlap by overlap samples.
+// The last clip is padded with silence. offsets are the first sample of each clip in the audio.
+func SplitIntoClips(rawBytes []byte, overlap int) (clips []AudioClip, offsets []int, err error) {
+	if overlap < 0 || overlap >= SamplePerClip {
+		err = errors.New("overlap must be at least 0 and less then " + strconv.Itoa(SamplePerClip) + " samples")
+		return
+	}
+	numSamples := len(rawBytes) / 2
+	if numSamples == 0 {
+		err = errors.New("no audio to split")
+		return
+	}
+	hop := SamplePerClip - overlap
+	for offset := 0; ; offset += hop {
+		var clip AudioClip
+		copy(clip[:], rawBytes[offset*2:numSamples*2])
+		clips = append(clips, clip)
+		offsets = append(offsets, offset)
+		if offset+SamplePerClip >= numSamples { // this clip reaches the end of the audio.
+			return
+		}
+	}
+}
+
 // ClipID is the hash of a clip of raw audio
 type ClipID [32]byte
 
@@ -123,6 +175,16 @@ func (voc Vocabulary) Color(state State) (c color.Color) {
 	return
 }
 
+// StateByName finds the state with the given name. prs is false if the vocabulary has no such state.
+func (voc Vocabulary) StateByName(name string) (state State, prs bool) {
+	for state, stateName := range voc.Names {
+		if stateName == name {
+			return state, true
+		}
+	}
+	return
+}
+
 var testVocab Vocabulary
 
 // Hue returns the hue as a float64
@@ -179,6 +241,86 @@ func (labels *LabelSet) ToStateArray() (stateArray [StridesPerClip]State) {
 	return
 }
 
+// DraftParams controls how the outputs of a model are turned into a draft LabelSet.
+type DraftParams struct {
+	SmoothingWindow int     // number of strides to average the probabilities over before taking the argmax.
+	MinDuration     float64 // labels shorter then this many seconds are dropped.
+	MinConfidence   float32 // labels whose mean smoothed probability is lower then this are dropped.
+}
+
+// DefaultDraftParams are sane defaults for drafting labels.
+var DefaultDraftParams = DraftParams{
+	SmoothingWindow: 5,
+	MinDuration:     0.1,
+	MinConfidence:   0.5,
+}
+
+// DraftLabelSet converts the outputs of a model for one clip into a LabelSet. Strides in the Nil state are not labeled.
+func DraftLabelSet(vocabName VocabName, id ClipID, probsList [][]float32, params DraftParams) (labelSet LabelSet) {
+	labelSet = LabelSet{
+		VocabName: vocabName,
+		ID:        id,
+		Labels:    []Label{},
+	}
+	smoothed := make([][]float32, len(probsList))
+	for i := range probsList { // average each stride with its neighbors.
+		smoothed[i] = make([]float32, len(probsList[i]))
+		start := i - params.SmoothingWindow/2
+		end := start + params.SmoothingWindow
+		if start < 0 {
+			start = 0
+		}
+		if end <= i {
+			end = i + 1
+		}
+		if end > len(probsList) {
+			end = len(probsList)
+		}
+		for _, probs := range probsList[start:end] {
+			for state, prob := range probs {
+				smoothed[i][state] += prob / float32(end-start)
+			}
+		}
+	}
+	strideDuration := float64(Duration) / float64(StridesPerClip)
+	var runStart int
+	var runState State
+	var runSum float32
+	for i := 0; i <= len(smoothed); i++ {
+		var state State
+		var prob float32
+		if i < len(smoothed) {
+			for s, p := range smoothed[i] { // argmax
+				if p > prob {
+					prob = p
+					state = State(s)
+				}
+			}
+			if i > 0 && state == runState {
+				runSum += prob
+				continue
+			}
+		}
+		if i > 0 && runState != Nil { // the run has ended, so label it if it is good enough.
+			length := i - runStart
+			duration := float64(length) * strideDuration
+			if duration >= params.MinDuration && runSum/float32(length) >= params.MinConfidence {
+				// the edges of the label are placed half way betwene strides so that ToStateArray() will return the same states.
+				label := Label{
+					State: runState,
+					Start: math.Max(0, (float64(runStart)-0.5)*strideDuration),
+					End:   math.Min(float64(Duration), (float64(i)-0.5)*strideDuration),
+				}
+				labelSet.Labels = append(labelSet.Labels, label)
+			}
+		}
+		runStart = i
+		runState = state
+		runSum = prob
+	}
+	return
+}
+
 // IsGood returns true iff the labelsSet contains no overlaps or other bad things. Executes in O(n2) time.
 func (labels *LabelSet) IsGood() bool {
 	for _, label := range labels.Labels {
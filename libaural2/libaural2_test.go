@@ -3,6 +3,8 @@ package libaural2
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
+	"math"
 	"testing"
 )
 
@@ -145,3 +147,104 @@ func TestIsGood(t *testing.T) {
 		t.Fatal("out of bound is good")
 	}
 }
+
+func TestEntropy(t *testing.T) {
+	certain := Output{0, 1, 0, 0}
+	if certain.Entropy() != 0 {
+		t.Fatal("certain output should have 0 entropy, got", certain.Entropy())
+	}
+	uniform := Output{0.25, 0.25, 0.25, 0.25}
+	if math.Abs(uniform.Entropy()-math.Log(4)) > 1e-6 {
+		t.Fatal("uniform output should have entropy ln(4), got", uniform.Entropy())
+	}
+}
+
+func TestMargin(t *testing.T) {
+	output := Output{0.1, 0.6, 0.05, 0.25}
+	if math.Abs(float64(output.Margin()-0.35)) > 1e-6 {
+		t.Fatal("expected margin of 0.35, got", output.Margin())
+	}
+	output = Output{0.5, 0.5}
+	if output.Margin() != 0 {
+		t.Fatal("expected margin of 0, got", output.Margin())
+	}
+}
+
+func TestDraftLabelSet(t *testing.T) {
+	labelSet := GenFakeLabelSet()
+	stateArray := labelSet.ToStateArray()
+	probsList := make([][]float32, StridesPerClip)
+	for i, state := range stateArray {
+		probsList[i] = make([]float32, 7)
+		probsList[i][state] = 0.9
+		probsList[i][Unknown] = 0.1
+	}
+	params := DraftParams{
+		SmoothingWindow: 1,
+		MinDuration:     0.1,
+		MinConfidence:   0.5,
+	}
+	draft := DraftLabelSet("foo", labelSet.ID, probsList, params)
+	if !draft.IsGood() {
+		t.Fatal("draft is not good")
+	}
+	if len(draft.Labels) != 6 {
+		t.Fatal("expected 6 non Nil labels, got", len(draft.Labels))
+	}
+	if draft.ToStateArray() != stateArray {
+		t.Fatal("draft does not match the labels it was drafted from")
+	}
+	params.MinConfidence = 0.95
+	draft = DraftLabelSet("foo", labelSet.ID, probsList, params)
+	if len(draft.Labels) != 0 {
+		t.Fatal("expected low confidence labels to be dropped, got", len(draft.Labels))
+	}
+	params.MinConfidence = 0.5
+	params.MinDuration = 2
+	draft = DraftLabelSet("foo", labelSet.ID, probsList, params)
+	if len(draft.Labels) != 0 {
+		t.Fatal("expected short labels to be dropped, got", len(draft.Labels))
+	}
+}
+
+func TestSplitIntoClips(t *testing.T) {
+	numSamples := SamplePerClip*2 + SamplePerClip/4 // 22.5 seconds
+	rawBytes := make([]byte, numSamples*2)
+	for i := 0; i < numSamples; i++ {
+		binary.LittleEndian.PutUint16(rawBytes[i*2:], uint16(i))
+	}
+	clips, offsets, err := SplitIntoClips(rawBytes, SamplePerClip/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clips) != 4 || len(offsets) != 4 {
+		t.Fatal("expected 4 clips, got", len(clips))
+	}
+	for i, offset := range offsets {
+		if offset != i*SamplePerClip/2 {
+			t.Fatal("clip", i, "starts at", offset)
+		}
+		if !bytes.Equal(clips[i][:20], rawBytes[offset*2:offset*2+20]) {
+			t.Fatal("clip", i, "does not start at its offset")
+		}
+	}
+	last := clips[3][(numSamples-offsets[3])*2:]
+	if !bytes.Equal(last, make([]byte, len(last))) {
+		t.Fatal("the last clip should be padded with silence")
+	}
+	clips, _, err = SplitIntoClips(rawBytes[:100], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clips) != 1 {
+		t.Fatal("short audio should make one clip, got", len(clips))
+	}
+	for _, overlap := range []int{-1, SamplePerClip} {
+		if _, _, err = SplitIntoClips(rawBytes, overlap); err == nil {
+			t.Fatal("overlap of", overlap, "should not be allowed")
+		}
+	}
+	if _, _, err = SplitIntoClips(nil, 0); err == nil {
+		t.Fatal("empty audio should not split")
+	}
+}
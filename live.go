@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.ibm.com/Blue-Horizon/aural2/features"
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+	"github.ibm.com/Blue-Horizon/aural2/vsh"
+)
+
+// Types of live event.
+const (
+	liveIntent   = "intent"   // an intentMsg: an action, confirmation, command or utterance.
+	liveAction   = "action"   // a vsh.ActionEvent: an action of any rule ran, whatever its handler.
+	liveProbs    = "probs"    // the raw probs of one vocab for one stride.
+	liveDecoded  = "decoded"  // the decoded probs of one vocab for one stride, which the rules are thresholded against.
+	liveSpectrum = "spectrum" // the spectrum of the audio of one stride.
+)
+
+// spectrumBins is the number of frequency bins in the spectrum of each stride.
+const spectrumBins = 128
+
+// strideSpectrum computes the spectrum of the raw audio of a stride, as one byte per bin of the power from -80 dB to +40 dB, so that it is small to send.
+func strideSpectrum(spectrogram *features.Spectrogram, audio []byte) (spectrum []byte) {
+	power := spectrogram.Frame(features.PCMFromInt16LE(audio))
+	spectrum = make([]byte, spectrumBins)
+	binWidth := (len(power) - 1) / spectrumBins
+	for bin := range spectrum {
+		var max float64
+		for _, channelPower := range power[bin*binWidth : (bin+1)*binWidth] {
+			if channelPower > max {
+				max = channelPower
+			}
+		}
+		dB := 10 * math.Log10(max+1e-12)
+		spectrum[bin] = byte(math.Max(0, math.Min(255, (dB+80)*255/120)))
+	}
+	return
+}
+
+// liveEventBuffer is the number of events a subscriber may fall behind by.
+const liveEventBuffer = 64
+
+// liveEvent is one event sent to the subscribers of the live stream.
+type liveEvent struct {
+	Type  string              `json:"type"`
+	Vocab libaural2.VocabName `json:"vocab,omitempty"` // vocab of the probs or action
+	TS    time.Time           `json:"ts"`
+	Data  interface{}         `json:"data"` // the intentMsg, the vsh.ActionEvent, the probs, or the spectrum as base64
+	name  string              // name of the intent or action, to filter by
+}
+
+// liveFilter says which events a subscriber wants. An empty set lets all through.
+type liveFilter struct {
+	types  map[string]bool
+	vocabs map[libaural2.VocabName]bool
+	names  map[string]bool
+}
+
+// parseLiveFilter reads the filter from query params such as ?types=intent,probs,spectrum&vocabs=intent&names=play0.95,pause0.95.
+// Without types, only intents are sent.
+func parseLiveFilter(query url.Values) (filter liveFilter) {
+	filter = liveFilter{types: map[string]bool{}, vocabs: map[libaural2.VocabName]bool{}, names: map[string]bool{}}
+	for _, item := range splitParam(query.Get("types")) {
+		filter.types[item] = true
+	}
+	if len(filter.types) == 0 {
+		filter.types[liveIntent] = true
+	}
+	for _, item := range splitParam(query.Get("vocabs")) {
+		filter.vocabs[libaural2.VocabName(item)] = true
+	}
+	for _, item := range splitParam(query.Get("names")) {
+		filter.names[item] = true
+	}
+	return
+}
+
+// splitParam splits a comma separated list, dropping empty items.
+func splitParam(param string) (items []string) {
+	for _, item := range strings.Split(param, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+func (filter liveFilter) matches(event liveEvent) bool {
+	if !filter.types[event.Type] {
+		return false
+	}
+	if event.Vocab != "" && len(filter.vocabs) > 0 && !filter.vocabs[event.Vocab] {
+		return false
+	}
+	if mustSend(event.Type) && len(filter.names) > 0 && !filter.names[event.name] {
+		return false
+	}
+	return true
+}
+
+// mustSend returns true for the types of event which a subscriber must never silently miss.
+func mustSend(eventType string) bool {
+	return eventType == liveIntent || eventType == liveAction
+}
+
+// liveSubscriber is one client of the live stream.
+type liveSubscriber struct {
+	filter  liveFilter
+	events  chan liveEvent // closed when the subscriber is dropped
+	dropped int            // number of probs and spectra dropped because the subscriber fell behind
+}
+
+// liveHub sends live events to its subscribers.
+// A subscriber which falls behind misses probs and spectra, but a subscriber which falls behind on intents or actions is disconnected, so that it never silently misses one.
+type liveHub struct {
+	mutex       sync.Mutex
+	subscribers map[*liveSubscriber]bool
+}
+
+func newLiveHub() *liveHub {
+	return &liveHub{subscribers: map[*liveSubscriber]bool{}}
+}
+
+func (hub *liveHub) subscribe(filter liveFilter) (sub *liveSubscriber) {
+	sub = &liveSubscriber{filter: filter, events: make(chan liveEvent, liveEventBuffer)}
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	hub.subscribers[sub] = true
+	return
+}
+
+// unsubscribe drops the subscriber, closing its events. It is safe to call more then once.
+func (hub *liveHub) unsubscribe(sub *liveSubscriber) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	hub.drop(sub)
+}
+
+func (hub *liveHub) drop(sub *liveSubscriber) {
+	if hub.subscribers[sub] {
+		delete(hub.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// wants returns true if any subscriber wants events of the type, so that they need not be made if not.
+func (hub *liveHub) wants(eventType string) bool {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	for sub := range hub.subscribers {
+		if sub.filter.types[eventType] {
+			return true
+		}
+	}
+	return false
+}
+
+// publish sends the event to the subscribers which want it, without waiting for any of them.
+func (hub *liveHub) publish(event liveEvent) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	for sub := range hub.subscribers {
+		if !sub.filter.matches(event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			if !mustSend(event.Type) {
+				sub.dropped++
+				if sub.dropped%100 == 1 {
+					logger.Println("live subscriber is too slow, dropped", sub.dropped, "events")
+				}
+				continue
+			}
+			logger.Println("live subscriber is too slow, disconnecting it")
+			hub.drop(sub)
+		}
+	}
+}
+
+// publishIntents publishes each intentMsg sent to intents.
+func (hub *liveHub) publishIntents(intents chan intentMsg) {
+	for msg := range intents {
+		hub.publish(liveEvent{Type: liveIntent, TS: msg.TS, Data: msg, name: msg.Name})
+	}
+}
+
+// publishAction publishes an action which ran. It does not block, so it may be given to EventBroker.OnAction.
+func (hub *liveHub) publishAction(event vsh.ActionEvent) {
+	hub.publish(liveEvent{Type: liveAction, Vocab: event.Vocab, TS: event.TS, Data: event, name: event.Action})
+}
+
+// teeResults publishes the probs of each result as events of probsType, and the spectrum of its audio if spectra, passing the results on.
+func (hub *liveHub) teeResults(results chan vsh.Result, probsType string, spectra bool) (passed chan vsh.Result) {
+	passed = make(chan vsh.Result)
+	spectrogram := features.NewSpectrogram(libaural2.StrideWidth, libaural2.StrideWidth)
+	go func() {
+		defer close(passed)
+		for result := range results {
+			now := time.Now()
+			if spectra && len(result.Audio) == libaural2.StrideWidth*2 && hub.wants(liveSpectrum) {
+				hub.publish(liveEvent{Type: liveSpectrum, TS: now, Data: strideSpectrum(spectrogram, result.Audio)})
+			}
+			if hub.wants(probsType) {
+				for vocab, probs := range result.Probs {
+					if len(probs) == 0 { // the model may not have been run yet.
+						continue
+					}
+					hub.publish(liveEvent{Type: probsType, Vocab: vocab, TS: now, Data: append([]float32{}, probs...)})
+				}
+			}
+			passed <- result
+		}
+	}()
+	return
+}
+
+// serveTCP sends the intents, as JSON, to each client which connects to l, as the intent stream always has.
+func (hub *liveHub) serveTCP(l net.Listener) {
+	for connsIndex := 1; ; connsIndex++ {
+		conn, err := l.Accept()
+		if err != nil {
+			fmt.Println("Error accepting: ", err.Error())
+			continue
+		}
+		fmt.Println("adding connection", connsIndex)
+		sub := hub.subscribe(liveFilter{types: map[string]bool{liveIntent: true}})
+		go func(conn net.Conn, index int) {
+			defer conn.Close()
+			encoder := json.NewEncoder(conn)
+			for event := range sub.events {
+				if err := encoder.Encode(event.Data); err != nil {
+					logger.Println("got error:", err.Error(), "closing connection", index)
+					hub.unsubscribe(sub)
+					return
+				}
+			}
+			logger.Println("closing connection", index)
+		}(conn, connsIndex)
+	}
+}
+
+// makeServeLiveEvents makes a handler which streams the live events as Server-Sent Events, until the client goes away.
+func makeServeLiveEvents(hub *liveHub) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		sub := hub.subscribe(parseLiveFilter(r.URL.Query()))
+		defer hub.unsubscribe(sub)
+		flusher.Flush()
+		keepAlive := time.NewTicker(15 * time.Second) // so that proxies don't close an idle stream.
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+			case event, ok := <-sub.events:
+				if !ok { // the subscriber fell behind.
+					return
+				}
+				eventBytes, err := json.Marshal(event)
+				if err != nil {
+					logger.Println(err)
+					continue
+				}
+				if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, eventBytes); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+var liveUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true }, // allow pages served from elsewhere to connect.
+}
+
+// makeServeLiveWS makes a handler which streams the live events over a WebSocket, until the client closes it.
+func makeServeLiveWS(hub *liveHub) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := liveUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logger.Println(err) // the upgrader has already replied.
+			return
+		}
+		defer conn.Close()
+		sub := hub.subscribe(parseLiveFilter(r.URL.Query()))
+		defer hub.unsubscribe(sub)
+		closed := make(chan struct{})
+		go func() { // read until the client closes, so that control messages are handled.
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		for {
+			select {
+			case <-closed:
+				return
+			case event, ok := <-sub.events:
+				deadline := time.Now().Add(10 * time.Second)
+				if !ok {
+					conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"), deadline)
+					return
+				}
+				conn.SetWriteDeadline(deadline)
+				if err := conn.WriteJSON(event); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
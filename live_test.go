@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestLiveFilterMatches(t *testing.T) {
+	cases := []struct {
+		query   string
+		event   liveEvent
+		matches bool
+	}{
+		{"", liveEvent{Type: liveIntent, name: "play0.9"}, true},
+		{"", liveEvent{Type: liveProbs, Vocab: "intent"}, false}, // without types, only intents are sent.
+		{"types=probs,spectrum", liveEvent{Type: liveProbs, Vocab: "intent"}, true},
+		{"types=probs,spectrum", liveEvent{Type: liveSpectrum}, true},
+		{"types=probs,spectrum", liveEvent{Type: liveIntent, name: "play0.9"}, false},
+		{"types=probs&vocabs=word", liveEvent{Type: liveProbs, Vocab: "intent"}, false},
+		{"types=probs&vocabs=word,intent", liveEvent{Type: liveProbs, Vocab: "intent"}, true},
+		{"types=spectrum&vocabs=word", liveEvent{Type: liveSpectrum}, true}, // spectra are of no vocab.
+		{"names=play0.9,pause0.9", liveEvent{Type: liveIntent, name: "pause0.9"}, true},
+		{"names=play0.9,pause0.9", liveEvent{Type: liveIntent, name: "skip0.9"}, false},
+		{"types=intent,probs&names=play0.9", liveEvent{Type: liveProbs, Vocab: "intent"}, true}, // names only filter intents.
+		{"types=,intent, ", liveEvent{Type: liveIntent, name: "play0.9"}, true},
+		{"types=action&names=shutdown0.98", liveEvent{Type: liveAction, Vocab: "intent", name: "shutdown0.98"}, true},
+		{"types=action&names=shutdown0.98", liveEvent{Type: liveAction, Vocab: "intent", name: "upload0.9"}, false},
+		{"types=action&vocabs=word", liveEvent{Type: liveAction, Vocab: "intent", name: "shutdown0.98"}, false},
+		{"types=decoded&vocabs=intent", liveEvent{Type: liveDecoded, Vocab: "intent"}, true},
+		{"types=probs", liveEvent{Type: liveDecoded, Vocab: "intent"}, false},
+	}
+	for _, c := range cases {
+		query, err := url.ParseQuery(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matches := parseLiveFilter(query).matches(c.event); matches != c.matches {
+			t.Fatal(c.query, c.event.Type, c.event.Vocab, c.event.name, "should match:", c.matches, "got", matches)
+		}
+	}
+}
+
+func TestLivePublish(t *testing.T) {
+	cases := []struct {
+		name      string
+		last      liveEvent // published once the buffer is full
+		dropped   int       // events the subscriber should have missed
+		connected bool      // should the subscriber still be subscribed?
+	}{
+		{"probs are dropped", liveEvent{Type: liveProbs, Vocab: "intent"}, 1, true},
+		{"spectra are dropped", liveEvent{Type: liveSpectrum}, 1, true},
+		{"decoded probs are dropped", liveEvent{Type: liveDecoded, Vocab: "intent"}, 1, true},
+		{"intents disconnect", liveEvent{Type: liveIntent, name: "play0.9"}, 0, false},
+		{"actions disconnect", liveEvent{Type: liveAction, Vocab: "intent", name: "shutdown0.98"}, 0, false},
+	}
+	for _, c := range cases {
+		hub := newLiveHub()
+		slow := hub.subscribe(parseLiveFilter(url.Values{"types": {"intent,action,probs,decoded,spectrum"}}))
+		other := hub.subscribe(parseLiveFilter(url.Values{"types": {"intent"}}))
+		for i := 0; i < liveEventBuffer; i++ { // fill the buffer of the slow subscriber.
+			hub.publish(liveEvent{Type: liveProbs, Vocab: "intent"})
+		}
+		hub.publish(c.last)
+		if slow.dropped != c.dropped {
+			t.Fatal(c.name, "expected", c.dropped, "dropped, got", slow.dropped)
+		}
+		if hub.subscribers[slow] != c.connected {
+			t.Fatal(c.name, "expected the slow subscriber to be connected:", c.connected)
+		}
+		received := 0
+		for range slow.events {
+			received++
+			if received == liveEventBuffer && c.connected {
+				break
+			}
+		}
+		if received != liveEventBuffer {
+			t.Fatal(c.name, "expected the", liveEventBuffer, "events which fit in the buffer, got", received)
+		}
+		if !hub.subscribers[other] {
+			t.Fatal(c.name, "a subscriber which keeps up should not be disconnected")
+		}
+	}
+}
+
+func TestLiveUnsubscribe(t *testing.T) {
+	hub := newLiveHub()
+	sub := hub.subscribe(parseLiveFilter(url.Values{"types": {"probs"}}))
+	if !hub.wants(liveProbs) {
+		t.Fatal("the hub should want probs while someone is subscribed to them")
+	}
+	hub.unsubscribe(sub)
+	hub.unsubscribe(sub) // such as by both the handler and the writer of a connection.
+	if _, ok := <-sub.events; ok {
+		t.Fatal("events should be closed")
+	}
+	if hub.wants(liveProbs) {
+		t.Fatal("no one wants probs once the subscriber has gone")
+	}
+	hub.publish(liveEvent{Type: liveProbs, Vocab: "intent"}) // should not send on the closed chan.
+	if len(hub.subscribers) != 0 {
+		t.Fatal("expected no subscribers, got", len(hub.subscribers))
+	}
+}
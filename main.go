@@ -1,46 +1,247 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"time"
 
 	tf "github.com/tensorflow/tensorflow/tensorflow/go"
 	"github.ibm.com/Blue-Horizon/aural2/boltstore"
+	"github.ibm.com/Blue-Horizon/aural2/decode"
+	"github.ibm.com/Blue-Horizon/aural2/features"
 	"github.ibm.com/Blue-Horizon/aural2/libaural2"
 	"github.ibm.com/Blue-Horizon/aural2/tftrain"
 	"github.ibm.com/Blue-Horizon/aural2/tfutils/lstmutils"
+	"github.ibm.com/Blue-Horizon/aural2/vad"
+	"github.ibm.com/Blue-Horizon/aural2/vsh"
 	"github.ibm.com/Blue-Horizon/aural2/vsh/intent"
 )
 
 var logger = log.New(os.Stdout, "arl2: ", log.Lshortfile)
 var version string
 
+// the vocabularies which have models.
+var vocabList = []*libaural2.Vocabulary{
+	//&word.Vocabulary,
+	&intent.Vocabulary,
+}
+
+// parseTransferSources parses a list such as "emotion=intent,speaker=intent" into a map of each vocab to the vocab it should be initialized from.
+func parseTransferSources(list string) (sources map[libaural2.VocabName]libaural2.VocabName) {
+	sources = map[libaural2.VocabName]libaural2.VocabName{}
+	for _, pair := range strings.Split(list, ",") {
+		parts := strings.Split(pair, "=")
+		if len(parts) != 2 {
+			continue
+		}
+		sources[libaural2.VocabName(strings.TrimSpace(parts[0]))] = libaural2.VocabName(strings.TrimSpace(parts[1]))
+	}
+	return
+}
+
+// envInt reads an int from an env var, returning defaultValue if it is not set or can't be parsed.
+func envInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// envFloat reads a float from an env var, returning defaultValue if it is not set or can't be parsed.
+func envFloat(name string, defaultValue float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// makeVAD configures voice activity detection from env vars.
+// VAD is "energy" to detect speech by its energy, or "model:<vocab>" to detect it with the model of the vocab. Empty for no VAD.
+func makeVAD(
+	streamSets map[libaural2.VocabName]*lstmutils.StreamSet,
+	featureConfigs map[libaural2.VocabName]features.Config,
+) (vadConfig vsh.VAD, err error) {
+	var detector vad.Detector
+	kind := os.Getenv("VAD")
+	switch {
+	case kind == "":
+		return
+	case kind == "energy":
+		detector = vad.NewEnergyDetector(envFloat("VAD_MARGIN_DB", vad.DefaultMarginDB))
+	case strings.HasPrefix(kind, "model:"):
+		vocabName := libaural2.VocabName(strings.TrimPrefix(kind, "model:"))
+		streamSet, prs := streamSets[vocabName]
+		if !prs {
+			err = errors.New("no model for VAD vocab " + string(vocabName))
+			return
+		}
+		stream := streamSet.NewStream() // the VAD needs a stream of its own, so as not to disturb the state of the stream used for actions.
+		detector, err = vad.NewModelDetector(featureConfigs[vocabName], func(input []float32) (probs []float32, err error) {
+			inputTensor, err := tf.NewTensor([][][]float32{[][]float32{input}})
+			if err != nil {
+				return
+			}
+			probs, err = stream.Step(inputTensor)
+			return
+		})
+		if err != nil {
+			return
+		}
+	default:
+		err = errors.New("unknown VAD " + kind)
+		return
+	}
+	vadConfig = vsh.VAD{
+		Gate:    vad.NewGate(detector, float32(envFloat("VAD_THRESHOLD", float64(vad.DefaultThreshold))), envInt("VAD_HANGOVER", vad.DefaultHangover)),
+		Policy:  vsh.SilencePolicy(os.Getenv("VAD_POLICY")),
+		Weight:  float32(envFloat("VAD_WEIGHT", 0.5)),
+		PreRoll: envInt("VAD_PRE_ROLL", 5),
+	}
+	switch vadConfig.Policy {
+	case "", vsh.RunInSilence, vsh.DownweightSilence, vsh.SkipSilence:
+	default:
+		err = errors.New("unknown VAD_POLICY " + string(vadConfig.Policy))
+	}
+	return
+}
+
+// loadFeatureConfigs reads the feature config of each vocab from a JSON file such as {"intent": {"num_mfcc": 13, "deltas": 2, "normalization": "running"}}.
+// If the file does not exist, all vocabs use features.DefaultConfig.
+func loadFeatureConfigs(path string) (configs map[libaural2.VocabName]features.Config, err error) {
+	configs = map[libaural2.VocabName]features.Config{}
+	configBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(configBytes, &configs); err != nil {
+		return
+	}
+	for vocabName, config := range configs {
+		if err = config.ValidateStream(); err != nil { // every vocab is run live by vsh, so must be trained on the features it will be fed live.
+			err = fmt.Errorf("feature config of %s: %v", vocabName, err)
+			return
+		}
+	}
+	return
+}
+
+// loadDecoders reads the decode config of each vocab from a JSON file such as {"intent": {"strategy": "hmm", "min_duration": 3, "lag": 10}}, and makes their decoders.
+// If the file does not exist, no vocab is decoded, so the broker acts on the raw probs.
+func loadDecoders(path string, vocabs map[libaural2.VocabName]*libaural2.Vocabulary) (decoders map[libaural2.VocabName]decode.Decoder, err error) {
+	decoders = map[libaural2.VocabName]decode.Decoder{}
+	configBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	configs := map[libaural2.VocabName]decode.Config{}
+	if err = json.Unmarshal(configBytes, &configs); err != nil {
+		return
+	}
+	for vocabName, config := range configs {
+		vocab, prs := vocabs[vocabName]
+		if !prs {
+			err = errors.New("decode config of unknown vocab " + string(vocabName))
+			return
+		}
+		if decoders[vocabName], err = decode.New(config, *vocab); err != nil {
+			err = fmt.Errorf("decode config of %s: %v", vocabName, err)
+			return
+		}
+	}
+	return
+}
+
+// transferLSTM initializes the LSTM layers of oSess from the trained model of the source vocab.
+func transferLSTM(oSess *tftrain.OnlineSess, source libaural2.VocabName, freezeLayers, freezeSteps int) (err error) {
+	graphBytes, err := ioutil.ReadFile("persist/" + string(source) + ".pb")
+	if err != nil {
+		return
+	}
+	graph := tf.NewGraph()
+	if err = graph.Import(graphBytes, ""); err != nil {
+		return
+	}
+	trained, err := tftrain.LoadVars(graph, "init")
+	if err != nil {
+		return
+	}
+	err = lstmutils.TransferLSTM(oSess, trained, freezeLayers, freezeSteps)
+	return
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import" { // import recordings, rather than serving.
+		os.Mkdir("persist/audio", 0777)
+		if err := runImport(os.Args[2:]); err != nil {
+			logger.Fatalln(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "calibrate" { // recommend thresholds from the labeled clips, rather than serving.
+		if err := runCalibrate(os.Args[2:], os.Stdout); err != nil {
+			logger.Fatalln(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" { // replay recordings through vsh, rather than serving.
+		if err := runReplay(os.Args[2:], os.Stdout); err != nil {
+			logger.Fatalln(err)
+		}
+		return
+	}
 	logger.Println("Starting Aural2", version)
 	logger.Println("TF version", tf.Version())
-	vocabList := []*libaural2.Vocabulary{
-		//&word.Vocabulary,
-		&intent.Vocabulary,
-	}
 	vocabs := map[libaural2.VocabName]*libaural2.Vocabulary{}                           // map to get the vocabulary struct
 	namesPrs := map[libaural2.VocabName]bool{}                                          // map to check if the vocab name exists
 	onlineSessions := map[libaural2.VocabName]*tftrain.OnlineSess{}                     // map of online sessions
 	stepInferenceFuncs := map[libaural2.VocabName]func(*tf.Tensor) ([]float32, error){} // map of functions to run statefull inference on individual MFCCs.
-	untrainedGraphBytes, err := ioutil.ReadFile("target/train_graph.pb")                // load the untrained training graph
+	streamSets := map[libaural2.VocabName]*lstmutils.StreamSet{}                        // map of sets of streams of step inference
+	featureConfigPath := os.Getenv("FEATURE_CONFIG")
+	if featureConfigPath == "" {
+		featureConfigPath = "persist/features.json"
+	}
+	featureConfigs, err := loadFeatureConfigs(featureConfigPath) // the features each vocab should use if it has not been trained yet
 	if err != nil {
 		logger.Fatalln(err)
 	}
+	transferSources := parseTransferSources(os.Getenv("TRANSFER_FROM")) // vocabs which should start from the LSTM layers of another vocab
+	transferFreezeLayers := envInt("TRANSFER_FREEZE_LAYERS", 0)
+	transferFreezeSteps := envInt("TRANSFER_FREEZE_STEPS", 0)
+	// number of training steps betwene updates of the weights used for inference
+	snapshotInterval := envInt("SNAPSHOT_INTERVAL", tftrain.DefaultSnapshotInterval)
 	for _, vocab := range vocabList { // for each vocab,
 		vocabs[vocab.Name] = vocab
 		namesPrs[vocab.Name] = true
 		graph := tf.NewGraph()
 		trainedGraphBytes, err := ioutil.ReadFile("persist/" + string(vocab.Name) + ".pb") // try to read the trained graph for that vocab
-		if err != nil {                                                                    // if the graph could not be loaded,
+		untrained := err != nil
+		if untrained { // if the graph could not be loaded,
 			logger.Println("Using untrained graph for", vocab.Name)
+			// vocabs whose features are not of the default size need a graph of their own, generated with gen_train_graph.py --input_size
+			untrainedGraphBytes, err := ioutil.ReadFile("target/train_graph_" + string(vocab.Name) + ".pb")
+			if err != nil {
+				untrainedGraphBytes, err = ioutil.ReadFile("target/train_graph.pb")
+			}
+			if err != nil {
+				logger.Fatalln(err)
+			}
 			err = graph.Import(untrainedGraphBytes, "") // then fall back to the untrained graph
 			if err != nil {
 				logger.Fatalln(err)
@@ -52,42 +253,88 @@ func main() {
 				logger.Fatalln(err)
 			}
 		}
-		requiredOutputs := []string{
-			"step_inference/softmax/output",
-			"step_inference/initial_state_names",
-			"step_inference/final_state_names",
-			"step_inference/loss_monitor/count",
-			"seq_inference/loss_monitor/count",
-			"seq_inference/loss_monitor/sum_mean_loss",
-			"step_inference/loss_monitor/sum_mean_loss",
-			"zeros",
+		featureConfig, prs := featureConfigs[vocab.Name]
+		if !prs {
+			featureConfig = features.DefaultConfig
 		}
-
-		// we need to create an online session so we can train and infer at the same time. It takes vareus operation names.
-		oSess, err := tftrain.NewOnlineSess(graph,
-			"training/inputs",  // placeholder for batch training inputs
-			"training/targets", // placeholder for batch training targets
-			"training/Adam",    // training operation
-			"init",             // OP to initalise the variables
-			"training/loss_monitor/div",    // the loss of the graph when training
-			"seq_inference/softmax/output", // output for live inference
-			"seq_inference/inputs",         // input for live inference
-			requiredOutputs,                // any other ops which need to be preserved when freezing
-		)
+		recordedConfig, recorded, err := lstmutils.ReadFeatureConfig(graph)
 		if err != nil {
 			logger.Fatalln(err)
 		}
+		if recorded { // a model must always be fed the features it was trained on,
+			if err = recordedConfig.ValidateStream(); err != nil {
+				logger.Fatalln(vocab.Name, "was trained with features which can't be computed live, delete persist/"+string(vocab.Name)+".pb to retrain it:", err)
+			}
+			if recordedConfig != featureConfig {
+				logger.Println(vocab.Name, "was trained with features", recordedConfig, "so ignoring configured features", featureConfig)
+			}
+			featureConfig = recordedConfig
+		} else {
+			if !untrained { // models trained before feature configs were recorded with them were trained on the default features.
+				if featureConfig != features.DefaultConfig {
+					logger.Println(vocab.Name, "was trained before its features were recorded, so with the default features", features.DefaultConfig, "ignoring configured features", featureConfig)
+				}
+				featureConfig = features.DefaultConfig
+			}
+			if err = lstmutils.AddFeatureConfig(graph, featureConfig); err != nil { // so record them with the model.
+				logger.Fatalln(err)
+			}
+		}
+		inputSize, err := lstmutils.InputSize(graph)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+		if inputSize != featureConfig.InputSize() {
+			logger.Fatalln("graph of", vocab.Name, "takes inputs of size", inputSize, "but its features are of size", featureConfig.InputSize(), "regenerate the graph with gen_train_graph.py --input_size", featureConfig.InputSize())
+		}
+		featureConfigs[vocab.Name] = featureConfig
+		// we need to create an online session so we can train and infer at the same time.
+		oSess, err := lstmutils.NewOnlineSess(graph)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+		oSess.SetSnapshotInterval(snapshotInterval)
+		if source, prs := transferSources[vocab.Name]; prs && untrained { // if the vocab has not been trained yet, it may start from another vocab.
+			logger.Println("Initializing", vocab.Name, "from the LSTM layers of", source)
+			if err = transferLSTM(&oSess, source, transferFreezeLayers, transferFreezeSteps); err != nil {
+				logger.Println("Can't transfer from", source, ":", err)
+			}
+		}
 		onlineSessions[vocab.Name] = &oSess
-		stepInfFunc, err := lstmutils.MakeStepInference(oSess) // make the func to do statefull step inference
+		streamSet, err := lstmutils.NewStreamSet(oSess) // make a set of streams to do statefull step inference,
 		if err != nil {
 			logger.Fatalln(err)
 		}
-		stepInferenceFuncs[vocab.Name] = stepInfFunc // and put in the map.
+		streamSets[vocab.Name] = streamSet
+		stepInferenceFuncs[vocab.Name] = streamSet.NewStream().Step // and give the local microphone a stream of its own.
+	}
+	vadConfig, err := makeVAD(streamSets, featureConfigs)
+	if err != nil {
+		logger.Fatalln(err)
 	}
 	db, err := boltstore.Init("persist/label_store.db", []libaural2.VocabName{"word", "intent"}) // open the bolt DB
 	if err != nil {
 		logger.Fatalln(err)
 	}
+	featureCaches := map[libaural2.VocabName]*features.Cache{} // features of clips are kept in the DB so that they need only be computed once.
+	for vocabName, featureConfig := range featureConfigs {
+		featureCaches[vocabName], err = features.NewCache(featureConfig, db)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+	}
+	pruned, err := db.PruneFeatures(func(key []byte) bool { // features of configs no longer used will never be used again.
+		for _, cache := range featureCaches {
+			if cache.IsCurrent(key) {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	logger.Println("pruned", pruned, "stale cached features")
 	os.Mkdir("persist/audio", 0777)
 	// func to save a 10 second audio clip
 	saveFunc := func(clip *libaural2.AudioClip) {
@@ -105,7 +352,11 @@ func main() {
 	}
 	sleepms := new(int32)
 	*sleepms = int32(300)
-	tdmMap, err := startTrainingLoops(db, onlineSessions, sleepms)
+	tdmMap, err := startTrainingLoops(db, onlineSessions, featureCaches, sleepms)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	scorer, err := startScoringLoop(db, onlineSessions, featureCaches) // score the clips so that the most useful ones can be labeled first.
 	if err != nil {
 		logger.Fatalln(err)
 	}
@@ -132,10 +383,11 @@ func main() {
 	}
 	logger.Println("starting vsh")
 	// start vsh, passing it the step
-	dumpClip := startVsh(saveFunc, stepInferenceFuncs, shutdownFunc)
+	hub := newLiveHub() // the live events, sent to the intent stream and the /live endpoints
+	dumpClip := startVsh(saveFunc, vocabs, stepInferenceFuncs, featureConfigs, vadConfig, shutdownFunc, hub)
 	// start the http server and REST API.
 	logger.Println("starting web server")
-	go serve(db, onlineSessions, namesPrs, dumpClip, tdmMap, sleepms)
+	go serve(db, onlineSessions, featureCaches, namesPrs, dumpClip, tdmMap, sleepms, scorer, hub)
 	logger.Println("starting model saving loop")
 	for { // endless loop of saving the models every 10 minutes.
 		time.Sleep(10 * time.Minute)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -8,13 +9,45 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 	"sync"
+
+	"github.ibm.com/Blue-Horizon/aural2/audioconv"
 )
 
-// try to connect to an audio device.
-func tryToConnect(hardwareNum string) (reader io.Reader, err error) {
-	devName := "plughw:" + hardwareNum
-	cmd := exec.Command("arecord", "-D", devName, "-r", "16000", "-t", "raw", "-f", "S16_LE", "-c", "1", "-")
+// formats to try to capture in, best first. Audio of any but the first is converted to it, so that clients always get 16 kHz mono S16_LE.
+var formats = []audioconv.Format{
+	audioconv.Native,
+	{SampleRate: 48000, Channels: 1, Encoding: audioconv.S16LE},
+	{SampleRate: 48000, Channels: 2, Encoding: audioconv.S16LE},
+	{SampleRate: 44100, Channels: 2, Encoding: audioconv.S16LE},
+	{SampleRate: 48000, Channels: 2, Encoding: audioconv.S32LE},
+	{SampleRate: 44100, Channels: 2, Encoding: audioconv.S32LE},
+}
+
+// try to connect to an audio device in each format until one works.
+func tryFormats(device string) (reader io.Reader, err error) {
+	for _, format := range formats {
+		reader, err = tryToConnect(device, format)
+		if err != nil {
+			fmt.Println("can't capture", format, "from", device, "trying next format")
+			reader = nil
+			continue
+		}
+		fmt.Println("capturing", format, "from", device)
+		reader, err = audioconv.NewReader(reader, format)
+		return
+	}
+	return
+}
+
+// try to connect to an audio device. The device is either the number of a card, which is opened through the plug plugin so ALSA can convert its format, or the full name of an ALSA device, such as hw:1,0.
+func tryToConnect(device string, format audioconv.Format) (reader io.Reader, err error) {
+	devName := device
+	if !strings.Contains(device, ":") {
+		devName = "plughw:" + device
+	}
+	cmd := exec.Command("arecord", "-D", devName, "-r", strconv.Itoa(format.SampleRate), "-t", "raw", "-f", string(format.Encoding), "-c", strconv.Itoa(format.Channels), "-")
 	cmd.Stderr = os.Stdout
 	reader, err = cmd.StdoutPipe()
 	if err != nil {
@@ -38,6 +71,7 @@ func tryToConnect(hardwareNum string) (reader io.Reader, err error) {
 		cmd.Process.Kill()
 		return
 	}
+	reader = io.MultiReader(bytes.NewReader(buff), reader) // put back the bytes we read, so that frames stay aligned.
 	return
 }
 
@@ -48,12 +82,20 @@ func main() {
 	args := os.Args
 	var reader io.Reader
 	var err error
+	if formatString := os.Getenv("MIC_FORMAT"); formatString != "" { // the format may be forced, for devices which claim formats they can't really do.
+		format, err := audioconv.ParseFormat(formatString)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		formats = []audioconv.Format{format}
+	}
 	if len(args) == 2 {
-		reader, err = tryToConnect(args[1])
+		reader, err = tryFormats(args[1])
 	} else {
 		for _, i := range []int{5, 4, 3, 2, 1, 0} {
 			fmt.Println("reading data from device", i)
-			reader, err = tryToConnect(strconv.Itoa(i))
+			reader, err = tryFormats(strconv.Itoa(i))
 			if err != nil {
 				fmt.Println("can't read from device", i, "trying next device")
 				continue
@@ -69,13 +111,13 @@ func main() {
 	var buffsIndex int
 	buffsMutex := sync.Mutex{}
 	go func() {
-		buff := make([]byte, 4000)
+		readBuff := make([]byte, 4000)
 		for {
-			i, err := reader.Read(buff)
+			n, err := reader.Read(readBuff)
 			if err != nil {
 				panic(err)
 			}
-			_ = i
+			buff := append([]byte{}, readBuff[:n]...) // each conn gets the same bytes, so they must not be overwritten by the next read.
 			buffsMutex.Lock()
 			for i, connChan := range buffsMap {
 				if len(connChan) < 99 {
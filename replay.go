@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	tf "github.com/tensorflow/tensorflow/tensorflow/go"
+	"github.ibm.com/Blue-Horizon/aural2/boltstore"
+	"github.ibm.com/Blue-Horizon/aural2/features"
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+	"github.ibm.com/Blue-Horizon/aural2/tfutils/lstmutils"
+	"github.ibm.com/Blue-Horizon/aural2/vsh"
+)
+
+// replayEpoch is the simulated time at which each recording starts, so that a recording gives the same timeline whenever it is replayed.
+var replayEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// strideDuration is the time one stride of audio lasts.
+const strideDuration = time.Duration(libaural2.StrideWidth) * time.Second / time.Duration(libaural2.SampleRate)
+
+// replayPadding is the silence played after each recording, so that decoders with a lag decide on its end, and utterances at its end end.
+const replayPadding = time.Second
+
+// replayEvent is one thing which happened while replaying a recording.
+type replayEvent struct {
+	Source   string            `json:"source"`             // the file or clip replayed
+	Offset   float64           `json:"offset"`             // seconds from the start of the source
+	Kind     string            `json:"kind"`               // action, confirm, command, utterance or label
+	Name     string            `json:"name"`               // name of the action, the action being confirmed, the command or the state
+	Prob     float32           `json:"prob,omitempty"`     // prob which activated the action, of the least sure word of the command, or mean prob of the utterance
+	Duration float64           `json:"duration,omitempty"` // seconds the utterance or label lasted
+	Slots    map[string]string `json:"slots,omitempty"`    // slots of the command
+	Status   vsh.ConfirmStatus `json:"status,omitempty"`   // how far the confirmation has got
+}
+
+// recording is raw 16 kHz mono S16_LE audio to replay, and the labels of it, if it is a labeled clip.
+type recording struct {
+	source   string
+	rawBytes []byte
+	labels   []libaural2.Label
+	vocab    *libaural2.Vocabulary
+}
+
+// replayer runs recordings through the same pipeline as the microphone: features, inference, decoding, rules and grammar.
+type replayer struct {
+	vocabs         map[libaural2.VocabName]*libaural2.Vocabulary
+	streamSets     map[libaural2.VocabName]*lstmutils.StreamSet
+	featureConfigs map[libaural2.VocabName]features.Config
+	rules          []vsh.Rule
+	makers         map[string]vsh.HandlerMaker
+	grammar        []byte // nil if there is no grammar
+	decodingPath   string
+}
+
+// replayVocabs maps the name of each vocab to it.
+func replayVocabs() (vocabs map[libaural2.VocabName]*libaural2.Vocabulary) {
+	vocabs = map[libaural2.VocabName]*libaural2.Vocabulary{}
+	for _, vocab := range vocabList {
+		vocabs[vocab.Name] = vocab
+	}
+	return
+}
+
+// newReplayer loads the models, feature configs and rules which recordings are replayed with.
+// Without a rules file, the built in rules are used. It has no grammar until one is given.
+func newReplayer(rulesPath string, decodingPath string) (rp *replayer, err error) {
+	rp = &replayer{
+		vocabs:       replayVocabs(),
+		makers:       replayMakers(makeHandlerMakers(nil, nil, nil, nil)),
+		decodingPath: decodingPath,
+	}
+	rp.featureConfigs, err = loadFeatureConfigs(envPath("FEATURE_CONFIG", "persist/features.json"))
+	if err != nil {
+		return
+	}
+	if rp.streamSets, err = loadReplayModels(rp.featureConfigs); err != nil {
+		return
+	}
+	rp.rules = defaultRules()
+	if rulesBytes, err := ioutil.ReadFile(rulesPath); err == nil {
+		if rp.rules, err = vsh.ParseRules(rulesBytes, rp.vocabs, rp.makers); err != nil {
+			return nil, fmt.Errorf("%s: %v", rulesPath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return
+}
+
+// replayMakers wraps makers, so that rules are checked as they would be, but no handler does anything.
+func replayMakers(makers map[string]vsh.HandlerMaker) (wrapped map[string]vsh.HandlerMaker) {
+	wrapped = map[string]vsh.HandlerMaker{}
+	for handlerType, maker := range makers {
+		maker := maker
+		wrapped[handlerType] = func(name string, rule vsh.Rule) (handler func(float32), err error) {
+			if _, err = maker(name, rule); err != nil {
+				return
+			}
+			handler = func(float32) {}
+			return
+		}
+	}
+	return
+}
+
+// loadReplayModels loads the trained model of each vocab, so that recordings can be replayed through them.
+// The feature config each model was trained with is written to featureConfigs.
+func loadReplayModels(featureConfigs map[libaural2.VocabName]features.Config) (streamSets map[libaural2.VocabName]*lstmutils.StreamSet, err error) {
+	streamSets = map[libaural2.VocabName]*lstmutils.StreamSet{}
+	for _, vocab := range vocabList {
+		graphBytes, err := ioutil.ReadFile("persist/" + string(vocab.Name) + ".pb")
+		if err != nil {
+			return nil, fmt.Errorf("no trained model of %s: %v", vocab.Name, err)
+		}
+		graph := tf.NewGraph()
+		if err = graph.Import(graphBytes, ""); err != nil {
+			return nil, err
+		}
+		featureConfig, recorded, err := lstmutils.ReadFeatureConfig(graph)
+		if err != nil {
+			return nil, err
+		}
+		if !recorded { // models trained before feature configs were recorded with them were trained on the default features.
+			if configured, prs := featureConfigs[vocab.Name]; prs && configured != features.DefaultConfig {
+				logger.Println(vocab.Name, "was trained before its features were recorded, so with the default features, ignoring configured features", configured)
+			}
+			featureConfig = features.DefaultConfig
+		}
+		featureConfigs[vocab.Name] = featureConfig
+		oSess, err := lstmutils.NewOnlineSess(graph)
+		if err != nil {
+			return nil, err
+		}
+		if streamSets[vocab.Name], err = lstmutils.NewStreamSet(oSess); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// run runs one recording through the features, models, VAD and decoders in simulated time, giving each decoded result to each, with the time it was heard and the events of the utterances it began, updated or ended.
+// Each recording starts from fresh model, VAD and decoder state.
+func (rp *replayer) run(rec recording, each func(now time.Time, decoded vsh.Result, utterances []vsh.Utterance)) (err error) {
+	stepInferenceFuncs := map[libaural2.VocabName]func(*tf.Tensor) ([]float32, error){}
+	for vocabName, streamSet := range rp.streamSets {
+		stepInferenceFuncs[vocabName] = streamSet.NewStream().Step
+	}
+	vadConfig, err := makeVAD(rp.streamSets, rp.featureConfigs)
+	if err != nil {
+		return
+	}
+	decoders, err := loadDecoders(rp.decodingPath, rp.vocabs)
+	if err != nil {
+		return
+	}
+	rd, err := vsh.NewResultDecoder(rp.vocabs, decoders)
+	if err != nil {
+		return
+	}
+	padding := make([]byte, int(replayPadding/strideDuration)*libaural2.StrideWidth*2)
+	results, err := vsh.Replay(io.MultiReader(bytes.NewReader(rec.rawBytes), bytes.NewReader(padding)), stepInferenceFuncs, rp.featureConfigs, vadConfig)
+	if err != nil {
+		return
+	}
+	stride := 0
+	for result := range results {
+		now := replayEpoch.Add(time.Duration(stride) * strideDuration)
+		stride++
+		decoded, utterances := rd.Step(result, now)
+		each(now, decoded, utterances)
+	}
+	return
+}
+
+// replay runs one recording through the pipeline, rules and grammar, returning what happened, in order.
+func (rp *replayer) replay(rec recording) (events []replayEvent, err error) {
+	results := make(chan vsh.Result)
+	close(results) // results are given to the broker by HandleAt, in simulated time, so the goroutine reading the chan ends at once.
+	eb := vsh.NewEventBroker(results)
+	if err = eb.LoadRules(rp.rules, rp.vocabs, rp.makers); err != nil {
+		return
+	}
+	var matcher *vsh.Matcher
+	if rp.grammar != nil {
+		if matcher, err = vsh.ParseGrammar(rp.grammar, rp.vocabs); err != nil {
+			return
+		}
+	}
+	offset := func(ts time.Time) float64 {
+		return ts.Sub(replayEpoch).Seconds()
+	}
+	eb.OnAction(func(event vsh.ActionEvent) {
+		events = append(events, replayEvent{Source: rec.source, Offset: offset(event.TS), Kind: "action", Name: event.Action, Prob: event.Prob})
+	})
+	eb.OnConfirm(func(event vsh.ConfirmEvent) { // so that prompts, cancellations and timeouts can be seen, not only confirmed actions.
+		events = append(events, replayEvent{Source: rec.source, Offset: offset(event.TS), Kind: "confirm", Name: event.Action, Prob: event.Prob, Status: event.Status})
+	})
+	err = rp.run(rec, func(now time.Time, decoded vsh.Result, utterances []vsh.Utterance) {
+		eb.HandleAt(decoded, now)
+		if matcher != nil {
+			for _, command := range matcher.Handle(decoded, now) {
+				events = append(events, replayEvent{Source: rec.source, Offset: offset(command.Start), Kind: "command", Name: command.Command, Prob: command.Prob, Slots: command.Slots})
+			}
+		}
+		for _, utterance := range utterances {
+			if utterance.Phase != vsh.UtteranceEnd {
+				continue
+			}
+			events = append(events, replayEvent{
+				Source:   rec.source,
+				Offset:   offset(utterance.Start),
+				Kind:     "utterance",
+				Name:     utterance.Name,
+				Prob:     utterance.Mean,
+				Duration: utterance.End.Sub(utterance.Start).Seconds() + strideDuration.Seconds(),
+			})
+		}
+	})
+	if err != nil {
+		return
+	}
+	for _, label := range rec.labels {
+		if label.State == libaural2.Nil {
+			continue
+		}
+		events = append(events, replayEvent{Source: rec.source, Offset: label.Start, Kind: "label", Name: rec.vocab.Names[label.State], Duration: label.End - label.Start})
+	}
+	sort.SliceStable(events, func(i, j int) bool { // actions which fire on the same stride are run in no particular order.
+		if events[i].Offset != events[j].Offset {
+			return events[i].Offset < events[j].Offset
+		}
+		if events[i].Kind != events[j].Kind {
+			return events[i].Kind < events[j].Kind
+		}
+		return events[i].Name < events[j].Name
+	})
+	return
+}
+
+// readLabeledClips reads the clips which have been labeled for the vocab, in order of ID.
+func readLabeledClips(vocab *libaural2.Vocabulary) (recs []recording, err error) {
+	db, err := boltstore.Init("persist/label_store.db", []libaural2.VocabName{"word", "intent"})
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	labelSets, err := db.GetAllLabelSets(vocab.Name)
+	if err != nil {
+		return
+	}
+	for id, labelSet := range labelSets {
+		rawBytes, err := ioutil.ReadFile("persist/audio/" + id.FSsafeString() + ".raw")
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, recording{source: id.FSsafeString(), rawBytes: rawBytes, labels: labelSet.Labels, vocab: vocab})
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].source < recs[j].source })
+	return
+}
+
+// runReplay replays recordings given on the command line, such as `aural2 replay -json meeting.wav`, writing the timeline of what vsh did to w.
+// Like import, it opens the DB and models of persist/, so aural2 must not be running.
+func runReplay(args []string, w io.Writer) (err error) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	clipsVocab := flags.String("clips", "", "replay the labeled clips of this vocab, rather than files")
+	jsonOutput := flags.Bool("json", false, "write the timeline as JSON lines")
+	rulesPath := flags.String("rules", envPath("RULES", "persist/rules.json"), "rules file")
+	grammarPath := flags.String("grammar", envPath("GRAMMAR", "persist/grammar.json"), "grammar file")
+	decodingPath := flags.String("decoding", envPath("DECODING", "persist/decoding.json"), "decoding file")
+	flags.Parse(args)
+	var recs []recording
+	if *clipsVocab != "" {
+		vocab, prs := replayVocabs()[libaural2.VocabName(*clipsVocab)]
+		if !prs {
+			return errors.New("unknown vocab " + *clipsVocab)
+		}
+		if recs, err = readLabeledClips(vocab); err != nil {
+			return
+		}
+	} else if flags.NArg() == 0 {
+		return errors.New("usage: aural2 replay [-json] [-rules file] [-grammar file] [-decoding file] file.wav... | -clips vocab")
+	}
+	for _, path := range flags.Args() {
+		upload, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rawBytes, err := toNative(upload)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		recs = append(recs, recording{source: path, rawBytes: rawBytes})
+	}
+	rp, err := newReplayer(*rulesPath, *decodingPath)
+	if err != nil {
+		return
+	}
+	if rp.grammar, err = ioutil.ReadFile(*grammarPath); os.IsNotExist(err) {
+		rp.grammar, err = nil, nil
+	} else if err != nil {
+		return
+	}
+	encoder := json.NewEncoder(w)
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, rec := range recs {
+		events, err := rp.replay(rec)
+		if err != nil {
+			return fmt.Errorf("%s: %v", rec.source, err)
+		}
+		for _, event := range events {
+			if *jsonOutput {
+				if err = encoder.Encode(event); err != nil {
+					return err
+				}
+				continue
+			}
+			detail := formatSlots(event.Slots)
+			if event.Status != "" {
+				detail = string(event.Status)
+			}
+			fmt.Fprintf(table, "%s\t%.3f\t%s\t%s\t%.3f\t%.3f\t%v\n", event.Source, event.Offset, event.Kind, event.Name, event.Prob, event.Duration, detail)
+		}
+	}
+	err = table.Flush()
+	return
+}
+
+// formatSlots formats the slots of a command as slot=word, in order of slot.
+func formatSlots(slots map[string]string) (formatted string) {
+	var names []string
+	for name := range slots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		formatted += name + "=" + slots[name] + " "
+	}
+	return
+}
+
+// envPath reads a path from an env var, returning defaultPath if it is not set.
+func envPath(name string, defaultPath string) string {
+	if path := os.Getenv(name); path != "" {
+		return path
+	}
+	return defaultPath
+}
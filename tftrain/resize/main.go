@@ -0,0 +1,79 @@
+// Command resize changes the size of the output projection of a trained aural2 model without losing what it has learned.
+//
+// First generate an untrained graph of the new size:
+//
+//	python gen_train_graph.py --output_size 60 --out target/train_graph_60.pb
+//
+// Then copy the trained weights into it:
+//
+//	resize -trained persist/intent.pb -untrained target/train_graph_60.pb -out persist/intent.pb
+//
+// The weights of the existing states are preserved, while those of any new states keep their initial values.
+// Only the output projection may change size: resizing fails if the untrained graph has any other hyperparameter, such as the input size, changed.
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+
+	tf "github.com/tensorflow/tensorflow/tensorflow/go"
+	"github.ibm.com/Blue-Horizon/aural2/tftrain"
+	"github.ibm.com/Blue-Horizon/aural2/tfutils/lstmutils"
+)
+
+var logger = log.New(os.Stdout, "resize: ", log.Lshortfile)
+
+func loadGraph(path string) (graph *tf.Graph, err error) {
+	graphBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	graph = tf.NewGraph()
+	err = graph.Import(graphBytes, "")
+	return
+}
+
+func main() {
+	trainedPath := flag.String("trained", "", "path of the trained model to be resized")
+	untrainedPath := flag.String("untrained", "target/train_graph.pb", "path of an untrained graph of the new size")
+	outPath := flag.String("out", "", "path to write the resized model to")
+	flag.Parse()
+	if *trainedPath == "" || *outPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	trainedGraph, err := loadGraph(*trainedPath)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	trained, err := tftrain.LoadVars(trainedGraph, "init") // read the values of the trained vars
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	untrainedGraph, err := loadGraph(*untrainedPath)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	oSess, err := lstmutils.NewOnlineSess(untrainedGraph) // initialize the graph of the new size,
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	if err = oSess.LoadResizedVars(trained, lstmutils.IsOutputVar); err != nil { // copy in as much of the trained output projection as will fit,
+		logger.Fatalln(err)
+	}
+	resized, err := oSess.Save() // and save it just as aural2 would.
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	f, err := os.Create(*outPath)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	defer f.Close()
+	if _, err = resized.WriteTo(f); err != nil {
+		logger.Fatalln(err)
+	}
+	logger.Println("wrote resized model to", *outPath)
+}
@@ -4,11 +4,14 @@ package tftrain
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/golang/protobuf/proto"
 
@@ -134,6 +137,88 @@ func getInitNames(nodesMap map[string]*pbtf.NodeDef, initOPname string) (varName
 	return
 }
 
+// varSetter is a placeholder and an assign OP which together can overwrite the value of one variable.
+type varSetter struct {
+	value  tf.Output
+	assign *tf.Operation
+}
+
+// addVarSetters adds a varSetter for each variable in the graph.
+// They must be added before any session is created, as the graph should not be modified while in use.
+func addVarSetters(graph *tf.Graph) (setters map[string]varSetter, err error) {
+	pbGraph, err := tfGraphToPbGraph(graph)
+	if err != nil {
+		return
+	}
+	setters = map[string]varSetter{}
+	for _, node := range pbGraph.Node {
+		if node.Op != "VariableV2" {
+			continue
+		}
+		variable := graph.Operation(node.Name)
+		if variable == nil {
+			err = errors.New("can't find variable " + node.Name)
+			return
+		}
+		var valuePH *tf.Operation
+		valuePH, err = graph.AddOperation(tf.OpSpec{
+			Name: "set_var/" + node.Name + "/value",
+			Type: "Placeholder",
+			Attrs: map[string]interface{}{
+				"dtype": tf.DataType(node.Attr["dtype"].GetType()),
+			},
+		})
+		if err != nil {
+			return
+		}
+		var assignOP *tf.Operation
+		assignOP, err = graph.AddOperation(tf.OpSpec{
+			Name: "set_var/" + node.Name + "/assign",
+			Type: "Assign",
+			Input: []tf.Input{
+				variable.Output(0),
+				valuePH.Output(0),
+			},
+		})
+		if err != nil {
+			return
+		}
+		setters[node.Name] = varSetter{value: valuePH.Output(0), assign: assignOP}
+	}
+	return
+}
+
+// LoadVars returns the values of all the variables of a graph written by OnlineSess.Save().
+// The init OP is run first so as to load the saved values into the variables.
+func LoadVars(graph *tf.Graph, initOpName string) (values map[string]*tf.Tensor, err error) {
+	pbGraph, err := tfGraphToPbGraph(graph)
+	if err != nil {
+		return
+	}
+	initOP, err := getOP(graph, initOpName)
+	if err != nil {
+		return
+	}
+	sess, err := tf.NewSession(graph, nil)
+	if err != nil {
+		return
+	}
+	defer sess.Close()
+	if _, err = sess.Run(map[tf.Output]*tf.Tensor{}, []tf.Output{}, []*tf.Operation{initOP}); err != nil {
+		return
+	}
+	varNames := listVarNames(pbGraph.Node)
+	tensors, err := evalVars(varNames, graph, sess)
+	if err != nil {
+		return
+	}
+	values = map[string]*tf.Tensor{}
+	for i, name := range varNames {
+		values[name] = tensors[i]
+	}
+	return
+}
+
 // pull out the actual values of each var as tensors.
 func evalVars(varNames []string, graph *tf.Graph, sess *tf.Session) (tensors []*tf.Tensor, err error) {
 	varOutputs := make([]tf.Output, len(varNames))
@@ -369,6 +454,10 @@ func NewOnlineSess(
 	if err != nil {
 		return
 	}
+	setters, err := addVarSetters(graph) // must be done before the session is created.
+	if err != nil {
+		return
+	}
 	sess, err := tf.NewSession(graph, nil)
 	if err != nil {
 		return
@@ -377,6 +466,18 @@ func NewOnlineSess(
 	if err != nil {
 		return
 	}
+	buffers := &inferenceBuffers{interval: DefaultSnapshotInterval}
+	for i := range buffers.snapshots { // make two more sessions on the same graph to hold the inference weights.
+		buffers.snapshots[i] = &snapshot{}
+		buffers.snapshots[i].sess, err = tf.NewSession(graph, nil)
+		if err != nil {
+			return
+		}
+		// the initializers may be random, so the vars must be copied from the training session rather then initialized again.
+		if err = copyVars(graph, setters, sess, buffers.snapshots[i].sess); err != nil {
+			return
+		}
+	}
 	trainOP, err := getOP(graph, trainOpName)
 	if err != nil {
 		return
@@ -412,11 +513,17 @@ func NewOnlineSess(
 		output:        outputOP.Output(0),
 		initOPName:    initOP.Name(),
 		outputOPnames: outputOpNames,
+		setters:       setters,
+		frozen:        &frozenVars{},
+		buffers:       buffers,
 	}
 	return
 }
 
 // OnlineSess stores a model in the process of training.
+// It is safe to train it in one goroutine while inferring from it in others.
+// Inference uses a snapshot of the weights, which is replaced atomically every few training steps,
+// so that no single inference ever sees weights which are half way through being updated.
 type OnlineSess struct {
 	Graph         *tf.Graph
 	Sess          *tf.Session
@@ -428,10 +535,115 @@ type OnlineSess struct {
 	output        tf.Output
 	initOPName    string
 	outputOPnames []string
+	setters       map[string]varSetter
+	frozen        *frozenVars
+	buffers       *inferenceBuffers
+}
+
+// DefaultSnapshotInterval is the number of training steps betwene updates of the weights used for inference.
+const DefaultSnapshotInterval = 10
+
+// snapshot is a session holding a copy of the weights for inference.
+type snapshot struct {
+	sync.RWMutex // read locked while inferring, write locked while the weights are being updated.
+	sess         *tf.Session
+}
+
+// inferenceBuffers double buffers the inference weights.
+// Inference reads from the current snapshot while the other is updated, and then the two are swapped.
+type inferenceBuffers struct {
+	sync.Mutex // held while using the training session.
+	snapshots  [2]*snapshot
+	current    int32 // index of the snapshot in use for inference. Must be accessed atomically.
+	interval   int   // number of training steps betwene swaps
+	steps      int   // training steps since the last swap
+}
+
+// snapshot returns the snapshot currently in use for inference.
+func (buffers *inferenceBuffers) snapshot() *snapshot {
+	return buffers.snapshots[atomic.LoadInt32(&buffers.current)]
+}
+
+// copyVars copies the values of all the variables from one session to another session of the same graph.
+func copyVars(graph *tf.Graph, setters map[string]varSetter, src, dst *tf.Session) (err error) {
+	names := []string{}
+	for name := range setters {
+		names = append(names, name)
+	}
+	tensors, err := evalVars(names, graph, src)
+	if err != nil {
+		return
+	}
+	values := map[string]*tf.Tensor{}
+	for i, name := range names {
+		values[name] = tensors[i]
+	}
+	err = setVars(setters, dst, values)
+	return
+}
+
+// setVars overwrites the values of variables in sess.
+func setVars(setters map[string]varSetter, sess *tf.Session, values map[string]*tf.Tensor) (err error) {
+	feeds := map[tf.Output]*tf.Tensor{}
+	targets := []*tf.Operation{}
+	for name, tensor := range values {
+		setter, prs := setters[name]
+		if !prs {
+			err = errors.New("can't find variable " + name)
+			return
+		}
+		feeds[setter.value] = tensor
+		targets = append(targets, setter.assign)
+	}
+	_, err = sess.Run(feeds, []tf.Output{}, targets)
+	return
+}
+
+// publish copies the weights of the training session into the idle snapshot, and then swaps it in for inference.
+// The caller must hold the lock on the buffers.
+func (oSess OnlineSess) publish() (err error) {
+	current := atomic.LoadInt32(&oSess.buffers.current)
+	idle := oSess.buffers.snapshots[1-current]
+	idle.Lock() // wait for any inference still using the old weights to finish.
+	err = copyVars(oSess.Graph, oSess.setters, oSess.Sess, idle.sess)
+	idle.Unlock()
+	if err != nil {
+		return
+	}
+	atomic.StoreInt32(&oSess.buffers.current, 1-current)
+	oSess.buffers.steps = 0
+	return
+}
+
+// SetSnapshotInterval sets the number of training steps betwene updates of the weights used for inference.
+func (oSess OnlineSess) SetSnapshotInterval(steps int) {
+	oSess.buffers.Lock()
+	defer oSess.buffers.Unlock()
+	if steps < 1 {
+		steps = 1
+	}
+	oSess.buffers.interval = steps
+}
+
+// Publish immediately updates the weights used for inference, rather then waiting for the next swap.
+func (oSess OnlineSess) Publish() (err error) {
+	oSess.buffers.Lock()
+	defer oSess.buffers.Unlock()
+	err = oSess.publish()
+	return
+}
+
+// frozenVars are variables to be held at fixed values for some number of training steps.
+type frozenVars struct {
+	sync.Mutex
+	values map[string]*tf.Tensor
+	steps  int
 }
 
 // Train trains one mini batch
 func (oSess OnlineSess) Train(inputTensor *tf.Tensor, targetTensor *tf.Tensor) (loss float32, err error) {
+	oSess.buffers.Lock()
+	defer oSess.buffers.Unlock()
 	results, err := oSess.Sess.Run(
 		map[tf.Output]*tf.Tensor{oSess.trainInputPH: inputTensor, oSess.targetPH: targetTensor},
 		[]tf.Output{oSess.loss},
@@ -441,6 +653,137 @@ func (oSess OnlineSess) Train(inputTensor *tf.Tensor, targetTensor *tf.Tensor) (
 		return
 	}
 	loss = results[0].Value().(float32)
+	oSess.frozen.Lock()
+	if oSess.frozen.steps > 0 { // undo whatever the training step did to the frozen vars.
+		oSess.frozen.steps--
+		err = setVars(oSess.setters, oSess.Sess, oSess.frozen.values)
+	}
+	oSess.frozen.Unlock()
+	if err != nil {
+		return
+	}
+	oSess.buffers.steps++
+	if oSess.buffers.steps >= oSess.buffers.interval { // every so often, let inference see the new weights.
+		err = oSess.publish()
+	}
+	return
+}
+
+// VarNames lists the names of the variables of the model.
+func (oSess OnlineSess) VarNames() (names []string) {
+	for name := range oSess.setters {
+		names = append(names, name)
+	}
+	return
+}
+
+// GetVars returns the current values of the named variables.
+func (oSess OnlineSess) GetVars(names []string) (values map[string]*tf.Tensor, err error) {
+	oSess.buffers.Lock()
+	tensors, err := evalVars(names, oSess.Graph, oSess.Sess)
+	oSess.buffers.Unlock()
+	if err != nil {
+		return
+	}
+	values = map[string]*tf.Tensor{}
+	for i, name := range names {
+		values[name] = tensors[i]
+	}
+	return
+}
+
+// SetVars overwrites the values of the variables. Each tensor must be of the same shape as the variable it replaces.
+// The new values are used for inference immediately.
+func (oSess OnlineSess) SetVars(values map[string]*tf.Tensor) (err error) {
+	oSess.buffers.Lock()
+	defer oSess.buffers.Unlock()
+	if err = setVars(oSess.setters, oSess.Sess, values); err != nil {
+		return
+	}
+	err = oSess.publish()
+	return
+}
+
+// LoadResizedVars copies the values of the variables of a trained model into oSess.
+// Where a variable for which resizable returns true has changed shape, the overlapping region is copied, and the rest keeps the value it was initialized to.
+// If any other variable has changed shape, its weights would end up in the wrong places, so nothing is copied and an error is returned.
+// Variables which are only present in one of the two models are ignored.
+func (oSess OnlineSess) LoadResizedVars(trained map[string]*tf.Tensor, resizable func(name string) bool) (err error) {
+	names := []string{}
+	for _, name := range oSess.VarNames() {
+		if _, prs := trained[name]; prs {
+			names = append(names, name)
+		}
+	}
+	current, err := oSess.GetVars(names)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if !sameShape(current[name].Shape(), trained[name].Shape()) && !resizable(name) {
+			err = fmt.Errorf("%s has changed shape from %v to %v, but only the output projection may be resized", name, trained[name].Shape(), current[name].Shape())
+			return
+		}
+	}
+	values := map[string]*tf.Tensor{}
+	for _, name := range names {
+		values[name], err = overlayTensor(current[name], trained[name])
+		if err != nil {
+			err = errors.New(name + ": " + err.Error())
+			return
+		}
+	}
+	err = oSess.SetVars(values)
+	return
+}
+
+func sameShape(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// overlayTensor returns a tensor of the shape of dst, with the region which overlaps src copied from src.
+func overlayTensor(dst, src *tf.Tensor) (result *tf.Tensor, err error) {
+	if dst.DataType() != src.DataType() {
+		err = errors.New("data types do not match")
+		return
+	}
+	switch dstValue := dst.Value().(type) {
+	case float32:
+		return src, nil
+	case []float32:
+		copy(dstValue, src.Value().([]float32))
+		return tf.NewTensor(dstValue)
+	case [][]float32:
+		srcValue := src.Value().([][]float32)
+		for i := range dstValue {
+			if i < len(srcValue) {
+				copy(dstValue[i], srcValue[i])
+			}
+		}
+		return tf.NewTensor(dstValue)
+	}
+	err = errors.New("can only resize float32 tensors of rank 0 to 2")
+	return
+}
+
+// FreezeVars holds the named variables at their current values for the next `steps` training steps.
+func (oSess OnlineSess) FreezeVars(names []string, steps int) (err error) {
+	values, err := oSess.GetVars(names)
+	if err != nil {
+		return
+	}
+	oSess.frozen.Lock()
+	defer oSess.frozen.Unlock()
+	oSess.frozen.values = values
+	oSess.frozen.steps = steps
 	return
 }
 
@@ -453,16 +796,17 @@ func (oSess OnlineSess) Save() (graph *tf.Graph, err error) {
 		oSess.inferInputPH.Op.Name(),
 		oSess.output.Op.Name(),
 	)
+	oSess.buffers.Lock()
+	defer oSess.buffers.Unlock()
 	graph, err = TrainableFreeze(oSess.Graph, oSess.Sess, headNames)
 	return
 }
 
-// Infer runs the graph
+// Infer runs the graph with the current inference weights.
 func (oSess OnlineSess) Infer(inputTensor *tf.Tensor) (outputTensor *tf.Tensor, err error) {
-	results, err := oSess.Sess.Run(
+	results, err := oSess.Run(
 		map[tf.Output]*tf.Tensor{oSess.inferInputPH: inputTensor},
 		[]tf.Output{oSess.output},
-		nil,
 	)
 	if err != nil {
 		return
@@ -471,8 +815,11 @@ func (oSess OnlineSess) Infer(inputTensor *tf.Tensor) (outputTensor *tf.Tensor,
 	return
 }
 
-// Run the graph. Just a wrapper around tf.Session.Run() For simple cases you probably want .Infer()
+// Run the graph with the current inference weights. Just a wrapper around tf.Session.Run() For simple cases you probably want .Infer()
 func (oSess OnlineSess) Run(feeds map[tf.Output]*tf.Tensor, fetches []tf.Output) (results []*tf.Tensor, err error) {
-	results, err = oSess.Sess.Run(feeds, fetches, nil)
+	snapshot := oSess.buffers.snapshot()
+	snapshot.RLock()
+	defer snapshot.RUnlock()
+	results, err = snapshot.sess.Run(feeds, fetches, nil)
 	return
 }
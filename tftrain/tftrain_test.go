@@ -331,3 +331,180 @@ func TestStepTrainLSTM(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSetVars(t *testing.T) {
+	graph, err := loadTrainGraph("models/linear_train.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oSess, err := NewOnlineSess(graph, "x", "y", "train", "init", "loss", "output", "x", []string{"output"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	weight, err := tf.NewTensor([]float32{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bias, err := tf.NewTensor([]float32{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = oSess.SetVars(map[string]*tf.Tensor{"weight": weight, "bias": bias}); err != nil {
+		t.Fatal(err)
+	}
+	inputTensor, _ := tf.NewTensor([]float32{1, 2, 3})
+	output, err := oSess.Infer(inputTensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, val := range output.Value().([]float32) {
+		if val != float32(i+1)*2+1 {
+			t.Fatal("expected output of 2x+1, got", output.Value())
+		}
+	}
+	if err = oSess.FreezeVars([]string{"weight"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	inputTensor, targetTensor, _ := getTrainingData(0)
+	if _, err = oSess.Train(inputTensor, targetTensor); err != nil {
+		t.Fatal(err)
+	}
+	values, err := oSess.GetVars([]string{"weight", "bias"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["weight"].Value().([]float32)[0] != 2 {
+		t.Fatal("frozen weight changed while training")
+	}
+	if values["bias"].Value().([]float32)[0] == 1 {
+		t.Fatal("bias was not trained")
+	}
+	if _, err = oSess.Train(inputTensor, targetTensor); err != nil {
+		t.Fatal(err)
+	}
+	values, err = oSess.GetVars([]string{"weight"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["weight"].Value().([]float32)[0] == 2 {
+		t.Fatal("weight is still frozen")
+	}
+}
+
+func TestOverlayTensor(t *testing.T) {
+	dst, err := tf.NewTensor([][]float32{{0, 0, 0}, {0, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := tf.NewTensor([][]float32{{1, 2}, {3, 4}, {5, 6}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := overlayTensor(dst, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := result.Value().([][]float32)
+	if value[0][1] != 2 || value[1][0] != 3 || value[1][2] != 0 {
+		t.Fatal("bad overlay:", value)
+	}
+	wrongType, err := tf.NewTensor([]int32{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = overlayTensor(dst, wrongType); err == nil {
+		t.Fatal("should not overlay tensors of different types")
+	}
+}
+
+func TestLoadResizedVars(t *testing.T) {
+	graph, err := loadTrainGraph("models/linear_train.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oSess, err := NewOnlineSess(graph, "x", "y", "train", "init", "loss", "output", "x", []string{"output"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	weight, err := tf.NewTensor([]float32{2, 3}) // the weight of a model with one more output.
+	if err != nil {
+		t.Fatal(err)
+	}
+	bias, err := tf.NewTensor([]float32{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trained := map[string]*tf.Tensor{"weight": weight, "bias": bias}
+	if err = oSess.LoadResizedVars(trained, func(name string) bool { return name == "bias" }); err == nil {
+		t.Fatal("should not resize a var which may not be resized")
+	}
+	values, err := oSess.GetVars([]string{"bias"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["bias"].Value().([]float32)[0] == 1 {
+		t.Fatal("should not copy any vars if one can't be resized")
+	}
+	if err = oSess.LoadResizedVars(trained, func(name string) bool { return name == "weight" }); err != nil {
+		t.Fatal(err)
+	}
+	values, err = oSess.GetVars([]string{"weight", "bias"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["weight"].Value().([]float32)[0] != 2 || values["bias"].Value().([]float32)[0] != 1 {
+		t.Fatal("expected the overlapping weight and the bias to be copied, got", values["weight"].Value(), values["bias"].Value())
+	}
+}
+
+func TestSnapshotInterval(t *testing.T) {
+	graph, err := loadTrainGraph("models/linear_train.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oSess, err := NewOnlineSess(graph, "x", "y", "train", "init", "loss", "output", "x", []string{"output"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oSess.SetSnapshotInterval(3)
+	inputTensor, targetTensor, _ := getTrainingData(0)
+	before, err := oSess.Infer(inputTensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { // infer while training, so that the race detector can check us.
+		for i := 0; i < 100; i++ {
+			if _, err := oSess.Infer(inputTensor); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 2; i++ {
+		if _, err = oSess.Train(inputTensor, targetTensor); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	during, err := oSess.Infer(inputTensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if during.Value().([]float32)[0] != before.Value().([]float32)[0] {
+		t.Fatal("inference weights changed before the snapshot interval")
+	}
+	if _, err = oSess.Train(inputTensor, targetTensor); err != nil {
+		t.Fatal(err)
+	}
+	after, err := oSess.Infer(inputTensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Value().([]float32)[0] == before.Value().([]float32)[0] {
+		t.Fatal("inference weights were not updated after the snapshot interval")
+	}
+}
@@ -9,8 +9,11 @@ import (
 	"image/png"
 	"log"
 	"os"
+	"regexp"
+	"strconv"
 	"sync"
 
+	"github.ibm.com/Blue-Horizon/aural2/features"
 	"github.ibm.com/Blue-Horizon/aural2/libaural2"
 	"github.ibm.com/Blue-Horizon/aural2/tftrain"
 
@@ -22,6 +25,147 @@ var logger = log.New(os.Stdout, "", log.Lshortfile)
 const outputname = "/softmax/output"
 const inputname = "/inputs"
 
+// RequiredOutputs are the OPs of an aural2 training graph, other then those used for training and seq inference, which must be preserved when saving.
+var RequiredOutputs = []string{
+	"step_inference/softmax/output",
+	"step_inference/initial_state_names",
+	"step_inference/final_state_names",
+	"step_inference/loss_monitor/count",
+	"seq_inference/loss_monitor/count",
+	"seq_inference/loss_monitor/sum_mean_loss",
+	"step_inference/loss_monitor/sum_mean_loss",
+	"multi_step_inference/softmax/output",
+	"multi_step_inference/initial_state_names",
+	"multi_step_inference/final_state_names",
+	"multi_step_inference/loss_monitor/count",
+	"multi_step_inference/loss_monitor/sum_mean_loss",
+	"zeros",
+	FeatureConfigName,
+}
+
+// FeatureConfigName is the name of the const in which the feature config of a model is recorded.
+const FeatureConfigName = "feature_config"
+
+// ReadFeatureConfig reads the feature config recorded in a graph by AddFeatureConfig().
+// ok is false if the graph has none, as graphs generated by gen_train_graph.py, or saved before configs were recorded, do not.
+func ReadFeatureConfig(graph *tf.Graph) (config features.Config, ok bool, err error) {
+	configOP := graph.Operation(FeatureConfigName)
+	if configOP == nil {
+		return
+	}
+	sess, err := tf.NewSession(graph, nil)
+	if err != nil {
+		return
+	}
+	defer sess.Close()
+	result, err := sess.Run(map[tf.Output]*tf.Tensor{}, []tf.Output{configOP.Output(0)}, nil)
+	if err != nil {
+		return
+	}
+	config, err = features.ParseConfig([]byte(result[0].Value().(string)))
+	ok = err == nil
+	return
+}
+
+// AddFeatureConfig records the feature config in the graph, so that it is saved with the model.
+// As with any change to the graph, it must be done before the OnlineSess is made.
+func AddFeatureConfig(graph *tf.Graph, config features.Config) (err error) {
+	serialized, err := config.Serialize()
+	if err != nil {
+		return
+	}
+	configTensor, err := tf.NewTensor(string(serialized))
+	if err != nil {
+		return
+	}
+	_, err = graph.AddOperation(tf.OpSpec{
+		Name: FeatureConfigName,
+		Type: "Const",
+		Attrs: map[string]interface{}{
+			"dtype": configTensor.DataType(),
+			"value": configTensor,
+		},
+	})
+	return
+}
+
+// InputSize returns the size of each input of the training graph, which must equal the InputSize() of the feature config.
+func InputSize(graph *tf.Graph) (size int, err error) {
+	inputOP := graph.Operation("training/inputs")
+	if inputOP == nil {
+		err = errors.New("can't find op training/inputs")
+		return
+	}
+	shape := inputOP.Output(0).Shape()
+	if shape.NumDimensions() != 3 {
+		err = errors.New("training/inputs should be of rank 3")
+		return
+	}
+	size = int(shape.Size(2))
+	return
+}
+
+// NewOnlineSess makes a tftrain.OnlineSess from a graph generated by gen_train_graph.py, or saved by a previous OnlineSess.
+func NewOnlineSess(graph *tf.Graph) (oSess tftrain.OnlineSess, err error) {
+	oSess, err = tftrain.NewOnlineSess(graph,
+		"training/inputs",              // placeholder for batch training inputs
+		"training/targets",             // placeholder for batch training targets
+		"training/Adam",                // training operation
+		"init",                         // OP to initalise the variables
+		"training/loss_monitor/div",    // the loss of the graph when training
+		"seq_inference/softmax/output", // output for live inference
+		"seq_inference/inputs",         // input for live inference
+		RequiredOutputs,                // any other ops which need to be preserved when freezing
+	)
+	return
+}
+
+// lstmVarPattern matches the kernel and bias variables of each LSTM layer, capturing the layer number.
+var lstmVarPattern = regexp.MustCompile(`cell_([0-9]+)/basic_lstm_cell/(kernel|bias)$`)
+
+// outputVarPattern matches the weights and bias of the output projection, and the optimizer slots of them, which are all of the vars whose shape depends on the number of states.
+var outputVarPattern = regexp.MustCompile(`softmax/softmax_(w|b)(/Adam(_1)?)?$`)
+
+// IsOutputVar returns true if the named variable is part of the output projection, so that it may be resized by tftrain.OnlineSess.LoadResizedVars when states are added.
+func IsOutputVar(name string) bool {
+	return outputVarPattern.MatchString(name)
+}
+
+// TransferLSTM copies the weights of the LSTM layers of a trained model into oSess, leaving the output projection at its initial value.
+// trained is the variables of the trained model, as returned by tftrain.LoadVars().
+// The lowest freezeLayers layers are then held fixed for freezeSteps training steps, so that the new output projection can catch up before they are disturbed.
+func TransferLSTM(oSess *tftrain.OnlineSess, trained map[string]*tf.Tensor, freezeLayers, freezeSteps int) (err error) {
+	transferred := map[string]*tf.Tensor{}
+	var frozen []string
+	for _, name := range oSess.VarNames() {
+		match := lstmVarPattern.FindStringSubmatch(name)
+		if match == nil { // not an LSTM weight, so leave it be.
+			continue
+		}
+		tensor, prs := trained[name]
+		if !prs {
+			err = errors.New("trained model has no variable " + name)
+			return
+		}
+		transferred[name] = tensor
+		layer, _ := strconv.Atoi(match[1])
+		if layer < freezeLayers {
+			frozen = append(frozen, name)
+		}
+	}
+	if len(transferred) == 0 {
+		err = errors.New("can't find any LSTM variables to transfer")
+		return
+	}
+	if err = oSess.SetVars(transferred); err != nil {
+		return
+	}
+	if len(frozen) > 0 && freezeSteps > 0 {
+		err = oSess.FreezeVars(frozen, freezeSteps)
+	}
+	return
+}
+
 // LoadGraph loads the TF graph from the bytes of an LSTM graphdef, and returns a
 func LoadGraph(graph *tf.Graph, sess *tf.Session, scopeName string) (input, output tf.Output, statePlaceholders, stateFetches []tf.Output, stateFeeds map[tf.Output]*tf.Tensor, err error) {
 	// read in the two lists of state OP names
@@ -137,26 +281,30 @@ func MakeSeqInference(savedModel tf.SavedModel) (seqInference func(*tf.Tensor) (
 }
 
 // MakeStepInference returns a function that takes a tensor of one mfccs, and returns a []float32 labels.
+// The LSTM state is carried from one call to the next, so calls are serialized. It is safe to call while oSession is training.
 func MakeStepInference(oSession tftrain.OnlineSess) (stepInference func(*tf.Tensor) ([]float32, error), err error) {
-	input, output, placeholders, fetches, feeds, err := LoadGraph(oSession.Graph, oSession.Sess, "step_inference")
+	input, output, placeholders, fetches, initialFeeds, err := LoadGraph(oSession.Graph, oSession.Sess, "step_inference")
 	if err != nil {
 		return
 	}
-	//slicePngBytes :=
+	state := make([]*tf.Tensor, len(placeholders)) // state is the LSTM state to be fed to the next step, in the order of placeholders.
+	for i, ph := range placeholders {
+		state[i] = initialFeeds[ph]
+	}
+	mutex := &sync.Mutex{}
 	fetches = append(fetches, output) // also pull on output
 	stepInference = func(mfccTensor *tf.Tensor) (probs []float32, err error) {
-		feeds[input] = mfccTensor // feed the input
-		results, err := oSession.Sess.Run(
-			feeds,
-			fetches,
-			nil,
-		)
+		mutex.Lock()
+		defer mutex.Unlock()
+		feeds := map[tf.Output]*tf.Tensor{input: mfccTensor} // feed the input,
+		for i, ph := range placeholders {
+			feeds[ph] = state[i] // and the state from the previous step.
+		}
+		results, err := oSession.Run(feeds, fetches)
 		if err != nil {
 			return
 		}
-		for i, ph := range placeholders {
-			feeds[ph] = results[i]
-		}
+		copy(state, results[:len(placeholders)])
 		probs = results[len(fetches)-1].Value().([][]float32)[0]
 		return
 	}
@@ -182,11 +330,7 @@ func MakeRenderLSTMstate(oSession *tftrain.OnlineSess) (renderLSTMstate func(*tf
 				logger.Println(err)
 				return
 			}
-			results, err = oSession.Sess.Run(
-				feeds,
-				fetches,
-				nil,
-			)
+			results, err = oSession.Run(feeds, fetches)
 			if err != nil {
 				logger.Println(err)
 				return
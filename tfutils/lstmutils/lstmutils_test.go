@@ -2,10 +2,13 @@ package lstmutils
 
 import (
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
 	"testing"
 
 	tf "github.com/tensorflow/tensorflow/tensorflow/go"
+	"github.ibm.com/Blue-Horizon/aural2/features"
 	"github.ibm.com/Blue-Horizon/aural2/libaural2"
 	"github.ibm.com/Blue-Horizon/aural2/tftrain"
 	"github.ibm.com/Blue-Horizon/aural2/tfutils"
@@ -46,7 +49,7 @@ func TestMakeSeqInference(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	audioClipToMFCCtensor, err := tfutils.MakeAudioClipToMFCCtensor()
+	audioClipToMFCCtensor, err := tfutils.MakeAudioClipToMFCCtensor(features.DefaultConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -95,7 +98,7 @@ func TestRenderLSTMstate(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	audioClipToMFCCtensor, err := tfutils.MakeAudioClipToMFCCtensor()
+	audioClipToMFCCtensor, err := tfutils.MakeAudioClipToMFCCtensor(features.DefaultConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -144,3 +147,155 @@ func TestRenderLSTMstate(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestStreamSet(t *testing.T) {
+	rawBytes, err := ioutil.ReadFile("testaudio2.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audioClip := &libaural2.AudioClip{}
+	copy(audioClip[:], rawBytes)
+	graphBytes, err := ioutil.ReadFile("intent.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audioClipToMFCCtensor, err := tfutils.MakeAudioClipToMFCCtensor(features.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph := tf.NewGraph()
+	if err := graph.Import(graphBytes, ""); err != nil {
+		t.Fatal(err)
+	}
+	oSess, err := NewOnlineSess(graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stepInference, err := MakeStepInference(oSess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := NewStreamSet(oSess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+	mfccTensor, err := audioClipToMFCCtensor(audioClip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfccs := mfccTensor.Value().([][][]float32)[0][:50]
+	streams := []*Stream{ss.NewStream(), ss.NewStream(), ss.NewStream()}
+	for _, mfcc := range mfccs {
+		stepTensor, err := tf.NewTensor([][][]float32{[][]float32{mfcc}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := stepInference(stepTensor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results := make(chan []float32, len(streams))
+		for _, stream := range streams { // step all the streams at once, so that they are batched together.
+			go func(stream *Stream) {
+				probs, err := stream.Step(stepTensor)
+				if err != nil {
+					t.Error(err)
+				}
+				results <- probs
+			}(stream)
+		}
+		for range streams {
+			probs := <-results
+			for i := range expected {
+				if math.Abs(float64(probs[i]-expected[i])) > 1e-5 {
+					t.Fatal("stream differs from step inference:", probs[i], expected[i])
+				}
+			}
+		}
+	}
+	streams[0].Reset()
+	stepTensor, _ := tf.NewTensor([][][]float32{[][]float32{mfccs[0]}})
+	first, err := streams[0].Step(stepTensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := streams[1].Step(stepTensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first[0] == second[0] && first[1] == second[1] {
+		t.Fatal("reset stream should not have the same state as a stream which was not reset")
+	}
+	streams[2].Close()
+	if _, err = streams[2].Step(stepTensor); err == nil {
+		t.Fatal("closed stream should not step")
+	}
+}
+
+// TestStreamSetBatched checks that stepping many streams in one run of the multi_step_inference scope gives each stream the same probs as stepping it alone.
+// It needs a graph with that scope, made by `python gen_train_graph.py` from the root of the repo.
+func TestStreamSetBatched(t *testing.T) {
+	graphBytes, err := ioutil.ReadFile("../../target/train_graph.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph := tf.NewGraph()
+	if err := graph.Import(graphBytes, ""); err != nil {
+		t.Fatal(err)
+	}
+	oSess, err := NewOnlineSess(graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := NewStreamSet(oSess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+	if !ss.batched {
+		t.Fatal("graph has no multi_step_inference scope")
+	}
+	r := rand.New(rand.NewSource(1))
+	streams := make([]*Stream, 5)
+	stepInferences := make([]func(*tf.Tensor) ([]float32, error), len(streams))
+	for i := range streams {
+		streams[i] = ss.NewStream()
+		if stepInferences[i], err = MakeStepInference(oSess); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for step := 0; step < 20; step++ {
+		batch := make([]stepRequest, len(streams))
+		for i, stream := range streams { // each stream hears different audio, so that their states differ.
+			mfcc := make([]float32, libaural2.InputSize)
+			for j := range mfcc {
+				mfcc[j] = float32(r.NormFloat64())
+			}
+			batch[i] = stepRequest{stream: stream, mfcc: mfcc, result: make(chan stepResult, 1)}
+		}
+		ss.runBatch(batch) // run them as one batch, rather than hoping that Step batches them.
+		for i, req := range batch {
+			result := <-req.result
+			if result.err != nil {
+				t.Fatal(result.err)
+			}
+			stepTensor, err := tf.NewTensor([][][]float32{{req.mfcc}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := stepInferences[i](stepTensor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.probs) != len(expected) {
+				t.Fatal("expected", len(expected), "probs, got", len(result.probs))
+			}
+			for j := range expected {
+				if math.Abs(float64(result.probs[j]-expected[j])) > 1e-5 {
+					t.Fatal("step", step, "stream", i, "batched:", result.probs[j], "alone:", expected[j])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package lstmutils
+
+import (
+	"errors"
+	"sync"
+
+	"github.ibm.com/Blue-Horizon/aural2/tftrain"
+
+	tf "github.com/tensorflow/tensorflow/tensorflow/go"
+)
+
+// maxBatchSize is the largest number of streams which will be stepped in one run of the graph.
+const maxBatchSize = 64
+
+// StreamSet runs step inference on many audio streams at once, each with its own LSTM state.
+// Steps from many streams which arrive together are batched into one run of the graph.
+type StreamSet struct {
+	oSess        tftrain.OnlineSess
+	input        tf.Output
+	output       tf.Output
+	placeholders []tf.Output // the initial state placeholders,
+	fetches      []tf.Output // and the final state outputs, followed by output.
+	zeroState    [][]float32 // one row of zeros for each placeholder.
+	batched      bool        // does the graph have a multi_step_inference scope? If not, streams are stepped one at a time.
+	requests     chan stepRequest
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// stepRequest is one MFCC to be stepped through the LSTM of one stream.
+type stepRequest struct {
+	stream *Stream
+	mfcc   []float32
+	result chan stepResult
+}
+
+type stepResult struct {
+	probs []float32
+	err   error
+}
+
+// Stream is a handle to the LSTM state of one audio stream.
+type Stream struct {
+	set    *StreamSet
+	mutex  sync.Mutex
+	state  [][]float32 // one row for each state placeholder
+	closed bool
+}
+
+// NewStreamSet makes a StreamSet which infers using the current inference weights of oSess.
+// Graphs saved before the multi_step_inference scope was added still work, but are stepped one stream at a time.
+func NewStreamSet(oSess tftrain.OnlineSess) (ss *StreamSet, err error) {
+	scopeName := "multi_step_inference"
+	batched := oSess.Graph.Operation(scopeName+inputname) != nil
+	if !batched {
+		scopeName = "step_inference"
+	}
+	input, output, placeholders, fetches, feeds, err := LoadGraph(oSess.Graph, oSess.Sess, scopeName)
+	if err != nil {
+		return
+	}
+	zeroState := make([][]float32, len(placeholders))
+	for i, ph := range placeholders {
+		zeroState[i] = feeds[ph].Value().([][]float32)[0]
+	}
+	ss = &StreamSet{
+		oSess:        oSess,
+		input:        input,
+		output:       output,
+		placeholders: placeholders,
+		fetches:      append(fetches, output), // also pull on output
+		zeroState:    zeroState,
+		batched:      batched,
+		requests:     make(chan stepRequest),
+		done:         make(chan struct{}),
+	}
+	go ss.batchLoop()
+	return
+}
+
+// Close stops the StreamSet. Any streams still open will return errors when stepped.
+func (ss *StreamSet) Close() {
+	ss.closeOnce.Do(func() { close(ss.done) })
+}
+
+// NewStream makes a new stream, starting from zero state.
+func (ss *StreamSet) NewStream() (stream *Stream) {
+	stream = &Stream{set: ss}
+	stream.Reset()
+	return
+}
+
+// batchLoop waits for step requests, and runs each lot which arrive together as one batch.
+func (ss *StreamSet) batchLoop() {
+	for {
+		var batch []stepRequest
+		select {
+		case req := <-ss.requests:
+			batch = append(batch, req)
+		case <-ss.done:
+			return
+		}
+	collect:
+		for len(batch) < maxBatchSize { // take whatever other requests are already waiting,
+			select {
+			case req := <-ss.requests:
+				batch = append(batch, req)
+			default:
+				break collect
+			}
+		}
+		if ss.batched { // and run them all at once.
+			ss.runBatch(batch)
+			continue
+		}
+		for _, req := range batch { // the graph can only take a batch of one, so run them one at a time.
+			ss.runBatch([]stepRequest{req})
+		}
+	}
+}
+
+// runBatch steps each stream of the batch by one MFCC, and sends each the result.
+func (ss *StreamSet) runBatch(batch []stepRequest) {
+	inputs := make([][][]float32, len(batch))
+	states := make([][][]float32, len(ss.placeholders))
+	for i, req := range batch {
+		inputs[i] = [][]float32{req.mfcc}
+		for p := range ss.placeholders {
+			states[p] = append(states[p], req.stream.state[p])
+		}
+	}
+	results, err := ss.run(inputs, states)
+	for i, req := range batch {
+		if err != nil {
+			req.result <- stepResult{err: err}
+			continue
+		}
+		for p := range ss.placeholders {
+			req.stream.state[p] = results[p].Value().([][]float32)[i]
+		}
+		req.result <- stepResult{probs: results[len(ss.fetches)-1].Value().([][]float32)[i]}
+	}
+}
+
+func (ss *StreamSet) run(inputs [][][]float32, states [][][]float32) (results []*tf.Tensor, err error) {
+	feeds := map[tf.Output]*tf.Tensor{}
+	feeds[ss.input], err = tf.NewTensor(inputs)
+	if err != nil {
+		return
+	}
+	for p, ph := range ss.placeholders {
+		feeds[ph], err = tf.NewTensor(states[p])
+		if err != nil {
+			return
+		}
+	}
+	results, err = ss.oSess.Run(feeds, ss.fetches)
+	return
+}
+
+// Step feeds one MFCC of shape [1, 1, n] to the stream, and returns the probabilities of the states.
+// It blocks until the batch the step is part of has been run.
+func (stream *Stream) Step(mfccTensor *tf.Tensor) (probs []float32, err error) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.closed {
+		err = errors.New("stream is closed")
+		return
+	}
+	mfcc, ok := mfccTensor.Value().([][][]float32)
+	if !ok || len(mfcc) != 1 || len(mfcc[0]) != 1 {
+		err = errors.New("expected an MFCC tensor of shape [1, 1, n]")
+		return
+	}
+	result := make(chan stepResult, 1)
+	select {
+	case stream.set.requests <- stepRequest{stream: stream, mfcc: mfcc[0][0], result: result}:
+	case <-stream.set.done:
+		err = errors.New("stream set is closed")
+		return
+	}
+	select {
+	case r := <-result:
+		return r.probs, r.err
+	case <-stream.set.done:
+		err = errors.New("stream set is closed")
+		return
+	}
+}
+
+// Reset returns the LSTM state of the stream to zero, as if it had just been created.
+func (stream *Stream) Reset() {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.state = make([][]float32, len(stream.set.zeroState))
+	for i, row := range stream.set.zeroState {
+		stream.state[i] = append([]float32{}, row...)
+	}
+}
+
+// Close releases the stream. It can not be stepped again.
+func (stream *Stream) Close() {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.closed = true
+	stream.state = nil
+}
@@ -10,6 +10,8 @@ import (
 	"sync"
 
 	tf "github.com/tensorflow/tensorflow/tensorflow/go"
+	"github.ibm.com/Blue-Horizon/aural2/audioconv"
+	"github.ibm.com/Blue-Horizon/aural2/features"
 	"github.ibm.com/Blue-Horizon/aural2/libaural2"
 
 	"github.com/tensorflow/tensorflow/tensorflow/go/op"
@@ -121,6 +123,24 @@ func MakeCleanWav(sampleRate int) (cleanWav func([]byte) ([]byte, error), err er
 	return
 }
 
+// MakeImportWav returns a function which takes the bytes of a wav file of any format supported by audioconv, such as 44.1 kHz stereo,
+// converts it to 16 kHz mono, and cleans it as MakeCleanWav does.
+func MakeImportWav() (importWav func([]byte) ([]byte, error), err error) {
+	cleanWav, err := MakeCleanWav(libaural2.SampleRate)
+	if err != nil {
+		return
+	}
+	importWav = func(inputBytes []byte) (outputBytes []byte, err error) {
+		native, err := audioconv.WavToNative(inputBytes)
+		if err != nil {
+			return
+		}
+		outputBytes, err = cleanWav(audioconv.EncodeWav(native))
+		return
+	}
+	return
+}
+
 // ComputeMFCC compute the Mel-frequency cepstrum coefficients of the PCM audio
 func ComputeMFCC(s *op.Scope, pcm tf.Output) (mfcc, sampleRatePH tf.Output) {
 	dim := op.Const(s.SubScope("dim"), int32(1))
@@ -288,39 +308,14 @@ func EmbedTrainingData(inputs [][][]float32, outputs [][libaural2.StridesPerClip
 	return
 }
 
-// MakeAudioClipToMFCCtensor makes a function that takes an audioClip and returns a tensor of mfccs sutable for feeding to seqInference
-func MakeAudioClipToMFCCtensor() (renderMFCC func(*libaural2.AudioClip) (*tf.Tensor, error), err error) {
-	s := op.NewScope()
-	bytesPH, pcm := ParseRawBytesToPCM(s)
-	mfccOP, sampleRatePH := ComputeMFCC(s.SubScope("spectrogram"), pcm)
-	dim := op.Const(s, int32(0))
-	expanded := op.ExpandDims(s, mfccOP, dim)
-	sampleRateTensor, err := tf.NewTensor(int32(libaural2.SampleRate))
-	if err != nil {
-		return
-	}
-	graph, err := s.Finalize() // finalize the scope to get the graph
-	if err != nil {
-		return
-	}
-	sess, err := tf.NewSession(graph, nil) // start a new TF session
-	if err != nil {
+// MakeAudioClipToMFCCtensor makes a function that takes an audioClip and returns a tensor of the features described by config, sutable for feeding to seqInference.
+// The features are computed in Go by package features, which computes the same MFCCs as ComputeMFCC.
+func MakeAudioClipToMFCCtensor(config features.Config) (renderMFCC func(*libaural2.AudioClip) (*tf.Tensor, error), err error) {
+	if err = config.Validate(); err != nil {
 		return
 	}
 	renderMFCC = func(raw *libaural2.AudioClip) (mfccTensor *tf.Tensor, err error) {
-		inputTensor, err := tf.NewTensor(string(raw[:])) // create a string tensor from the input bytes
-		if err != nil {
-			return
-		}
-		feeds := map[tf.Output]*tf.Tensor{
-			sampleRatePH: sampleRateTensor,
-			bytesPH:      inputTensor,
-		}
-		results, err := sess.Run(feeds, []tf.Output{expanded}, nil)
-		if err != nil {
-			return
-		}
-		mfccTensor = results[0]
+		mfccTensor, err = tf.NewTensor([][][]float32{config.AudioClipToFeatures(raw)}) // add the batch dimension
 		return
 	}
 	return
@@ -1,8 +1,14 @@
 package tfutils
 
 import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+
 	tf "github.com/tensorflow/tensorflow/tensorflow/go"
 	"github.com/tensorflow/tensorflow/tensorflow/go/op"
+	"github.ibm.com/Blue-Horizon/aural2/audioconv"
+	"github.ibm.com/Blue-Horizon/aural2/features"
 	"github.ibm.com/Blue-Horizon/aural2/libaural2"
 	"io/ioutil"
 	"testing"
@@ -95,6 +101,52 @@ func TestComputeMFCC(t *testing.T) {
 	}
 }
 
+// TestComputeMFCCmatchesFeatures is the golden test of package features: it must compute the same MFCCs as TF.
+func TestComputeMFCCmatchesFeatures(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	raw := make([]byte, libaural2.SampleRate*2*2) // two seconds of a tone in noise
+	for i := 0; i < len(raw)/2; i++ {
+		sample := 8000*math.Sin(2*math.Pi*440*float64(i)/float64(libaural2.SampleRate)) + 500*r.NormFloat64()
+		binary.LittleEndian.PutUint16(raw[i*2:], uint16(int16(sample)))
+	}
+	s := op.NewScope()
+	rawBytesPH, pcm := ParseRawBytesToPCM(s)
+	mfccOP, sampleRatePH := ComputeMFCC(s.SubScope("mfcc"), pcm)
+	graph, err := s.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := tf.NewSession(graph, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawTensor, err := tf.NewTensor(string(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sampleRateTensor, err := tf.NewTensor(int32(libaural2.SampleRate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := sess.Run(map[tf.Output]*tf.Tensor{rawBytesPH: rawTensor, sampleRatePH: sampleRateTensor}, []tf.Output{mfccOP}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := result[0].Value().([][]float32)
+	actual := features.NewExtractor().Compute(features.PCMFromInt16LE(raw))
+	if len(actual) != len(expected) {
+		t.Fatal("expected", len(expected), "MFCCs, got", len(actual))
+	}
+	for i := range expected {
+		for j := range expected[i] {
+			diff := math.Abs(float64(actual[i][j] - expected[i][j]))
+			if diff > 1e-3*math.Max(1, math.Abs(float64(expected[i][j]))) {
+				t.Fatal("stride", i, "coefficient", j, "go:", actual[i][j], "tf:", expected[i][j])
+			}
+		}
+	}
+}
+
 func TestComputeMFCCinputSet(t *testing.T) {
 	rawBytes, err := ioutil.ReadFile("10s.raw")
 	if err != nil {
@@ -535,6 +587,39 @@ func TestMakeCleanWav(t *testing.T) {
 	}
 }
 
+func TestMakeImportWav(t *testing.T) {
+	importWav, err := MakeImportWav()
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := audioconv.Format{SampleRate: 48000, Channels: 2, Encoding: audioconv.S16LE}
+	data := make([]byte, format.SampleRate*2*2) // one second of 48 kHz stereo,
+	for i := 0; i < format.SampleRate; i++ {
+		sample := uint16(int16(10000 * math.Sin(float64(i)*0.05)))
+		binary.LittleEndian.PutUint16(data[i*4:], sample)
+		binary.LittleEndian.PutUint16(data[i*4+2:], sample)
+	}
+	wavBytes := audioconv.EncodeWav(data) // which EncodeWav labels as native,
+	binary.LittleEndian.PutUint16(wavBytes[22:], uint16(format.Channels))
+	binary.LittleEndian.PutUint32(wavBytes[24:], uint32(format.SampleRate))
+	binary.LittleEndian.PutUint32(wavBytes[28:], uint32(format.SampleRate*4))
+	binary.LittleEndian.PutUint16(wavBytes[32:], 4)
+	importedWav, err := importWav(wavBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	importedFormat, importedData, err := audioconv.ParseWav(importedWav)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if importedFormat != audioconv.Native || len(importedData) != libaural2.SampleRate*2 {
+		t.Fatal("expected one second of native audio, got", len(importedData), "bytes of", importedFormat)
+	}
+	if _, err = importWav([]byte("some byte string that is not wav audio")); err == nil {
+		t.Fatal("should not import garbage")
+	}
+}
+
 var hash = libaural2.ClipID{}
 var labelSets = []libaural2.LabelSet{
 	libaural2.GenFakeLabelSet(),
@@ -7,11 +7,10 @@ import (
 	"time"
 
 	tf "github.com/tensorflow/tensorflow/tensorflow/go"
-	"github.com/tensorflow/tensorflow/tensorflow/go/op"
 	"github.ibm.com/Blue-Horizon/aural2/boltstore"
+	"github.ibm.com/Blue-Horizon/aural2/features"
 	"github.ibm.com/Blue-Horizon/aural2/libaural2"
 	"github.ibm.com/Blue-Horizon/aural2/tftrain"
-	"github.ibm.com/Blue-Horizon/aural2/tfutils"
 )
 
 type trainParams struct {
@@ -29,11 +28,15 @@ func newTrainingDataMap(
 	getAudioClip func(libaural2.ClipID) (*libaural2.AudioClip, error),
 	getLabelSet func(libaural2.ClipID, libaural2.VocabName) (libaural2.LabelSet, error),
 	vocabName libaural2.VocabName,
+	featureCache *features.Cache,
 ) (
 	td *trainingDataMaps,
 	err error,
 ) {
-	clipToMFCC, err := makeClipToMFCC()
+	clipToMFCC, err := makeClipToMFCC(featureCache)
+	if err != nil {
+		return
+	}
 	td = &trainingDataMaps{
 		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
 		inputs:       map[libaural2.ClipID][][]float32{},
@@ -105,11 +108,16 @@ func (td *trainingDataMaps) makeMiniBatch() (mb miniBatch, err error) {
 	return
 }
 
-func startTrainingLoops(db boltstore.DB, onlineSessions map[libaural2.VocabName]*tftrain.OnlineSess, sleepms *int32) (tdmMap map[libaural2.VocabName]*trainingDataMaps, err error) {
+func startTrainingLoops(
+	db boltstore.DB,
+	onlineSessions map[libaural2.VocabName]*tftrain.OnlineSess,
+	featureCaches map[libaural2.VocabName]*features.Cache,
+	sleepms *int32,
+) (tdmMap map[libaural2.VocabName]*trainingDataMaps, err error) {
 	tdmMap = map[libaural2.VocabName]*trainingDataMaps{}
 	for vocabName, oSess := range onlineSessions {
 		tdm := &trainingDataMaps{}
-		tdm, err = newTrainingDataMap(getAudioClipFromFS, db.GetLabelSet, vocabName)
+		tdm, err = newTrainingDataMap(getAudioClipFromFS, db.GetLabelSet, vocabName, featureCaches[vocabName])
 		if err != nil {
 			return
 		}
@@ -167,40 +175,22 @@ func startTrainingDataLoop(vocabName libaural2.VocabName, tdm *trainingDataMaps)
 	return
 }
 
-// makeClipToMFCC returns a function to turn a clip into tensor
-func makeClipToMFCC() (clipToMFCC func(*libaural2.AudioClip) ([][]float32, error), err error) {
-	s := op.NewScope()
-	bytesPH, pcm := tfutils.ParseRawBytesToPCM(s)
-	mfccOP, sampleRatePH := tfutils.ComputeMFCC(s.SubScope("spectrogram"), pcm)
-	sampleRateTensor, err := tf.NewTensor(int32(libaural2.SampleRate))
-	if err != nil {
-		return
-	}
-	graph, err := s.Finalize() // finalize the scope to get the graph
-	if err != nil {
-		return
-	}
-	sess, err := tf.NewSession(graph, nil) // start a new TF session
-	if err != nil {
+// makeClipToMFCC returns a function to turn a clip into the features of the cache, computing them only if they are not already cached.
+func makeClipToMFCC(cache *features.Cache) (clipToMFCC func(*libaural2.AudioClip) ([][]float32, error), err error) {
+	if cache == nil {
+		err = errors.New("no feature cache")
 		return
 	}
+	inputSize := cache.Config().InputSize()
 	clipToMFCC = func(clip *libaural2.AudioClip) (mfccs [][]float32, err error) {
-		clipTensor, err := tf.NewTensor(string(clip[:])) // create a string tensor from the input bytes
-		if err != nil {
-			logger.Println(err)
-			return
-		}
-		result, err := sess.Run(map[tf.Output]*tf.Tensor{bytesPH: clipTensor, sampleRatePH: sampleRateTensor}, []tf.Output{mfccOP}, nil)
+		mfccs, err = cache.AudioClipToFeatures(clip)
 		if err != nil {
-			logger.Println(err)
 			return
 		}
-		shape := result[0].Shape()
-		if shape[0] != int64(libaural2.StridesPerClip) || shape[1] != int64(libaural2.InputSize) {
+		if len(mfccs) != libaural2.StridesPerClip || len(mfccs[0]) != inputSize {
 			err = errors.New("bad shape")
 			return
 		}
-		mfccs = result[0].Value().([][]float32)
 		return
 	}
 	return
@@ -0,0 +1,171 @@
+// Package vad detects which strides of audio are speech, so that models need not be run on hours of silence and room noise,
+// and so that clips can be split into spans of speech for labeling.
+package vad
+
+import (
+	"errors"
+	"math"
+
+	"github.ibm.com/Blue-Horizon/aural2/features"
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+)
+
+// Defaults which work for a quiet room.
+const (
+	DefaultMarginDB  float64 = 12  // how far above the noise floor speech must be.
+	DefaultThreshold float32 = 0.5 // probability above which a stride is speech.
+	DefaultHangover  int     = 10  // about a third of a second.
+)
+
+// Detector gives the probability that each stride of audio is speech.
+// A Detector carries state from one stride to the next, so each stream of audio needs its own.
+type Detector interface {
+	Step(samples []float32) (prob float32, err error)
+}
+
+// floor tracking of the EnergyDetector.
+const (
+	floorFall = 0.5   // fraction of the way the floor falls toward quieter audio each stride.
+	floorRise = 0.02  // dB the floor may rise toward louder audio each stride, so that it follows slowly rising noise, but is barely moved by speech.
+	energyEps = 1e-10 // so that the log of digital silence is finite.
+	softness  = 3     // dB over which the probability goes from about 0.25 to 0.75.
+)
+
+// EnergyDetector is a Detector which compares the energy of each stride to an estimate of the noise floor.
+type EnergyDetector struct {
+	MarginDB float64 // how far above the noise floor speech must be.
+	floor    float64 // estimate of the noise floor, in dB.
+	started  bool
+}
+
+// NewEnergyDetector makes a new EnergyDetector.
+func NewEnergyDetector(marginDB float64) *EnergyDetector {
+	return &EnergyDetector{MarginDB: marginDB}
+}
+
+// Step gives the probability that one stride is speech.
+func (detector *EnergyDetector) Step(samples []float32) (prob float32, err error) {
+	if len(samples) == 0 {
+		err = errors.New("no samples")
+		return
+	}
+	var sum float64
+	for _, sample := range samples {
+		sum += float64(sample) * float64(sample)
+	}
+	energy := 10 * math.Log10(sum/float64(len(samples))+energyEps)
+	if !detector.started {
+		detector.floor = energy
+		detector.started = true
+	}
+	if energy < detector.floor {
+		detector.floor += floorFall * (energy - detector.floor)
+	} else {
+		detector.floor += math.Min(floorRise, energy-detector.floor)
+	}
+	prob = float32(1 / (1 + math.Exp(-(energy-detector.floor-detector.MarginDB)/softness)))
+	return
+}
+
+// ModelDetector is a Detector which runs a model on the features of each stride.
+// The probability of speech is taken to be 1 minus the probability of the Nil state,
+// so the model can be of any vocab, including intent itself, or of a vocab trained just to tell speech from Nil.
+type ModelDetector struct {
+	stream *features.Stream
+	step   func([]float32) ([]float32, error)
+}
+
+// NewModelDetector makes a ModelDetector.
+// step is a statefull step inference func of the model, such as golstm.Model.Step with a state, which takes the features of one stride and returns the probabilities of each state.
+func NewModelDetector(config features.Config, step func([]float32) ([]float32, error)) (detector *ModelDetector, err error) {
+	if err = config.Validate(); err != nil {
+		return
+	}
+	detector = &ModelDetector{
+		stream: config.NewStream(),
+		step:   step,
+	}
+	return
+}
+
+// Step gives the probability that one stride is speech.
+func (detector *ModelDetector) Step(samples []float32) (prob float32, err error) {
+	probs, err := detector.step(detector.stream.Step(samples))
+	if err != nil {
+		return
+	}
+	if len(probs) <= int(libaural2.Nil) {
+		err = errors.New("model has no Nil state")
+		return
+	}
+	prob = 1 - probs[libaural2.Nil]
+	return
+}
+
+// Gate turns the probabilities of a Detector into decisions of speech or not speech.
+// It stays in speech for a while after the probability drops, so that short pauses do not cut speech in two.
+type Gate struct {
+	Detector    Detector
+	Threshold   float32 // probability above which a stride is speech.
+	Hangover    int     // number of strides to stay in speech after the probability drops.
+	sinceSpeech int     // number of strides since the probability was last above the threshold.
+}
+
+// NewGate makes a new Gate.
+func NewGate(detector Detector, threshold float32, hangover int) *Gate {
+	return &Gate{
+		Detector:    detector,
+		Threshold:   threshold,
+		Hangover:    hangover,
+		sinceSpeech: hangover + 1, // the stream starts in silence.
+	}
+}
+
+// Step decides if one stride is speech.
+func (gate *Gate) Step(samples []float32) (speech bool, prob float32, err error) {
+	prob, err = gate.Detector.Step(samples)
+	if err != nil {
+		return
+	}
+	if prob > gate.Threshold {
+		gate.sinceSpeech = 0
+	} else if gate.sinceSpeech <= gate.Hangover {
+		gate.sinceSpeech++
+	}
+	speech = gate.sinceSpeech <= gate.Hangover
+	return
+}
+
+// Segment is a span of speech, in seconds from the start of the audio.
+type Segment struct {
+	Start float64
+	End   float64
+}
+
+// Segments feeds PCM through the gate one stride at a time, and returns the spans of speech, along with the decision and probability of each stride.
+// The gate should be new, so that it starts in silence.
+func (gate *Gate) Segments(pcm []float32) (segments []Segment, speech []bool, probs []float32, err error) {
+	strideDuration := float64(libaural2.StrideWidth) / float64(libaural2.SampleRate)
+	for i := 0; (i+1)*libaural2.StrideWidth <= len(pcm); i++ {
+		isSpeech, prob, err := gate.Step(pcm[i*libaural2.StrideWidth : (i+1)*libaural2.StrideWidth])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		speech = append(speech, isSpeech)
+		probs = append(probs, prob)
+		if !isSpeech {
+			continue
+		}
+		if i > 0 && speech[i-1] { // extend the current segment,
+			segments[len(segments)-1].End = float64(i+1) * strideDuration
+			continue
+		}
+		segments = append(segments, Segment{Start: float64(i) * strideDuration, End: float64(i+1) * strideDuration}) // or start a new one.
+	}
+	return
+}
+
+// DefaultGate makes a new Gate of an EnergyDetector with the default parameters.
+func DefaultGate() *Gate {
+	return NewGate(NewEnergyDetector(DefaultMarginDB), DefaultThreshold, DefaultHangover)
+}
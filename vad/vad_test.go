@@ -0,0 +1,91 @@
+package vad
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.ibm.com/Blue-Horizon/aural2/features"
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+)
+
+// makeTestPCM makes 1 second of quiet noise, a second of a loud tone, then another second of quiet noise.
+func makeTestPCM() (pcm []float32) {
+	r := rand.New(rand.NewSource(42))
+	pcm = make([]float32, 3*libaural2.SampleRate)
+	for i := range pcm {
+		pcm[i] = float32(0.001 * r.NormFloat64())
+		if i >= libaural2.SampleRate && i < 2*libaural2.SampleRate {
+			pcm[i] += float32(0.1 * math.Sin(2*math.Pi*300*float64(i)/float64(libaural2.SampleRate)))
+		}
+	}
+	return
+}
+
+func TestEnergyGate(t *testing.T) {
+	segments, speech, probs, err := DefaultGate().Segments(makeTestPCM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(speech) != len(probs) || len(speech) != 3*libaural2.SampleRate/libaural2.StrideWidth {
+		t.Fatal("should decide each stride")
+	}
+	if len(segments) != 1 {
+		t.Fatal("expected one segment, got", segments)
+	}
+	strideDuration := float64(libaural2.StrideWidth) / float64(libaural2.SampleRate)
+	if math.Abs(segments[0].Start-1) > strideDuration {
+		t.Fatal("speech should start at 1 second, started at", segments[0].Start)
+	}
+	hangoverEnd := 2 + float64(DefaultHangover)*strideDuration
+	if math.Abs(segments[0].End-hangoverEnd) > 2*strideDuration {
+		t.Fatal("speech should end one hangover after 2 seconds, ended at", segments[0].End)
+	}
+}
+
+func TestGateHangover(t *testing.T) {
+	probs := []float32{0, 0.9, 0.2, 0.2, 0.9, 0.2, 0.2, 0.2, 0.2}
+	expected := []bool{false, true, true, true, true, true, true, false, false}
+	var i int
+	gate := NewGate(detectorFunc(func([]float32) (float32, error) {
+		i++
+		return probs[i-1], nil
+	}), 0.5, 2)
+	for j := range probs {
+		speech, _, err := gate.Step([]float32{0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if speech != expected[j] {
+			t.Fatal("stride", j, "expected", expected[j], "got", speech)
+		}
+	}
+}
+
+// detectorFunc makes a func into a Detector.
+type detectorFunc func([]float32) (float32, error)
+
+func (f detectorFunc) Step(samples []float32) (float32, error) {
+	return f(samples)
+}
+
+func TestModelDetector(t *testing.T) {
+	var inputSize int
+	detector, err := NewModelDetector(features.DefaultConfig, func(input []float32) ([]float32, error) {
+		inputSize = len(input)
+		return []float32{0.25, 0.5, 0.25}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prob, err := detector.Step(make([]float32, libaural2.StrideWidth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inputSize != features.DefaultConfig.InputSize() {
+		t.Fatal("model should be given the features of the stride")
+	}
+	if prob != 0.75 {
+		t.Fatal("speech should be everything but Nil, got", prob)
+	}
+}
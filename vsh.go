@@ -1,49 +1,113 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
-	"sync"
 	"time"
 
 	"os"
 
 	tf "github.com/tensorflow/tensorflow/tensorflow/go"
+	"github.ibm.com/Blue-Horizon/aural2/audioconv"
+	"github.ibm.com/Blue-Horizon/aural2/features"
 	"github.ibm.com/Blue-Horizon/aural2/libaural2"
 	"github.ibm.com/Blue-Horizon/aural2/vsh"
 	"github.ibm.com/Blue-Horizon/aural2/vsh/intent"
 )
 
 type intentMsg struct {
-	Name string    `json:"name"`
-	Prob float32   `json:"prob"`
-	TS   time.Time `json:"ts"`
+	Name      string            `json:"name"` // the action, command or state, or confirmPrefix followed by the action being confirmed
+	Prob      float32           `json:"prob"`
+	TS        time.Time         `json:"ts"`
+	Slots     map[string]string `json:"slots,omitempty"`     // the slots of a command of the grammar
+	Confirm   vsh.ConfirmStatus `json:"confirm,omitempty"`   // how far the confirmation of an action which needs it has got
+	Utterance *vsh.Utterance    `json:"utterance,omitempty"` // the begin, update or end of an utterance the decoder found, if the message is of one
 }
 
-func initMakeSendIntentMsgAction(intentChan chan intentMsg) func(string, float32) vsh.Action {
-	return func(intentName string, minProb float32) (action vsh.Action) {
-		action = vsh.Action{
-			MinActivationProb: minProb,
-			MaxResetProb:      0.2,
-			HandlerFunction: func(prob float32) {
-				fmt.Println(intentName, prob)
-				intentChan <- intentMsg{
-					Name: intentName,
-					Prob: prob,
-					TS:   time.Now(),
-				}
-			},
+// confirmPrefix is prefixed to the name of an action in the messages about its confirmation, so that clients which only look at the name don't take a prompt or a cancellation for the action itself.
+const confirmPrefix = "confirm:"
+
+// initMakeSendIntentMsg makes a HandlerMaker of handlers which send the name of their action to the clients of the intent stream.
+func initMakeSendIntentMsg(intentChan chan intentMsg) vsh.HandlerMaker {
+	return func(intentName string, rule vsh.Rule) (handler func(float32), err error) {
+		handler = func(prob float32) {
+			fmt.Println(intentName, prob)
+			intentChan <- intentMsg{
+				Name: intentName,
+				Prob: prob,
+				TS:   time.Now(),
+			}
 		}
 		return
 	}
 }
 
+// defaultRules are the rules used if there is no rules file.
+func defaultRules() (rules []vsh.Rule) {
+	var uploadMinActivationProb float32 = 0.98
+	saveClipThreshold := os.Getenv("SAVE_CLIP_THRESHOLD")
+	if saveClipThreshold != "" {
+		parsedFloat, err := strconv.ParseFloat(saveClipThreshold, 64)
+		if err != nil {
+			logger.Println("Can't parse SAVE_CLIP_THRESHOLD:", err.Error())
+		} else {
+			uploadMinActivationProb = float32(parsedFloat)
+		}
+	}
+	rules = []vsh.Rule{
+		{Name: "play", Vocab: intent.Vocabulary.Name, State: "PlayMusic", Thresholds: []float32{0.5, 0.8, 0.9, 0.95, 0.99}, ResetProb: 0.2, Handler: "intent"},
+		{Name: "pause", Vocab: intent.Vocabulary.Name, State: "PauseMusic", Thresholds: []float32{0.5, 0.8, 0.9, 0.95, 0.99}, ResetProb: 0.2, Handler: "intent"},
+		{Name: "skip", Vocab: intent.Vocabulary.Name, State: "SkipSong", Thresholds: []float32{0.5, 0.8, 0.9, 0.95, 0.99}, ResetProb: 0.2, Handler: "intent"},
+		{Name: "next", Vocab: intent.Vocabulary.Name, State: "Next", Thresholds: []float32{0.95}, ResetProb: 0.2, Handler: "intent"},
+		{Name: "previous", Vocab: intent.Vocabulary.Name, State: "Previous", Thresholds: []float32{0.95}, ResetProb: 0.2, Handler: "intent"},
+		{Name: "shutdown", Vocab: intent.Vocabulary.Name, State: "ShutDown", Thresholds: []float32{0.99}, ResetProb: 0.5, Confirm: "5s", Handler: "shutdown"},
+		{Name: "upload", Vocab: intent.Vocabulary.Name, State: "UploadClip", Thresholds: []float32{uploadMinActivationProb}, ResetProb: 0.5, Cooldown: "10s", Handler: "upload"},
+	}
+	return
+}
+
+// makeHandlerMakers makes the types of handler which rules can use.
+func makeHandlerMakers(
+	intentsChan chan intentMsg,
+	beforeShutdown func(),
+	dump func() *libaural2.AudioClip,
+	saveClip func(*libaural2.AudioClip),
+) (handlerMakers map[string]vsh.HandlerMaker) {
+	handlerMakers = map[string]vsh.HandlerMaker{
+		"intent": initMakeSendIntentMsg(intentsChan),
+		"shutdown": func(name string, rule vsh.Rule) (handler func(float32), err error) {
+			handler = func(prob float32) {
+				beforeShutdown()
+			}
+			return
+		},
+		"upload": func(name string, rule vsh.Rule) (handler func(float32), err error) {
+			handler = func(prob float32) {
+				logger.Println("uploading in 2 seconds")
+				time.Sleep(2 * time.Second)
+				clip := dump()
+				saveClip(clip)
+				logger.Println("saved clip:", clip.ID())
+			}
+			return
+		},
+	}
+	for handlerType, maker := range vsh.BuiltinHandlers {
+		handlerMakers[handlerType] = maker
+	}
+	return
+}
+
 func startVsh(
 	saveClip func(*libaural2.AudioClip),
+	vocabs map[libaural2.VocabName]*libaural2.Vocabulary,
 	stepInferenceFuncs map[libaural2.VocabName]func(*tf.Tensor) ([]float32, error),
+	featureConfigs map[libaural2.VocabName]features.Config,
+	vadConfig vsh.VAD,
 	beforeShutdown func(),
+	hub *liveHub,
 ) (
 	dump func() *libaural2.AudioClip,
 ) {
@@ -69,98 +133,107 @@ func startVsh(
 	}
 
 	fmt.Println("Listening for tcp connections on", listenAddr)
-	resultChan, dump, err := vsh.Init(conn, stepInferenceFuncs)
+	var audioReader io.Reader = conn
+	if formatString := os.Getenv("AUDIO_FORMAT"); formatString != "" { // if the audio is not 16 kHz mono S16_LE, convert it.
+		format, err := audioconv.ParseFormat(formatString)
+		if err != nil {
+			panic(err)
+		}
+		logger.Println("converting audio from", format)
+		audioReader, err = audioconv.NewReader(conn, format)
+		if err != nil {
+			panic(err)
+		}
+	}
+	rawResultChan, dump, err := vsh.Init(audioReader, stepInferenceFuncs, featureConfigs, vadConfig)
+	if err != nil {
+		panic(err)
+	}
+	decodingPath := os.Getenv("DECODING")
+	if decodingPath == "" {
+		decodingPath = "persist/decoding.json"
+	}
+	decoders, err := loadDecoders(decodingPath, vocabs)
+	if err != nil {
+		panic(err)
+	}
+	resultChan, utterances, err := vsh.Decode(hub.teeResults(rawResultChan, liveProbs, true), vocabs, decoders)
 	if err != nil {
 		panic(err)
 	}
-	connsMap := map[int]*json.Encoder{}
-	var connsIndex int
-	connsMutex := sync.Mutex{}
 	intentsChan := make(chan intentMsg)
-	makeSendIntentMsgAction := initMakeSendIntentMsgAction(intentsChan)
+	go hub.publishIntents(intentsChan)
+	handlerMakers := makeHandlerMakers(intentsChan, beforeShutdown, dump, saveClip)
+	rulesPath := os.Getenv("RULES")
+	if rulesPath == "" {
+		rulesPath = "persist/rules.json"
+	}
+	// the rules are thresholded against the decoded probs, so those are what the live page shows.
+	eb := vsh.NewEventBroker(hub.teeResults(resultChan, liveDecoded, false))
+	eb.OnAction(hub.publishAction) // so that rules of every handler can be seen firing, not only those which send intents.
+	if err = eb.WatchRules(rulesPath, defaultRules(), vocabs, handlerMakers); err != nil {
+		panic(err)
+	}
+	confirmEvents := make(chan vsh.ConfirmEvent)
+	eb.SetConfirmation(vsh.DefaultConfirmation, confirmEvents)
 	go func() {
-		for {
-			msg := <-intentsChan
-			for i, encoder := range connsMap {
-				logger.Print("conn", i)
-				go func(writer *json.Encoder, connID int) {
-					err := writer.Encode(msg)
-					logger.Println("writing message to conn", i)
-					if err != nil {
-						logger.Println("got error:", err.Error(), "closing connection", i)
-						delete(connsMap, i)
-					}
-				}(encoder, i)
+		for event := range confirmEvents { // so that clients of the intent stream can prompt the user to say DoIt or DontDoIt.
+			intentsChan <- intentMsg{
+				Name:    confirmPrefix + event.Action,
+				Prob:    event.Prob,
+				TS:      event.TS,
+				Confirm: event.Status,
 			}
 		}
 	}()
-	eb := vsh.NewEventBroker(resultChan)
-	eb.Register(intent.Vocabulary.Name, intent.PlayMusic, "play0.5", makeSendIntentMsgAction("play0.5", 0.5))
-	eb.Register(intent.Vocabulary.Name, intent.PlayMusic, "play0.8", makeSendIntentMsgAction("play0.8", 0.8))
-	eb.Register(intent.Vocabulary.Name, intent.PlayMusic, "play0.9", makeSendIntentMsgAction("play0.9", 0.9))
-	eb.Register(intent.Vocabulary.Name, intent.PlayMusic, "play0.95", makeSendIntentMsgAction("play0.95", 0.95))
-	eb.Register(intent.Vocabulary.Name, intent.PlayMusic, "play0.99", makeSendIntentMsgAction("play0.99", 0.99))
-
-	eb.Register(intent.Vocabulary.Name, intent.PauseMusic, "pause0.5", makeSendIntentMsgAction("pause0.5", 0.5))
-	eb.Register(intent.Vocabulary.Name, intent.PauseMusic, "pause0.8", makeSendIntentMsgAction("pause0.8", 0.8))
-	eb.Register(intent.Vocabulary.Name, intent.PauseMusic, "pause0.9", makeSendIntentMsgAction("pause0.9", 0.9))
-	eb.Register(intent.Vocabulary.Name, intent.PauseMusic, "pause0.95", makeSendIntentMsgAction("pause0.95", 0.95))
-	eb.Register(intent.Vocabulary.Name, intent.PauseMusic, "pause0.99", makeSendIntentMsgAction("pause0.99", 0.99))
-
-	eb.Register(intent.Vocabulary.Name, intent.SkipSong, "skip0.5", makeSendIntentMsgAction("skip0.5", 0.5))
-	eb.Register(intent.Vocabulary.Name, intent.SkipSong, "skip0.8", makeSendIntentMsgAction("skip0.8", 0.8))
-	eb.Register(intent.Vocabulary.Name, intent.SkipSong, "skip0.9", makeSendIntentMsgAction("skip0.9", 0.9))
-	eb.Register(intent.Vocabulary.Name, intent.SkipSong, "skip0.95", makeSendIntentMsgAction("skip0.95", 0.95))
-	eb.Register(intent.Vocabulary.Name, intent.SkipSong, "skip0.99", makeSendIntentMsgAction("skip0.99", 0.99))
-
-	eb.Register(intent.Vocabulary.Name, intent.Next, "next0.95", makeSendIntentMsgAction("next0.95", 0.95))
-	eb.Register(intent.Vocabulary.Name, intent.Previous, "previous0.95", makeSendIntentMsgAction("previous0.95", 0.95))
-
-	eb.Register(intent.Vocabulary.Name, intent.ShutDown, "shutdown", vsh.Action{
-		MinActivationProb: 0.99,
-		MaxResetProb:      0.5,
-		HandlerFunction: func(prob float32) {
-			beforeShutdown()
-		},
-	})
-	var uploadMinActivationProb float32 = 0.98
-	saveClipThreshold := os.Getenv("SAVE_CLIP_THRESHOLD")
-	if saveClipThreshold != "" {
-		parsedFloat, err := strconv.ParseFloat(saveClipThreshold, 64)
+	grammarPath := os.Getenv("GRAMMAR")
+	if grammarPath == "" {
+		grammarPath = "persist/grammar.json"
+	}
+	commands := make(chan vsh.CommandEvent)
+	if err = eb.WatchGrammar(grammarPath, vocabs, commands); err != nil {
+		panic(err)
+	}
+	go func() {
+		for command := range commands { // commands are sent to the clients of the intent stream like intents.
+			logger.Println("heard command", command.Command, command.Slots)
+			intentsChan <- intentMsg{
+				Name:  command.Command,
+				Prob:  command.Prob,
+				TS:    command.End,
+				Slots: command.Slots,
+			}
+		}
+	}()
+	var saveUtteranceMinMean float32 // utterances at least this confident have the audio around them saved, 0 to save none.
+	if saveUtterances := os.Getenv("SAVE_UTTERANCES"); saveUtterances != "" {
+		parsedFloat, err := strconv.ParseFloat(saveUtterances, 64)
 		if err != nil {
-			logger.Println("Can't parse SAVE_CLIP_THRESHOLD:", err.Error())
+			logger.Println("Can't parse SAVE_UTTERANCES:", err.Error())
 		} else {
-			uploadMinActivationProb = float32(parsedFloat)
+			saveUtteranceMinMean = float32(parsedFloat)
 		}
 	}
-	eb.Register(intent.Vocabulary.Name, intent.UploadClip, "upload", vsh.Action{
-		MinActivationProb: uploadMinActivationProb,
-		MaxResetProb:      0.5,
-		CoolDownDuration:  10 * time.Second,
-		TimeLastCalled:    time.Now(),
-		HandlerFunction: func(prob float32) {
-			logger.Println("uploading in 2 seconds")
-			time.Sleep(2 * time.Second)
-			clip := dump()
-			saveClip(clip)
-			logger.Println("saved clip:", clip.ID())
-		},
-	})
 	go func() {
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				fmt.Println("Error accepting: ", err.Error())
-			} else {
-				connsMutex.Lock()
-				connsIndex++
-				index := connsIndex
-				fmt.Println("adding connection", index)
-				encoder := json.NewEncoder(conn)
-				connsMap[connsIndex] = encoder
-				connsMutex.Unlock()
+		for utterance := range utterances { // the begin, updates and end of utterances are sent to the clients of the intent stream, named by their state.
+			utterance := utterance
+			if utterance.Phase == vsh.UtteranceEnd {
+				logger.Println("heard", utterance.Name, "from stride", utterance.StartStride, "to", utterance.EndStride)
+				// the clip is the last 10 seconds, so it only holds all of the utterance if it started since then.
+				if saveUtteranceMinMean > 0 && utterance.Mean >= saveUtteranceMinMean && time.Since(utterance.Start) < time.Duration(libaural2.Duration)*time.Second {
+					clip := dump()
+					saveClip(clip)
+					utterance.ClipID = clip.ID().FSsafeString()
+				}
+			}
+			intentsChan <- intentMsg{
+				Name:      utterance.Name,
+				Prob:      utterance.Mean,
+				TS:        utterance.End,
+				Utterance: &utterance,
 			}
 		}
 	}()
+	go hub.serveTCP(l)
 	return
 }
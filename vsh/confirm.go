@@ -0,0 +1,172 @@
+package vsh
+
+import (
+	"time"
+
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+	"github.ibm.com/Blue-Horizon/aural2/vsh/intent"
+)
+
+// Confirmation says which states confirm or cancel an action.
+type Confirmation struct {
+	Vocab     libaural2.VocabName
+	Yes       libaural2.State // the state which confirms the action
+	No        libaural2.State // the state which cancels it
+	Threshold float32         // Yes or No is heard when its prob rises above this,
+	ResetProb float32         // but only once its prob has been below this since the user was asked.
+}
+
+// DefaultConfirmation confirms with the DoIt intent, and cancels with DontDoIt.
+var DefaultConfirmation = Confirmation{
+	Vocab:     intent.Vocabulary.Name,
+	Yes:       intent.DoIt,
+	No:        intent.DontDoIt,
+	Threshold: 0.9,
+	ResetProb: 0.3,
+}
+
+// ConfirmStatus is how far a confirmation has got.
+type ConfirmStatus string
+
+const (
+	// ConfirmPrompt means the user is being asked to confirm the action.
+	ConfirmPrompt ConfirmStatus = "prompt"
+	// Confirmed means the user confirmed the action, so it has been run.
+	Confirmed ConfirmStatus = "confirmed"
+	// ConfirmCancelled means the user cancelled the action, or asked for another action before confirming this one.
+	ConfirmCancelled ConfirmStatus = "cancelled"
+	// ConfirmTimeout means the user did not confirm the action in time.
+	ConfirmTimeout ConfirmStatus = "timeout"
+)
+
+// ConfirmEvent tells of the progress of the confirmation of an action, so that the user can be prompted.
+type ConfirmEvent struct {
+	Action   string              `json:"action"` // name of the action
+	Vocab    libaural2.VocabName `json:"vocab"`
+	State    libaural2.State     `json:"state"`
+	Prob     float32             `json:"prob"` // the prob which activated the action
+	Status   ConfirmStatus       `json:"status"`
+	TS       time.Time           `json:"ts"`
+	Deadline time.Time           `json:"deadline"` // when the action will time out if not confirmed
+}
+
+// pendingAction is an action waiting to be confirmed.
+type pendingAction struct {
+	key      actionKey
+	action   *Action
+	prob     float32
+	deadline time.Time
+	yesArmed bool // true once the prob of Yes has been below the reset prob, so that a Yes heard before the user was asked does not count.
+	noArmed  bool
+}
+
+// confirmer holds the action waiting to be confirmed. Only one action waits at a time.
+type confirmer struct {
+	Confirmation
+	events    chan ConfirmEvent // queue of events to send
+	onConfirm func(ConfirmEvent)
+	pending   *pendingAction
+}
+
+// SetConfirmation sets the states which confirm or cancel actions, and the chan to send the progress of confirmations to, so that the user can be prompted.
+func (eb *EventBroker) SetConfirmation(confirmation Confirmation, events chan<- ConfirmEvent) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+	eb.confirm.Confirmation = confirmation
+	queue := make(chan ConfirmEvent, 100) // the events are queued, so that they arrive in order without holding up the broker.
+	go func() {
+		for event := range queue {
+			events <- event
+		}
+	}()
+	if eb.confirm.events != nil {
+		close(eb.confirm.events)
+	}
+	eb.confirm.events = queue
+}
+
+// OnConfirm sets a func to be called with each event of the progress of a confirmation, as it happens, such as to log what the broker did.
+// It is called with the broker locked, so it must not block, or call the broker.
+func (eb *EventBroker) OnConfirm(onConfirm func(ConfirmEvent)) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+	eb.confirm.onConfirm = onConfirm
+}
+
+// ask the user to confirm the action, cancelling any action already waiting.
+func (c *confirmer) ask(key actionKey, action *Action, prob float32, now time.Time) {
+	if c.pending != nil {
+		c.finish(ConfirmCancelled, now)
+	}
+	c.pending = &pendingAction{
+		key:      key,
+		action:   action,
+		prob:     prob,
+		deadline: now.Add(action.ConfirmWindow),
+	}
+	c.send(ConfirmPrompt, now)
+}
+
+// step looks for Yes or No in the result, and times out the pending action if it has waited too long.
+// If the action is confirmed, it is returned to be run.
+func (c *confirmer) step(result Result, now time.Time) (confirmed *pendingAction) {
+	if c.pending == nil {
+		return
+	}
+	if now.After(c.pending.deadline) {
+		c.finish(ConfirmTimeout, now)
+		return
+	}
+	probs := result.Probs[c.Vocab]
+	if int(c.Yes) >= len(probs) || int(c.No) >= len(probs) {
+		return
+	}
+	if probs[c.Yes] < c.ResetProb {
+		c.pending.yesArmed = true
+	}
+	if probs[c.No] < c.ResetProb {
+		c.pending.noArmed = true
+	}
+	if c.pending.noArmed && probs[c.No] > c.Threshold { // when in doubt, don't.
+		c.finish(ConfirmCancelled, now)
+		return
+	}
+	if c.pending.yesArmed && probs[c.Yes] > c.Threshold {
+		confirmed = c.pending
+		c.finish(Confirmed, now)
+	}
+	return
+}
+
+// finish the pending action with a status.
+func (c *confirmer) finish(status ConfirmStatus, now time.Time) {
+	logger.Println("confirmation of", c.pending.key.Name, status)
+	c.send(status, now)
+	c.pending = nil
+}
+
+func (c *confirmer) send(status ConfirmStatus, now time.Time) {
+	if c.events == nil && c.onConfirm == nil {
+		return
+	}
+	event := ConfirmEvent{
+		Action:   c.pending.key.Name,
+		Vocab:    c.pending.key.VocabName,
+		State:    c.pending.key.State,
+		Prob:     c.pending.prob,
+		Status:   status,
+		TS:       now,
+		Deadline: c.pending.deadline,
+	}
+	if c.onConfirm != nil {
+		c.onConfirm(event)
+	}
+	if c.events == nil {
+		return
+	}
+	select {
+	case c.events <- event:
+	default:
+		logger.Println("confirmation events are not being read, dropping", event.Status, "of", event.Action)
+	}
+}
@@ -0,0 +1,170 @@
+package vsh
+
+import (
+	"errors"
+	"time"
+
+	"github.ibm.com/Blue-Horizon/aural2/decode"
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+)
+
+// UtterancePhase says whether an utterance event is of the start, progress or end of an utterance.
+type UtterancePhase string
+
+const (
+	// UtteranceBegin is sent when the decoder decides an utterance has started.
+	UtteranceBegin UtterancePhase = "begin"
+	// UtteranceUpdate is sent while the utterance goes on, at most every UtteranceUpdateInterval.
+	UtteranceUpdate UtterancePhase = "update"
+	// UtteranceEnd is sent when the decoder decides the utterance is over.
+	UtteranceEnd UtterancePhase = "end"
+)
+
+// UtteranceUpdateInterval is the shortest time betwene updates of one utterance.
+var UtteranceUpdateInterval = 250 * time.Millisecond
+
+// Utterance is a run of strides which a decoder decided were all the same state.
+// It is sent when the utterance begins, while it goes on, and when it ends, the fields being as they are so far.
+type Utterance struct {
+	Phase       UtterancePhase      `json:"phase"`
+	Vocab       libaural2.VocabName `json:"vocab"`
+	State       libaural2.State     `json:"state"`
+	Name        string              `json:"name"`              // name of the state
+	StartStride int                 `json:"start_stride"`      // index of the first stride, counting from the start of vsh
+	EndStride   int                 `json:"end_stride"`        // index of the stride after the last
+	Start       time.Time           `json:"start"`             // when the first stride was heard
+	End         time.Time           `json:"end"`               // when the last stride was heard
+	Peak        float32             `json:"peak"`              // highest prob of the state
+	Mean        float32             `json:"mean"`              // mean prob of the state
+	ClipID      string              `json:"clip_id,omitempty"` // FSsafe ID of the clip of audio saved around the utterance, if any
+}
+
+// queuedStride is a stride which a decoder has been given, but not yet decided on.
+type queuedStride struct {
+	stride int
+	ts     time.Time
+}
+
+// vocabDecoder decodes the results of one vocab.
+type vocabDecoder struct {
+	vocab      *libaural2.Vocabulary
+	decoder    decode.Decoder
+	tracker    decode.Tracker
+	queue      []queuedStride
+	start      time.Time // when the current utterance started
+	last       time.Time // when the last decided stride was heard
+	lastUpdate time.Time // when the last event of the current utterance was sent
+}
+
+// event makes an event of an utterance.
+func (vd *vocabDecoder) event(phase UtterancePhase, utterance *decode.Utterance, end time.Time) Utterance {
+	return Utterance{
+		Phase:       phase,
+		Vocab:       vd.vocab.Name,
+		State:       utterance.State,
+		Name:        vd.vocab.Names[utterance.State],
+		StartStride: utterance.Start,
+		EndStride:   utterance.End,
+		Start:       vd.start,
+		End:         end,
+		Peak:        utterance.Peak,
+		Mean:        utterance.Mean,
+	}
+}
+
+// step decodes the probs of one stride, returning the decision and the events of the utterances it ended, began or updated.
+func (vd *vocabDecoder) step(probs []float32, stride int, ts time.Time) (decision decode.Decision, ok bool, events []Utterance) {
+	vd.queue = append(vd.queue, queuedStride{stride: stride, ts: ts})
+	decision, ok = vd.decoder.Step(probs)
+	if !ok {
+		return
+	}
+	decided := vd.queue[0] // the decision is of the oldest stride the decoder has not yet decided on.
+	vd.queue = vd.queue[1:]
+	decision.Stride = decided.stride
+	wasSpeaking := vd.tracker.Current() != nil
+	ended := vd.tracker.Step(decision)
+	if ended != nil {
+		events = append(events, vd.event(UtteranceEnd, ended, vd.last))
+	}
+	if current := vd.tracker.Current(); current != nil {
+		if ended != nil || !wasSpeaking { // a new utterance started with this stride.
+			vd.start = decided.ts
+			vd.lastUpdate = decided.ts
+			events = append(events, vd.event(UtteranceBegin, current, decided.ts))
+		} else if decided.ts.Sub(vd.lastUpdate) >= UtteranceUpdateInterval {
+			vd.lastUpdate = decided.ts
+			events = append(events, vd.event(UtteranceUpdate, current, decided.ts))
+		}
+	}
+	vd.last = decided.ts
+	return
+}
+
+// ResultDecoder decodes the probs of each vocab of one result at a time, as Decode does.
+type ResultDecoder struct {
+	vocabDecoders map[libaural2.VocabName]*vocabDecoder
+	stride        int // index of the next result
+}
+
+// NewResultDecoder makes a ResultDecoder which decodes the probs of each vocab with its decoder.
+func NewResultDecoder(vocabs map[libaural2.VocabName]*libaural2.Vocabulary, decoders map[libaural2.VocabName]decode.Decoder) (rd *ResultDecoder, err error) {
+	rd = &ResultDecoder{vocabDecoders: map[libaural2.VocabName]*vocabDecoder{}}
+	for vocabName, decoder := range decoders {
+		vocab, prs := vocabs[vocabName]
+		if !prs {
+			err = errors.New("decoder of unknown vocab " + string(vocabName))
+			return
+		}
+		rd.vocabDecoders[vocabName] = &vocabDecoder{vocab: vocab, decoder: decoder}
+	}
+	return
+}
+
+// Step decodes the next result, heard at now, returning the decoded result, and the events of the utterances it began, updated or ended.
+func (rd *ResultDecoder) Step(result Result, now time.Time) (decoded Result, events []Utterance) {
+	stride := rd.stride
+	rd.stride++
+	decoded = result
+	decoded.Probs = map[libaural2.VocabName][]float32{}
+	for vocab, probs := range result.Probs {
+		vd, prs := rd.vocabDecoders[vocab]
+		if !prs || len(probs) == 0 { // the model may not have been run yet.
+			decoded.Probs[vocab] = probs
+			continue
+		}
+		decision, ok, vocabEvents := vd.step(probs, stride, now)
+		if ok {
+			decoded.Probs[vocab] = decision.Probs
+		}
+		events = append(events, vocabEvents...)
+	}
+	return
+}
+
+// Decode passes the probs of each vocab through its decoder, so that the broker acts on decoded probs, and sends the events of the utterances the decoders find to utterances.
+// Vocabs with no decoder are passed through as they are. Decoders with a lag decide on each stride that many strides late, so their probs in each result are of an earlier stride.
+func Decode(results chan Result, vocabs map[libaural2.VocabName]*libaural2.Vocabulary, decoders map[libaural2.VocabName]decode.Decoder) (decoded chan Result, utterances chan Utterance, err error) {
+	rd, err := NewResultDecoder(vocabs, decoders)
+	if err != nil {
+		return
+	}
+	decoded = make(chan Result)
+	utterances = make(chan Utterance, 100)
+	go func() {
+		defer close(decoded)
+		defer close(utterances)
+		for result := range results {
+			decodedResult, events := rd.Step(result, time.Now())
+			for _, event := range events {
+				select {
+				case utterances <- event:
+				default:
+					logger.Println("utterances are not being read, dropping", event.Phase, "of", event.Name)
+				}
+			}
+			decoded <- decodedResult
+		}
+	}()
+	return
+}
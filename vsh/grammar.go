@@ -0,0 +1,334 @@
+package vsh
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+)
+
+// Grammar declares commands made of sequences of words, such as "Mpc Play Genre Rock".
+type Grammar struct {
+	Vocab     libaural2.VocabName `json:"vocab"`      // vocabulary of the words, usually word
+	Threshold float32             `json:"threshold"`  // a word is heard when its prob rises above this, default 0.8
+	ResetProb float32             `json:"reset_prob"` // and can't be heard again until its prob falls below this, default 0.3
+	Timeout   string              `json:"timeout"`    // the longest gap betwene the words of a command, default 2s
+	Commands  []Command           `json:"commands"`
+}
+
+// Command is one sequence of words.
+type Command struct {
+	Name    string              `json:"name"`
+	Pattern []string            `json:"pattern"` // each token is the name of a state, or $slot to match any of the states of the slot.
+	Slots   map[string][]string `json:"slots"`   // the names of the states each slot may be
+}
+
+// CommandEvent is a command which has been heard.
+type CommandEvent struct {
+	Command string            `json:"command"`
+	Slots   map[string]string `json:"slots"` // the word heard for each slot
+	Words   []string          `json:"words"` // all the words heard
+	Prob    float32           `json:"prob"`  // prob of the least sure word
+	Start   time.Time         `json:"start"` // when the first word was heard
+	End     time.Time         `json:"end"`   // when the last word was heard
+}
+
+// token is one token of the pattern of a command.
+type token struct {
+	slot   string                     // name of the slot, empty for a literal word
+	states map[libaural2.State]string // the states which match the token, and their names
+}
+
+type compiledCommand struct {
+	name    string
+	pattern []token
+}
+
+// partialMatch is a command of which the first pos tokens have been heard.
+type partialMatch struct {
+	command *compiledCommand
+	pos     int
+	slots   map[string]string
+	words   []string
+	prob    float32
+	start   time.Time
+	last    time.Time
+}
+
+// advance tries to match the word to the next token, returning the longer match.
+func (match partialMatch) advance(state libaural2.State, prob float32, at time.Time) (next partialMatch, ok bool) {
+	tok := match.command.pattern[match.pos]
+	name, ok := tok.states[state]
+	if !ok {
+		return
+	}
+	next = match
+	next.pos++
+	next.words = append(append([]string{}, match.words...), name)
+	if tok.slot != "" {
+		next.slots = map[string]string{}
+		for slot, value := range match.slots {
+			next.slots[slot] = value
+		}
+		next.slots[tok.slot] = name
+	}
+	if match.pos == 0 {
+		next.start = at
+		next.prob = prob
+	}
+	if prob < next.prob {
+		next.prob = prob
+	}
+	next.last = at
+	return
+}
+
+func (match partialMatch) done() bool {
+	return match.pos == len(match.command.pattern)
+}
+
+func (match partialMatch) event() (event CommandEvent) {
+	event = CommandEvent{
+		Command: match.command.name,
+		Slots:   match.slots,
+		Words:   match.words,
+		Prob:    match.prob,
+		Start:   match.start,
+		End:     match.last,
+	}
+	if event.Slots == nil {
+		event.Slots = map[string]string{}
+	}
+	return
+}
+
+// Matcher finds the commands of a grammar in the stream of results.
+// When one command is the start of another, the longest one heard wins, so the shorter one is only emitted once the longer one can no longer match.
+type Matcher struct {
+	vocab       libaural2.VocabName
+	threshold   float32
+	resetProb   float32
+	timeout     time.Duration
+	commands    []*compiledCommand
+	tokenStates []libaural2.State        // the states used by the commands, in order
+	active      map[libaural2.State]bool // true while the prob of a state has not fallen below resetProb since it was heard.
+	partials    []partialMatch
+	pending     *partialMatch // a complete match which is waiting to see if a longer command matches.
+}
+
+// NewMatcher checks the grammar against the vocabularies, and makes a matcher for it.
+func NewMatcher(grammar Grammar, vocabs map[libaural2.VocabName]*libaural2.Vocabulary) (matcher *Matcher, err error) {
+	vocab, prs := vocabs[grammar.Vocab]
+	if !prs {
+		err = errors.New("unknown vocab " + string(grammar.Vocab))
+		return
+	}
+	matcher = &Matcher{
+		vocab:     grammar.Vocab,
+		threshold: grammar.Threshold,
+		resetProb: grammar.ResetProb,
+		timeout:   2 * time.Second,
+		active:    map[libaural2.State]bool{},
+	}
+	if matcher.threshold == 0 {
+		matcher.threshold = 0.8
+	}
+	if matcher.resetProb == 0 {
+		matcher.resetProb = 0.3
+	}
+	if matcher.resetProb < 0 || matcher.threshold <= matcher.resetProb || matcher.threshold >= 1 {
+		err = errors.New("threshold must be above reset_prob and less then 1")
+		return
+	}
+	if grammar.Timeout != "" {
+		if matcher.timeout, err = time.ParseDuration(grammar.Timeout); err != nil {
+			return
+		}
+	}
+	used := map[libaural2.State]bool{}
+	names := map[string]bool{}
+	for i, command := range grammar.Commands {
+		compiled, err := compileCommand(command, *vocab)
+		if err != nil {
+			return nil, fmt.Errorf("command %d (%s): %v", i, command.Name, err)
+		}
+		if names[command.Name] {
+			return nil, errors.New("command " + command.Name + " is defined twice")
+		}
+		names[command.Name] = true
+		for _, tok := range compiled.pattern {
+			for state := range tok.states {
+				used[state] = true
+			}
+		}
+		matcher.commands = append(matcher.commands, compiled)
+	}
+	for state := range used {
+		matcher.tokenStates = append(matcher.tokenStates, state)
+	}
+	sort.Slice(matcher.tokenStates, func(i, j int) bool { return matcher.tokenStates[i] < matcher.tokenStates[j] })
+	return
+}
+
+func compileCommand(command Command, vocab libaural2.Vocabulary) (compiled *compiledCommand, err error) {
+	if command.Name == "" {
+		err = errors.New("command has no name")
+		return
+	}
+	if len(command.Pattern) == 0 {
+		err = errors.New("command has no pattern")
+		return
+	}
+	compiled = &compiledCommand{name: command.Name}
+	for _, word := range command.Pattern {
+		tok := token{states: map[libaural2.State]string{}}
+		stateNames := []string{word}
+		if strings.HasPrefix(word, "$") {
+			tok.slot = strings.TrimPrefix(word, "$")
+			var prs bool
+			if stateNames, prs = command.Slots[tok.slot]; !prs || len(stateNames) == 0 {
+				err = errors.New("slot " + tok.slot + " has no states")
+				return
+			}
+		}
+		for _, name := range stateNames {
+			state, prs := vocab.StateByName(name)
+			if !prs {
+				err = errors.New(string(vocab.Name) + " has no state " + name)
+				return
+			}
+			tok.states[state] = name
+		}
+		compiled.pattern = append(compiled.pattern, tok)
+	}
+	return
+}
+
+// ParseGrammar parses a JSON grammar, and makes a matcher for it.
+func ParseGrammar(grammarBytes []byte, vocabs map[libaural2.VocabName]*libaural2.Vocabulary) (matcher *Matcher, err error) {
+	var grammar Grammar
+	dec := json.NewDecoder(bytes.NewReader(grammarBytes))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&grammar); err != nil {
+		return
+	}
+	matcher, err = NewMatcher(grammar, vocabs)
+	return
+}
+
+// Word tells the matcher that the word of state was heard at a time.
+func (matcher *Matcher) Word(state libaural2.State, prob float32, at time.Time) (events []CommandEvent) {
+	events = matcher.Tick(at)
+	continued, completed := matcher.advanceAll(matcher.partials, state, prob, at)
+	if completed == nil && len(continued) == 0 { // the word does not carry on any match,
+		if matcher.pending != nil { // so a match waiting for a longer one is now done,
+			events = append(events, matcher.pending.event())
+			matcher.pending = nil
+		}
+		fresh := make([]partialMatch, len(matcher.commands))
+		for i, command := range matcher.commands {
+			fresh[i] = partialMatch{command: command}
+		}
+		continued, completed = matcher.advanceAll(fresh, state, prob, at) // and the word may start a new match.
+	}
+	if completed != nil {
+		matcher.pending = completed
+	}
+	matcher.partials = continued
+	if len(matcher.partials) == 0 && matcher.pending != nil {
+		events = append(events, matcher.pending.event())
+		matcher.pending = nil
+	}
+	return
+}
+
+// advanceAll advances each match which the word matches the next token of, returning those which are complete and those which are not.
+// If more then one is complete, the longest wins.
+func (matcher *Matcher) advanceAll(partials []partialMatch, state libaural2.State, prob float32, at time.Time) (continued []partialMatch, completed *partialMatch) {
+	for _, partial := range partials {
+		next, ok := partial.advance(state, prob, at)
+		if !ok {
+			continue
+		}
+		if !next.done() {
+			continued = append(continued, next)
+		} else if completed == nil || next.pos > completed.pos {
+			completed = &next
+		}
+	}
+	return
+}
+
+// Tick drops the matches which have waited too long for their next word.
+func (matcher *Matcher) Tick(now time.Time) (events []CommandEvent) {
+	var alive []partialMatch
+	for _, partial := range matcher.partials {
+		if now.Sub(partial.last) <= matcher.timeout {
+			alive = append(alive, partial)
+		}
+	}
+	matcher.partials = alive
+	if len(matcher.partials) == 0 && matcher.pending != nil {
+		events = append(events, matcher.pending.event())
+		matcher.pending = nil
+	}
+	return
+}
+
+// Handle finds the words in one result, and passes them to the matcher.
+// A word is heard when its prob rises above the threshold, and can't be heard again until its prob falls below the reset prob.
+func (matcher *Matcher) Handle(result Result, now time.Time) (events []CommandEvent) {
+	probs := result.Probs[matcher.vocab]
+	for _, state := range matcher.tokenStates {
+		if int(state) >= len(probs) { // the model may not have been run yet.
+			continue
+		}
+		prob := probs[state]
+		if prob > matcher.threshold && !matcher.active[state] {
+			matcher.active[state] = true
+			events = append(events, matcher.Word(state, prob, now)...)
+		} else if prob < matcher.resetProb {
+			matcher.active[state] = false
+		}
+	}
+	events = append(events, matcher.Tick(now)...)
+	return
+}
+
+// WatchGrammar loads the grammar in the JSON file at path, and sends the commands the broker hears to commands.
+// Like the rules, the grammar is reloaded whenever the file changes or the process gets SIGHUP. If there is no file, no commands are heard.
+func (eb *EventBroker) WatchGrammar(path string, vocabs map[libaural2.VocabName]*libaural2.Vocabulary, commands chan<- CommandEvent) (err error) {
+	queue := make(chan CommandEvent, 100) // the commands are queued, so that they arrive in order without holding up the broker.
+	go func() {
+		for event := range queue {
+			commands <- event
+		}
+	}()
+	err = watchFile(path, func() (err error) {
+		var matcher *Matcher
+		grammarBytes, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			logger.Println(path, "does not exist, no commands will be heard")
+			err = nil
+		} else if err != nil {
+			return
+		} else if matcher, err = ParseGrammar(grammarBytes, vocabs); err != nil {
+			return
+		} else {
+			logger.Println("loaded", len(matcher.commands), "commands")
+		}
+		eb.mutex.Lock()
+		defer eb.mutex.Unlock()
+		eb.matcher = matcher
+		eb.commands = queue
+		return
+	})
+	return
+}
@@ -0,0 +1,296 @@
+package vsh
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+)
+
+// BuiltinHandlers are the handler types which rules can always use. Their options are given in the options of the rule.
+var BuiltinHandlers = map[string]HandlerMaker{
+	"exec":    makeExecHandler,
+	"webhook": makeWebhookHandler,
+	"mqtt":    makeMQTTHandler,
+}
+
+// Event is what a handler is told of the action it is run for. Templates in the options of handlers are executed on it.
+type Event struct {
+	Name  string              `json:"name"`  // name of the action, such as play0.9
+	Rule  string              `json:"rule"`  // name of the rule
+	Vocab libaural2.VocabName `json:"vocab"` // name of the vocabulary
+	State string              `json:"state"` // name of the state
+	Prob  float32             `json:"prob"`  // prob of the state when the action was run
+	TS    time.Time           `json:"ts"`
+}
+
+// RetryPolicy says how long a handler may take, and how often it is tried if it fails.
+type RetryPolicy struct {
+	Timeout  string `json:"timeout"`  // how long each attempt may take, default 10s
+	Attempts int    `json:"attempts"` // how many times to try, default 3
+	Backoff  string `json:"backoff"`  // how long to wait before the first retry, doubling after each, default 1s
+}
+
+// permanentError is an error which retrying won't fix, such as a 404.
+type permanentError struct {
+	error
+}
+
+// do calls attempt until it succeeds, it fails permanently, or it has been tried policy.Attempts times.
+func (policy RetryPolicy) do(attempt func(ctx context.Context) error) (err error) {
+	timeout, backoff, err := policy.parse()
+	if err != nil {
+		return
+	}
+	attempts := policy.Attempts
+	if attempts == 0 {
+		attempts = 3
+	}
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err = attempt(ctx)
+		cancel()
+		if err == nil {
+			return
+		}
+		if _, ok := err.(permanentError); ok {
+			return
+		}
+	}
+	return
+}
+
+// parse the durations of the policy, filling in defaults.
+func (policy RetryPolicy) parse() (timeout, backoff time.Duration, err error) {
+	timeout = 10 * time.Second
+	backoff = time.Second
+	if policy.Timeout != "" {
+		if timeout, err = time.ParseDuration(policy.Timeout); err != nil {
+			return
+		}
+	}
+	if policy.Backoff != "" {
+		if backoff, err = time.ParseDuration(policy.Backoff); err != nil {
+			return
+		}
+	}
+	if policy.Attempts < 0 {
+		err = errors.New("attempts can't be negative")
+	}
+	return
+}
+
+// decodeOptions decodes the options of a rule for its handler.
+func decodeOptions(rule Rule, options interface{}) (err error) {
+	if len(rule.Options) == 0 {
+		err = errors.New("handler " + rule.Handler + " needs options")
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(rule.Options))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(options)
+	return
+}
+
+// parseTemplates parses each string as a template.
+func parseTemplates(texts ...string) (templates []*template.Template, err error) {
+	for _, text := range texts {
+		tmpl, err := template.New("").Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, tmpl)
+	}
+	return
+}
+
+// executeTemplates executes each template on the event.
+func executeTemplates(templates []*template.Template, event Event) (texts []string, err error) {
+	for _, tmpl := range templates {
+		buf := bytes.Buffer{}
+		if err = tmpl.Execute(&buf, event); err != nil {
+			return
+		}
+		texts = append(texts, buf.String())
+	}
+	return
+}
+
+// makeHandler makes the func of an action which tells send of each event, retrying as the policy says.
+func makeHandler(name string, rule Rule, policy RetryPolicy, send func(ctx context.Context, event Event) error) (handler func(prob float32), err error) {
+	if _, _, err = policy.parse(); err != nil {
+		return
+	}
+	handler = func(prob float32) {
+		event := Event{
+			Name:  name,
+			Rule:  rule.Name,
+			Vocab: rule.Vocab,
+			State: rule.State,
+			Prob:  prob,
+			TS:    time.Now(),
+		}
+		err := policy.do(func(ctx context.Context) error {
+			return send(ctx, event)
+		})
+		if err != nil {
+			logger.Println(rule.Handler, "handler of", name, "failed:", err)
+		}
+	}
+	return
+}
+
+// execOptions are the options of the exec handler, such as {"command": "mpc", "args": ["{{.Rule}}"]}.
+type execOptions struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"` // each arg is a template
+	RetryPolicy
+}
+
+// makeExecHandler makes a handler which runs a command. It fails if the command exits with an error.
+func makeExecHandler(name string, rule Rule) (handler func(prob float32), err error) {
+	var options execOptions
+	if err = decodeOptions(rule, &options); err != nil {
+		return
+	}
+	if options.Command == "" {
+		err = errors.New("exec handler needs a command")
+		return
+	}
+	argTemplates, err := parseTemplates(options.Args...)
+	if err != nil {
+		return
+	}
+	handler, err = makeHandler(name, rule, options.RetryPolicy, func(ctx context.Context, event Event) (err error) {
+		args, err := executeTemplates(argTemplates, event)
+		if err != nil {
+			return permanentError{err}
+		}
+		output, err := exec.CommandContext(ctx, options.Command, args...).CombinedOutput()
+		if err != nil && len(output) > 0 {
+			err = errors.New(err.Error() + ": " + string(output))
+		}
+		return
+	})
+	return
+}
+
+// webhookOptions are the options of the webhook handler, such as {"url": "http://localhost:8080/intent"}.
+type webhookOptions struct {
+	URL     string            `json:"url"`     // a template
+	Headers map[string]string `json:"headers"` // extra headers of the request
+	RetryPolicy
+}
+
+// makeWebhookHandler makes a handler which POSTs the event as JSON. It fails if the response is not 2xx, and does not retry 4xx responses.
+func makeWebhookHandler(name string, rule Rule) (handler func(prob float32), err error) {
+	var options webhookOptions
+	if err = decodeOptions(rule, &options); err != nil {
+		return
+	}
+	if options.URL == "" {
+		err = errors.New("webhook handler needs a url")
+		return
+	}
+	urlTemplates, err := parseTemplates(options.URL)
+	if err != nil {
+		return
+	}
+	handler, err = makeHandler(name, rule, options.RetryPolicy, func(ctx context.Context, event Event) (err error) {
+		urls, err := executeTemplates(urlTemplates, event)
+		if err != nil {
+			return permanentError{err}
+		}
+		body, err := json.Marshal(event)
+		if err != nil {
+			return permanentError{err}
+		}
+		req, err := http.NewRequest("POST", urls[0], bytes.NewReader(body))
+		if err != nil {
+			return permanentError{err}
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for key, value := range options.Headers {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body) // so that the connection can be reused.
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			err = errors.New("webhook returned " + resp.Status)
+			if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+				err = permanentError{err}
+			}
+		}
+		return
+	})
+	return
+}
+
+// mqttOptions are the options of the mqtt handler, such as {"broker": "localhost:1883", "topic": "aural2/{{.Vocab}}/{{.State}}"}.
+type mqttOptions struct {
+	Broker   string `json:"broker"`    // host:port of the broker, the port defaulting to 1883
+	Topic    string `json:"topic"`     // a template
+	Payload  string `json:"payload"`   // a template, the event as JSON if empty
+	QoS      byte   `json:"qos"`       // 0 or 1
+	Retain   bool   `json:"retain"`    // if the broker should keep the message for new subscribers
+	ClientID string `json:"client_id"` // empty to have the broker choose one
+	Username string `json:"username"`
+	Password string `json:"password"` // MQTT 3.1.1 allows a password only with a username
+	RetryPolicy
+}
+
+// makeMQTTHandler makes a handler which publishes the event to an MQTT topic, connecting to the broker each time.
+func makeMQTTHandler(name string, rule Rule) (handler func(prob float32), err error) {
+	var options mqttOptions
+	if err = decodeOptions(rule, &options); err != nil {
+		return
+	}
+	if options.Broker == "" || options.Topic == "" {
+		err = errors.New("mqtt handler needs a broker and a topic")
+		return
+	}
+	if options.QoS > 1 {
+		err = errors.New("mqtt handler supports QoS 0 and 1, not " + strconv.Itoa(int(options.QoS)))
+		return
+	}
+	if options.Password != "" && options.Username == "" { // brokers drop the connection, so every retry would fail.
+		err = errors.New("mqtt handler needs a username with a password")
+		return
+	}
+	templates, err := parseTemplates(options.Topic, options.Payload)
+	if err != nil {
+		return
+	}
+	handler, err = makeHandler(name, rule, options.RetryPolicy, func(ctx context.Context, event Event) (err error) {
+		texts, err := executeTemplates(templates, event)
+		if err != nil {
+			return permanentError{err}
+		}
+		payload := []byte(texts[1])
+		if options.Payload == "" {
+			if payload, err = json.Marshal(event); err != nil {
+				return permanentError{err}
+			}
+		}
+		err = publishMQTT(ctx, options, texts[0], payload)
+		return
+	})
+	return
+}
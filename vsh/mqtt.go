@@ -0,0 +1,155 @@
+package vsh
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// MQTT 3.1.1 packet types, shifted into the high nibble of the first byte of the packet.
+const (
+	mqttConnect    = 1 << 4
+	mqttConnack    = 2 << 4
+	mqttPublish    = 3 << 4
+	mqttPuback     = 4 << 4
+	mqttDisconnect = 14 << 4
+)
+
+// mqttPacket is an MQTT control packet.
+type mqttPacket struct {
+	header byte // the packet type and its flags
+	body   []byte
+}
+
+// write the packet, with its remaining length.
+func (packet mqttPacket) write(writer io.Writer) (err error) {
+	buf := []byte{packet.header}
+	length := len(packet.body)
+	for { // the remaining length is 7 bits per byte, least significant first, the top bit set if more bytes follow.
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 128
+		}
+		buf = append(buf, digit)
+		if length == 0 {
+			break
+		}
+	}
+	_, err = writer.Write(append(buf, packet.body...))
+	return
+}
+
+// readMQTTPacket reads one packet.
+func readMQTTPacket(reader *bufio.Reader) (packet mqttPacket, err error) {
+	if packet.header, err = reader.ReadByte(); err != nil {
+		return
+	}
+	var length int
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			err = errors.New("malformed MQTT remaining length")
+			return
+		}
+		var digit byte
+		if digit, err = reader.ReadByte(); err != nil {
+			return
+		}
+		length |= int(digit&127) << shift
+		if digit&128 == 0 {
+			break
+		}
+	}
+	packet.body = make([]byte, length)
+	_, err = io.ReadFull(reader, packet.body)
+	return
+}
+
+// mqttString encodes a string as MQTT does, prefixed with its length.
+func mqttString(s string) (encoded []byte) {
+	encoded = make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(encoded, uint16(len(s)))
+	return append(encoded, s...)
+}
+
+// publishMQTT connects to the broker, publishes one message, and disconnects.
+// It is not a full client: it publishes with QoS 0 or 1, and never subscribes.
+func publishMQTT(ctx context.Context, options mqttOptions, topic string, payload []byte) (err error) {
+	addr := strings.TrimPrefix(options.Broker, "tcp://")
+	if _, _, splitErr := net.SplitHostPort(addr); splitErr != nil {
+		addr = net.JoinHostPort(addr, "1883")
+	}
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	reader := bufio.NewReader(conn)
+
+	connect := append(mqttString("MQTT"), 4) // protocol level 4 is MQTT 3.1.1
+	var flags byte = 0x02                    // clean session
+	if options.Username != "" {
+		flags |= 0x80
+	}
+	if options.Password != "" {
+		flags |= 0x40
+	}
+	connect = append(connect, flags, 0, 60) // keep alive of 60 seconds
+	connect = append(connect, mqttString(options.ClientID)...)
+	if options.Username != "" {
+		connect = append(connect, mqttString(options.Username)...)
+	}
+	if options.Password != "" {
+		connect = append(connect, mqttString(options.Password)...)
+	}
+	if err = (mqttPacket{header: mqttConnect, body: connect}).write(conn); err != nil {
+		return
+	}
+	connack, err := readMQTTPacket(reader)
+	if err != nil {
+		return
+	}
+	if connack.header != mqttConnack || len(connack.body) != 2 {
+		err = errors.New("expected CONNACK from MQTT broker")
+		return
+	}
+	if code := connack.body[1]; code != 0 {
+		err = permanentError{errors.New("MQTT broker refused connection with code " + strconv.Itoa(int(code)))}
+		return
+	}
+
+	header := byte(mqttPublish) | options.QoS<<1
+	if options.Retain {
+		header |= 0x01
+	}
+	publish := mqttString(topic)
+	const packetID = 1 // only one message is sent on each connection.
+	if options.QoS == 1 {
+		publish = append(publish, 0, packetID)
+	}
+	publish = append(publish, payload...)
+	if err = (mqttPacket{header: header, body: publish}).write(conn); err != nil {
+		return
+	}
+	if options.QoS == 1 {
+		var puback mqttPacket
+		if puback, err = readMQTTPacket(reader); err != nil {
+			return
+		}
+		if puback.header != mqttPuback || len(puback.body) != 2 || puback.body[1] != packetID {
+			err = errors.New("expected PUBACK from MQTT broker")
+			return
+		}
+	}
+	err = (mqttPacket{header: mqttDisconnect}).write(conn)
+	return
+}
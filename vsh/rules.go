@@ -0,0 +1,230 @@
+package vsh
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+)
+
+// RulesPollInterval is how often WatchRules and WatchGrammar check if their file has changed.
+var RulesPollInterval = 2 * time.Second
+
+// Rule maps a state of a vocabulary to actions, one for each of its thresholds.
+type Rule struct {
+	Name       string              `json:"name"`               // each action is named the name followed by its threshold, such as play0.9
+	Action     string              `json:"action,omitempty"`   // if set, the name of the action of a rule with one threshold, so that it does not change with the threshold
+	Vocab      libaural2.VocabName `json:"vocab"`              // name of the vocabulary
+	State      string              `json:"state"`              // name of the state in the vocabulary, such as PlayMusic
+	Thresholds []float32           `json:"thresholds"`         // an action is run when the prob of the state rises above each of these.
+	ResetProb  float32             `json:"reset_prob"`         // how low the prob must fall for the utterance to have ended
+	Cooldown   string              `json:"cooldown,omitempty"` // how long after running the action it can't run again, such as "10s"
+	Confirm    string              `json:"confirm,omitempty"`  // if set, the user must confirm the action within this long, such as "5s", before it is run.
+	Handler    string              `json:"handler"`            // type of the handler to run
+	Options    json.RawMessage     `json:"options,omitempty"`  // options of the handler, such as the command of an exec handler
+}
+
+// HandlerMaker makes the func run by the action named name of a rule.
+type HandlerMaker func(name string, rule Rule) (handler func(prob float32), err error)
+
+// ActionName is the name of the action of a rule for one of its thresholds.
+func (rule Rule) ActionName(threshold float32) string {
+	if rule.Action != "" {
+		return rule.Action
+	}
+	return rule.Name + strconv.FormatFloat(float64(threshold), 'f', -1, 32)
+}
+
+// actions makes the actions of the rule, checking it against the vocabularies and handler types.
+func (rule Rule) actions(vocabs map[libaural2.VocabName]*libaural2.Vocabulary, makers map[string]HandlerMaker) (actions map[actionKey]*Action, err error) {
+	if rule.Name == "" {
+		err = errors.New("rule has no name")
+		return
+	}
+	vocab, prs := vocabs[rule.Vocab]
+	if !prs {
+		err = errors.New("unknown vocab " + string(rule.Vocab))
+		return
+	}
+	state, prs := vocab.StateByName(rule.State)
+	if !prs {
+		err = errors.New(string(rule.Vocab) + " has no state " + rule.State)
+		return
+	}
+	if len(rule.Thresholds) == 0 {
+		err = errors.New("rule has no thresholds")
+		return
+	}
+	if rule.Action != "" && len(rule.Thresholds) != 1 {
+		err = errors.New("action can only be given for a rule with one threshold, as each threshold needs an action of its own")
+		return
+	}
+	if rule.ResetProb < 0 || rule.ResetProb >= 1 {
+		err = errors.New("reset_prob must be at least 0 and less then 1")
+		return
+	}
+	var cooldown time.Duration
+	if rule.Cooldown != "" {
+		if cooldown, err = time.ParseDuration(rule.Cooldown); err != nil {
+			return
+		}
+	}
+	var confirmWindow time.Duration
+	if rule.Confirm != "" {
+		if confirmWindow, err = time.ParseDuration(rule.Confirm); err != nil {
+			return
+		}
+		if confirmWindow <= 0 {
+			err = errors.New("confirm must be positive")
+			return
+		}
+	}
+	maker, prs := makers[rule.Handler]
+	if !prs {
+		err = errors.New("unknown handler " + rule.Handler)
+		return
+	}
+	actions = map[actionKey]*Action{}
+	for _, threshold := range rule.Thresholds {
+		if threshold <= rule.ResetProb || threshold >= 1 {
+			err = fmt.Errorf("threshold %v must be above reset_prob and less then 1", threshold)
+			return
+		}
+		name := rule.ActionName(threshold)
+		key := actionKey{VocabName: rule.Vocab, State: state, Name: name}
+		if _, prs := actions[key]; prs {
+			err = fmt.Errorf("threshold %v is given twice", threshold)
+			return
+		}
+		var handler func(float32)
+		if handler, err = maker(name, rule); err != nil {
+			return
+		}
+		actions[key] = &Action{
+			MinActivationProb: threshold,
+			MaxResetProb:      rule.ResetProb,
+			CoolDownDuration:  cooldown,
+			coolDownFromStart: true, // actions can't run for the cooldown after the rules are loaded, by the clock of the broker, which may be simulated.
+			HandlerFunction:   handler,
+			ConfirmWindow:     confirmWindow,
+		}
+	}
+	return
+}
+
+// ParseRules parses a JSON list of rules, and checks them against the vocabularies and handler types.
+func ParseRules(rulesBytes []byte, vocabs map[libaural2.VocabName]*libaural2.Vocabulary, makers map[string]HandlerMaker) (rules []Rule, err error) {
+	dec := json.NewDecoder(bytes.NewReader(rulesBytes))
+	dec.DisallowUnknownFields() // a misspelled field should not silently fall back to its zero value.
+	if err = dec.Decode(&rules); err != nil {
+		return
+	}
+	_, err = compileRules(rules, vocabs, makers)
+	return
+}
+
+// compileRules makes the actions of all the rules.
+func compileRules(rules []Rule, vocabs map[libaural2.VocabName]*libaural2.Vocabulary, makers map[string]HandlerMaker) (actions map[actionKey]*Action, err error) {
+	actions = map[actionKey]*Action{}
+	for i, rule := range rules {
+		ruleActions, err := rule.actions(vocabs, makers)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %v", i, rule.Name, err)
+		}
+		for key, action := range ruleActions {
+			if _, prs := actions[key]; prs {
+				return nil, fmt.Errorf("rule %d (%s): action %s is defined twice", i, rule.Name, key.Name)
+			}
+			actions[key] = action
+		}
+	}
+	return
+}
+
+// LoadRules replaces the actions of the rules last loaded with the actions of rules.
+// Actions registered with Register are kept. If the rules are bad, the actions are not changed.
+func (eb *EventBroker) LoadRules(rules []Rule, vocabs map[libaural2.VocabName]*libaural2.Vocabulary, makers map[string]HandlerMaker) (err error) {
+	actions, err := compileRules(rules, vocabs, makers)
+	if err != nil {
+		return
+	}
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+	for _, key := range eb.ruleKeys {
+		delete(eb.handlers, key)
+	}
+	eb.ruleKeys = nil
+	for key, action := range actions {
+		eb.handlers[key] = action
+		eb.ruleKeys = append(eb.ruleKeys, key)
+	}
+	return
+}
+
+// WatchRules loads the rules in the JSON file at path, or defaults if there is no file,
+// then reloads them whenever the file changes or the process gets SIGHUP.
+// If the rules can't be reloaded, the error is logged and the old rules kept.
+func (eb *EventBroker) WatchRules(path string, defaults []Rule, vocabs map[libaural2.VocabName]*libaural2.Vocabulary, makers map[string]HandlerMaker) (err error) {
+	err = watchFile(path, func() (err error) {
+		rules := defaults
+		rulesBytes, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			logger.Println(path, "does not exist, using default rules")
+		} else if err != nil {
+			return
+		} else if rules, err = ParseRules(rulesBytes, vocabs, makers); err != nil {
+			return
+		}
+		if err = eb.LoadRules(rules, vocabs, makers); err != nil {
+			return
+		}
+		logger.Println("loaded", len(rules), "rules")
+		return
+	})
+	return
+}
+
+// watchFile calls load, then calls it again whenever the file at path changes or the process gets SIGHUP.
+// Only the error of the first load is returned, later errors are logged.
+func watchFile(path string, load func() error) (err error) {
+	modTime := func() (t time.Time) {
+		if info, err := os.Stat(path); err == nil {
+			t = info.ModTime()
+		}
+		return
+	}
+	lastModTime := modTime()
+	if err = load(); err != nil {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		ticker := time.NewTicker(RulesPollInterval)
+		for {
+			select {
+			case <-hup:
+				logger.Println("got SIGHUP, reloading", path)
+			case <-ticker.C:
+				if !modTime().Equal(lastModTime) {
+					logger.Println(path, "changed, reloading")
+					break
+				}
+				continue
+			}
+			lastModTime = modTime()
+			if err := load(); err != nil {
+				logger.Println("keeping the old config, can't load", path, ":", err)
+			}
+		}
+	}()
+	return
+}
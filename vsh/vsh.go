@@ -11,9 +11,9 @@ import (
 	"time"
 
 	tf "github.com/tensorflow/tensorflow/tensorflow/go"
-	"github.com/tensorflow/tensorflow/tensorflow/go/op"
+	"github.ibm.com/Blue-Horizon/aural2/features"
 	"github.ibm.com/Blue-Horizon/aural2/libaural2"
-	"github.ibm.com/Blue-Horizon/aural2/tfutils"
+	"github.ibm.com/Blue-Horizon/aural2/vad"
 )
 
 const outputname = "evaluation/softmax/output"
@@ -57,43 +57,36 @@ func Argmax(probs []float32) (state libaural2.State, prob float32) {
 	return
 }
 
-func makeComputeMFCCgraph() (computeMFCC func([]byte) (*tf.Tensor, error), err error) {
-	s := op.NewScope()
-	rawBytesPH, pcm := tfutils.ParseRawBytesToPCM(s)
-	mfccOP, sampleRatePH := tfutils.ComputeMFCC(s.SubScope("spectrogram"), pcm)
-	dim := op.Const(s, int32(0))
-	expanded := op.ExpandDims(s, mfccOP, dim)
-	sampleRateTensor, err := tf.NewTensor(int32(libaural2.SampleRate))
-	if err != nil {
+// makeComputeFeatures returns a func which computes the features of one stride of raw audio, as a tensor sutable for step inference.
+// It carries state from one stride to the next, so each stream of audio needs its own.
+func makeComputeFeatures(config features.Config) (computeFeatures func([]byte) (*tf.Tensor, error), err error) {
+	if err = config.Validate(); err != nil {
 		return
 	}
-	graph, err := s.Finalize() // finalize the scope to get the graph
-	if err != nil {
-		return
-	}
-	sess, err := tf.NewSession(graph, nil) // start a new TF session
-	if err != nil {
-		return
-	}
-	computeMFCC = func(rawBytes []byte) (mfccTensor *tf.Tensor, err error) {
-		rawBytesTensor, err := tf.NewTensor(string(rawBytes[:])) // create a string tensor from the input bytes
-		if err != nil {
+	stream := config.NewStream()
+	computeFeatures = func(rawBytes []byte) (featuresTensor *tf.Tensor, err error) {
+		if len(rawBytes) != libaural2.StrideWidth*2 {
+			err = errors.New("bad stride length")
 			return
 		}
-		result, err := sess.Run(map[tf.Output]*tf.Tensor{rawBytesPH: rawBytesTensor, sampleRatePH: sampleRateTensor}, []tf.Output{expanded}, nil)
-		if err != nil {
+		featuresTensor, err = tf.NewTensor([][][]float32{[][]float32{stream.Step(features.PCMFromInt16LE(rawBytes))}})
+		return
+	}
+	return
+}
+
+// readStrides reads whole strides of raw audio from the reader, calling handle on each, until the reader fails or handle returns false.
+// A net.Conn may return less then a stride from each read, so strides are read with io.ReadFull to keep them aligned with the strides of the clips we train on.
+func readStrides(reader io.Reader, handle func(stride []byte) bool) (err error) {
+	buf := make([]byte, libaural2.StrideWidth*2)
+	for {
+		if _, err = io.ReadFull(reader, buf); err != nil {
 			return
 		}
-		//logger.Println(result[0].Shape())
-		//logger.Println(result[0].Value())
-		if result[0].Shape()[0] != 1 {
-			err = errors.New("bad shape")
+		if !handle(buf) {
 			return
 		}
-		mfccTensor = result[0]
-		return
 	}
-	return
 }
 
 func uploadClip(clip *libaural2.AudioClip) (err error) {
@@ -101,49 +94,168 @@ func uploadClip(clip *libaural2.AudioClip) (err error) {
 	return
 }
 
+// SilencePolicy says what vsh does with the models while the VAD hears no speech.
+type SilencePolicy string
+
+const (
+	// RunInSilence runs the models on every stride, as if there were no VAD.
+	RunInSilence SilencePolicy = "run"
+	// DownweightSilence runs the models on every stride, but in silence moves their probabilities toward the Nil state, so that noise is less likely to trigger actions.
+	DownweightSilence SilencePolicy = "downweight"
+	// SkipSilence only runs the models on speech, to save CPU. In silence, every vocab is reported to be in the Nil state.
+	// The models do not see the silence betwene utterances, so their state carries over from one utterance to the next.
+	SkipSilence SilencePolicy = "skip"
+)
+
+// VAD configures voice activity detection. The zero value is no VAD, so every stride is speech.
+type VAD struct {
+	Gate    *vad.Gate     // decides which strides are speech. nil for no VAD.
+	Policy  SilencePolicy // what to do with the models in silence. "" is RunInSilence.
+	Weight  float32       // for DownweightSilence, how much of the probabilities of the models to keep in silence.
+	PreRoll int           // for SkipSilence, how many strides from before the start of speech to run the models on, as the VAD notices speech a little late.
+}
+
+// Result is the output of vsh for one stride of audio.
+type Result struct {
+	Probs      map[libaural2.VocabName][]float32 // the probability of each state of each vocab.
+	Speech     bool                              // true if the VAD thinks the stride is speech.
+	SpeechProb float32                           // the probability of speech given by the VAD.
+	Audio      []byte                            // the raw audio of the stride, 16 kHz mono S16_LE.
+}
+
+// nilProbs returns probabilities of size states, all in the Nil state.
+func nilProbs(size int) (probs []float32) {
+	probs = make([]float32, size)
+	if size > int(libaural2.Nil) {
+		probs[libaural2.Nil] = 1
+	}
+	return
+}
+
+// downweight keeps weight of the probabilities, moving the rest to the Nil state.
+func downweight(probs []float32, weight float32) (weighted []float32) {
+	weighted = make([]float32, len(probs))
+	for i, prob := range probs {
+		weighted[i] = prob * weight
+	}
+	if len(weighted) > int(libaural2.Nil) {
+		weighted[libaural2.Nil] += 1 - weight
+	}
+	return
+}
+
 // Init takes a reader of raw audio, and returns a chan of outputs.
 func Init(
 	reader io.Reader,
 	stepInferenceFuncs map[libaural2.VocabName]func(*tf.Tensor) ([]float32, error),
-) (result chan map[libaural2.VocabName][]float32,
+	featureConfigs map[libaural2.VocabName]features.Config, // the features each vocab's model takes. Vocabs not in the map take features.DefaultConfig.
+	vadConfig VAD,
+) (result chan Result,
 	dump func() *libaural2.AudioClip,
 	err error,
 ) {
 	rb := makeRing()
 	dump = rb.dump
-	result = make(chan map[libaural2.VocabName][]float32)
-	computeMFCC, err := makeComputeMFCCgraph()
-	if err != nil {
-		return
+	result, err = start(reader, stepInferenceFuncs, featureConfigs, vadConfig, rb.write, func(err error) {
+		logger.Println(err)
+		panic("connection to mic is broken")
+	})
+	return
+}
+
+// Replay takes a reader of recorded raw audio, and returns a chan of outputs, as Init does for a microphone.
+// At the end of the audio, the chan is closed. A trailing part of a stride is dropped.
+func Replay(
+	reader io.Reader,
+	stepInferenceFuncs map[libaural2.VocabName]func(*tf.Tensor) ([]float32, error),
+	featureConfigs map[libaural2.VocabName]features.Config,
+	vadConfig VAD,
+) (result chan Result, err error) {
+	result, err = start(reader, stepInferenceFuncs, featureConfigs, vadConfig, func([]byte) {}, func(err error) {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			logger.Println(err)
+		}
+	})
+	return
+}
+
+// start runs the models on each stride of the audio, passing each stride to write, and calling end with the error which stopped the reading of the audio.
+func start(
+	reader io.Reader,
+	stepInferenceFuncs map[libaural2.VocabName]func(*tf.Tensor) ([]float32, error),
+	featureConfigs map[libaural2.VocabName]features.Config,
+	vadConfig VAD,
+	write func([]byte),
+	end func(error),
+) (result chan Result, err error) {
+	result = make(chan Result)
+	computeFeaturesFuncs := map[libaural2.VocabName]func([]byte) (*tf.Tensor, error){}
+	for vocabName := range stepInferenceFuncs {
+		config, prs := featureConfigs[vocabName]
+		if !prs {
+			config = features.DefaultConfig
+		}
+		computeFeaturesFuncs[vocabName], err = makeComputeFeatures(config)
+		if err != nil {
+			return
+		}
 	}
-	buf := make([]byte, libaural2.StrideWidth*2)
 	go func() {
-		var iters int
-		for {
-			iters++
-			_, err := reader.Read(buf)
-			if err != nil {
-				logger.Println(err)
-				close(result)
-				panic("connection to mic is broken")
+		preRolls := map[libaural2.VocabName][]*tf.Tensor{} // the features of the latest strides of silence, for SkipSilence.
+		sizes := map[libaural2.VocabName]int{}             // the number of states of each vocab, as learned from the outputs of its model.
+		err := readStrides(reader, func(stride []byte) bool {
+			write(stride)
+			strideResult := Result{
+				Probs:      map[libaural2.VocabName][]float32{},
+				Speech:     true,
+				SpeechProb: 1,
+				Audio:      append([]byte{}, stride...), // the buffer of stride is reused.
 			}
-			rb.write(buf)
-			mfccTensor, err := computeMFCC(buf)
-			if err != nil {
-				logger.Println(err)
-				close(result)
-				return
+			if vadConfig.Gate != nil {
+				var err error
+				strideResult.Speech, strideResult.SpeechProb, err = vadConfig.Gate.Step(features.PCMFromInt16LE(stride))
+				if err != nil {
+					logger.Println(err)
+					return false
+				}
 			}
-			probsMap := map[libaural2.VocabName][]float32{}
 			for vocabName, stepInference := range stepInferenceFuncs {
-				probsMap[vocabName], err = stepInference(mfccTensor)
+				featuresTensor, err := computeFeaturesFuncs[vocabName](stride) // features are computed even in silence, to keep the context of the feature stream.
+				if err != nil {
+					logger.Println(err)
+					return false
+				}
+				if !strideResult.Speech && vadConfig.Policy == SkipSilence {
+					preRolls[vocabName] = append(preRolls[vocabName], featuresTensor)
+					if len(preRolls[vocabName]) > vadConfig.PreRoll {
+						preRolls[vocabName] = preRolls[vocabName][1:]
+					}
+					strideResult.Probs[vocabName] = nilProbs(sizes[vocabName])
+					continue
+				}
+				for _, preRollTensor := range preRolls[vocabName] { // catch up on the start of the speech,
+					if _, err = stepInference(preRollTensor); err != nil {
+						logger.Fatalln(err)
+					}
+				}
+				delete(preRolls, vocabName)
+				probs, err := stepInference(featuresTensor) // and run the model on this stride.
 				if err != nil {
 					logger.Fatalln(err)
 				}
+				sizes[vocabName] = len(probs)
+				if !strideResult.Speech && vadConfig.Policy == DownweightSilence {
+					probs = downweight(probs, vadConfig.Weight)
+				}
+				strideResult.Probs[vocabName] = probs
 			}
-			result <- probsMap
-		}
+			result <- strideResult
+			return true
+		})
 		close(result)
+		if err != nil {
+			end(err)
+		}
 	}()
 	return
 }
@@ -167,20 +279,30 @@ type Action struct {
 	CoolDownDuration  time.Duration      // how long after the utterance can a new utterance start?
 	TimeLastCalled    time.Time          // when was the handlerFunc last called?
 	ended             bool               // false if still in word, true if not continued.
+	coolDownFromStart bool               // if true, the cooldown starts at the first step, as if the action had just been called.
 	HandlerFunction   func(prob float32) // the func to be called when activated.
+	ConfirmWindow     time.Duration      // if not 0, the handler is only called if the user confirms within this long.
 }
 
-func (action *Action) run(prob float32, name string) {
+// step returns true if the action should be activated by the prob.
+func (action *Action) step(prob float32, now time.Time) (activated bool) {
+	if action.coolDownFromStart {
+		action.coolDownFromStart = false
+		if action.CoolDownDuration > 0 {
+			action.TimeLastCalled = now
+		}
+	}
 	if prob > action.MinActivationProb && // if prob is high,
-		action.TimeLastCalled.Add(action.CoolDownDuration).Before(time.Now()) && // and it's not too soon
+		action.TimeLastCalled.Add(action.CoolDownDuration).Before(now) && // and it's not too soon
 		action.ended { // and the action is ended
 		action.ended = false
-		action.TimeLastCalled = time.Now()
-		go action.HandlerFunction(prob)
+		action.TimeLastCalled = now
+		activated = true
 	}
 	if prob < action.MaxResetProb && !action.ended {
 		action.ended = true
 	}
+	return
 }
 
 type actionKey struct {
@@ -193,13 +315,36 @@ type actionKey struct {
 type EventBroker struct {
 	mutex    sync.Mutex
 	handlers map[actionKey]*Action
+	ruleKeys []actionKey // the actions which were loaded from rules, to be replaced when the rules are reloaded.
+	matcher  *Matcher    // finds the commands of the grammar, nil if there is none.
+	commands chan<- CommandEvent
+	confirm  confirmer // asks the user to confirm actions which need it.
+	onAction func(ActionEvent)
+}
+
+// ActionEvent tells that an action ran.
+type ActionEvent struct {
+	Action string              `json:"action"` // name of the action
+	Vocab  libaural2.VocabName `json:"vocab"`
+	State  libaural2.State     `json:"state"`
+	Prob   float32             `json:"prob"` // the prob which activated the action
+	TS     time.Time           `json:"ts"`   // when the result which ran it was handled, or the action was confirmed
+}
+
+// OnAction sets a func to be called each time an action runs, such as to log what the broker did.
+// It is called with the broker locked, so it must not block, or call the broker.
+func (eb *EventBroker) OnAction(onAction func(ActionEvent)) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+	eb.onAction = onAction
 }
 
 // NewEventBroker makes a new event broker from a chan of results
-func NewEventBroker(resultsChan chan map[libaural2.VocabName][]float32) (eb EventBroker) {
-	eb = EventBroker{
+func NewEventBroker(resultsChan chan Result) (eb *EventBroker) {
+	eb = &EventBroker{
 		mutex:    sync.Mutex{},
 		handlers: map[actionKey]*Action{},
+		confirm:  confirmer{Confirmation: DefaultConfirmation},
 	}
 	go func() {
 		for results := range resultsChan {
@@ -224,10 +369,47 @@ func (eb *EventBroker) Unregister(vocab libaural2.VocabName, state libaural2.Sta
 }
 
 // Handle takes one result and passes it on to the actions
-func (eb *EventBroker) Handle(results map[libaural2.VocabName][]float32) {
+func (eb *EventBroker) Handle(result Result) {
+	eb.HandleAt(result, time.Now())
+}
+
+// HandleAt takes one result as if it were heard at now, so that recorded audio can be replayed in simulated time.
+func (eb *EventBroker) HandleAt(result Result, now time.Time) {
 	eb.mutex.Lock()
 	defer eb.mutex.Unlock()
+	if confirmed := eb.confirm.step(result, now); confirmed != nil { // an action waiting for confirmation may be confirmed or cancelled by this result.
+		eb.run(confirmed.key, confirmed.action, confirmed.prob, now)
+	}
 	for key, action := range eb.handlers {
-		go action.run(results[key.VocabName][key.State], key.Name)
+		probs := result.Probs[key.VocabName]
+		if int(key.State) >= len(probs) { // the model may not have been run yet.
+			continue
+		}
+		prob := probs[key.State]
+		if !action.step(prob, now) {
+			continue
+		}
+		if action.ConfirmWindow > 0 {
+			eb.confirm.ask(key, action, prob, now)
+			continue
+		}
+		eb.run(key, action, prob, now)
+	}
+	if eb.matcher != nil {
+		for _, event := range eb.matcher.Handle(result, now) {
+			select {
+			case eb.commands <- event:
+			default:
+				logger.Println("commands are not being read, dropping", event.Command)
+			}
+		}
+	}
+}
+
+// run the handler of an action.
+func (eb *EventBroker) run(key actionKey, action *Action, prob float32, now time.Time) {
+	go action.HandlerFunction(prob)
+	if eb.onAction != nil {
+		eb.onAction(ActionEvent{Action: key.Name, Vocab: key.VocabName, State: key.State, Prob: prob, TS: now})
 	}
 }
@@ -1,12 +1,30 @@
 package vsh
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	tf "github.com/tensorflow/tensorflow/tensorflow/go"
+	"github.ibm.com/Blue-Horizon/aural2/decode"
+	"github.ibm.com/Blue-Horizon/aural2/features"
 	"github.ibm.com/Blue-Horizon/aural2/libaural2"
+	"github.ibm.com/Blue-Horizon/aural2/vad"
+	"github.ibm.com/Blue-Horizon/aural2/vsh/intent"
+	"github.ibm.com/Blue-Horizon/aural2/vsh/word"
 )
 
 func TestRing(t *testing.T) {
@@ -26,3 +44,787 @@ func TestRing(t *testing.T) {
 	fmt.Println(len(clip))
 	ioutil.WriteFile("outclip.raw", clip[:], 0644)
 }
+
+// TestLiveMatchesBatch checks that features computed live, a stride at a time from a reader which returns short reads, are the same as those computed from the whole recording, as for training.
+func TestLiveMatchesBatch(t *testing.T) {
+	rawBytes, err := ioutil.ReadFile("testaudio.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawBytes = rawBytes[:len(rawBytes)/(libaural2.StrideWidth*2)*libaural2.StrideWidth*2] // only whole strides can be read live.
+	for _, config := range []features.Config{
+		features.DefaultConfig,
+		{NumMFCC: 13, Deltas: 2, Normalization: features.RunningNormalization, WindowSize: 2 * libaural2.StrideWidth},
+		{LogMel: true, WindowSize: 3 * libaural2.StrideWidth},
+	} {
+		computeFeatures, err := makeComputeFeatures(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		live := [][]float32{}
+		err = readStrides(iotest.HalfReader(bytes.NewReader(rawBytes)), func(stride []byte) bool {
+			featuresTensor, err := computeFeatures(stride)
+			if err != nil {
+				t.Fatal(err)
+			}
+			live = append(live, featuresTensor.Value().([][][]float32)[0][0])
+			return true
+		})
+		if err != io.EOF {
+			t.Fatal("expected EOF, got", err)
+		}
+		batch := config.Compute(features.PCMFromInt16LE(rawBytes))
+		if len(live) != len(batch) {
+			t.Fatal(config, "live gave", len(live), "frames, batch gave", len(batch))
+		}
+		for i := range batch {
+			for j := range batch[i] {
+				if live[i][j] != batch[i][j] {
+					t.Fatal(config, "frame", i, "feature", j, "live:", live[i][j], "batch:", batch[i][j])
+				}
+			}
+		}
+	}
+}
+
+// stridesDetector is a vad.Detector which hears speech in strides start to end.
+type stridesDetector struct {
+	i, start, end int
+}
+
+func (detector *stridesDetector) Step(samples []float32) (prob float32, err error) {
+	if detector.i >= detector.start && detector.i < detector.end {
+		prob = 1
+	}
+	detector.i++
+	return
+}
+
+func TestVAD(t *testing.T) {
+	for _, policy := range []SilencePolicy{RunInSilence, DownweightSilence, SkipSilence} {
+		reader, writer := io.Pipe()
+		go writer.Write(make([]byte, 40*libaural2.StrideWidth*2)) // the pipe is never closed, as Init panics when the audio ends.
+		var calls int
+		stepInference := func(*tf.Tensor) ([]float32, error) {
+			calls++
+			return []float32{0.2, 0.8}, nil
+		}
+		vadConfig := VAD{
+			Gate:    vad.NewGate(&stridesDetector{start: 10, end: 20}, 0.5, 0),
+			Policy:  policy,
+			Weight:  0.5,
+			PreRoll: 3,
+		}
+		results, _, err := Init(reader, map[libaural2.VocabName]func(*tf.Tensor) ([]float32, error){"intent": stepInference}, nil, vadConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 40; i++ {
+			result := <-results
+			if result.Speech != (i >= 10 && i < 20) {
+				t.Fatal(policy, "stride", i, "should not be speech:", result.Speech)
+			}
+			probs := result.Probs["intent"]
+			switch {
+			case result.Speech || policy == RunInSilence:
+				if probs[1] != 0.8 {
+					t.Fatal(policy, "stride", i, "should have the probs of the model, got", probs)
+				}
+			case policy == DownweightSilence:
+				if probs[0] != 0.6 || probs[1] != 0.4 {
+					t.Fatal(policy, "stride", i, "should be downweighted toward Nil, got", probs)
+				}
+			case i < 10:
+				if len(probs) != 0 {
+					t.Fatal(policy, "stride", i, "should have no probs before the model has been run, got", probs)
+				}
+			default:
+				if probs[0] != 1 || probs[1] != 0 {
+					t.Fatal(policy, "stride", i, "should be Nil, got", probs)
+				}
+			}
+		}
+		expectedCalls := 40
+		if policy == SkipSilence {
+			expectedCalls = 10 + vadConfig.PreRoll
+		}
+		if calls != expectedCalls {
+			t.Fatal(policy, "expected", expectedCalls, "calls of the model, got", calls)
+		}
+	}
+}
+
+var testVocabs = map[libaural2.VocabName]*libaural2.Vocabulary{
+	"intent": &libaural2.Vocabulary{
+		Name:  "intent",
+		Size:  3,
+		Names: map[libaural2.State]string{0: "Nil", 1: "PlayMusic", 2: "PauseMusic"},
+	},
+}
+
+// makeCountingMakers makes handler makers whose handlers count how many times each action is run.
+func makeCountingMakers() (makers map[string]HandlerMaker, counts chan string) {
+	counts = make(chan string, 100)
+	makers = map[string]HandlerMaker{
+		"count": func(name string, rule Rule) (handler func(float32), err error) {
+			handler = func(float32) {
+				counts <- name
+			}
+			return
+		},
+	}
+	return
+}
+
+func TestParseRules(t *testing.T) {
+	makers, _ := makeCountingMakers()
+	rules, err := ParseRules([]byte(`[{"name": "play", "vocab": "intent", "state": "PlayMusic", "thresholds": [0.5, 0.9], "reset_prob": 0.2, "cooldown": "10s", "handler": "count"}]`), testVocabs, makers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].ActionName(rules[0].Thresholds[1]) != "play0.9" {
+		t.Fatal("parsed wrongly:", rules)
+	}
+	rules, err = ParseRules([]byte(`[{"name": "next", "action": "next0.95", "vocab": "intent", "state": "PlayMusic", "thresholds": [0.9], "reset_prob": 0.2, "handler": "count"}]`), testVocabs, makers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := rules[0].ActionName(rules[0].Thresholds[0]); name != "next0.95" {
+		t.Fatal("the action should keep its name whatever the threshold, got", name)
+	}
+	for _, bad := range []string{
+		`[{"name": "play", "vocab": "word", "state": "PlayMusic", "thresholds": [0.5], "handler": "count"}]`,
+		`[{"name": "play", "vocab": "intent", "state": "Dance", "thresholds": [0.5], "handler": "count"}]`,
+		`[{"name": "play", "vocab": "intent", "state": "PlayMusic", "thresholds": [0.5], "handler": "dance"}]`,
+		`[{"name": "play", "vocab": "intent", "state": "PlayMusic", "thresholds": [], "handler": "count"}]`,
+		`[{"name": "play", "vocab": "intent", "state": "PlayMusic", "thresholds": [0.5], "reset_prob": 0.6, "handler": "count"}]`,
+		`[{"name": "play", "vocab": "intent", "state": "PlayMusic", "thresholds": [0.5], "cooldown": "soon", "handler": "count"}]`,
+		`[{"name": "play", "vocab": "intent", "state": "PlayMusic", "threshold": [0.5], "handler": "count"}]`,
+		`[{"name": "play", "vocab": "intent", "state": "PlayMusic", "thresholds": [0.5, 0.5], "handler": "count"}]`,
+		`[{"vocab": "intent", "state": "PlayMusic", "thresholds": [0.5], "handler": "count"}]`,
+		`[{"name": "play", "action": "play", "vocab": "intent", "state": "PlayMusic", "thresholds": [0.5, 0.9], "handler": "count"}]`,
+	} {
+		if _, err = ParseRules([]byte(bad), testVocabs, makers); err == nil {
+			t.Fatal(bad, "should not parse")
+		}
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	makers, counts := makeCountingMakers()
+	results := make(chan Result)
+	eb := NewEventBroker(results)
+	eb.Register("intent", 2, "pause", Action{
+		MinActivationProb: 0.5,
+		ended:             true,
+		HandlerFunction: func(float32) {
+			counts <- "pause"
+		},
+	})
+	rule := Rule{Name: "play", Vocab: "intent", State: "PlayMusic", Thresholds: []float32{0.5}, ResetProb: 0.2, Handler: "count"}
+	if err := eb.LoadRules([]Rule{rule}, testVocabs, makers); err != nil {
+		t.Fatal(err)
+	}
+	rule.Name = "start"
+	if err := eb.LoadRules([]Rule{rule}, testVocabs, makers); err != nil {
+		t.Fatal(err)
+	}
+	rule.State = "Dance"
+	if err := eb.LoadRules([]Rule{rule}, testVocabs, makers); err == nil {
+		t.Fatal("bad rules should not load")
+	}
+	results <- Result{Probs: map[libaural2.VocabName][]float32{"intent": {1, 0, 0}}} // the prob must fall below reset_prob before the action can run,
+	results <- Result{Probs: map[libaural2.VocabName][]float32{"intent": {0, 0.5, 0.5}}}
+	results <- Result{Probs: map[libaural2.VocabName][]float32{"intent": {0, 0.9, 0.9}}}
+	ran := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case name := <-counts:
+			ran[name] = true
+		case <-time.After(time.Second):
+			t.Fatal("only ran", ran)
+		}
+	}
+	if !ran["start0.5"] || !ran["pause"] {
+		t.Fatal("the reloaded rule and the registered action should run, ran", ran)
+	}
+}
+
+func TestWatchRules(t *testing.T) {
+	RulesPollInterval = 10 * time.Millisecond
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/rules.json"
+	makers, _ := makeCountingMakers()
+	eb := NewEventBroker(make(chan Result))
+	defaults := []Rule{{Name: "play", Vocab: "intent", State: "PlayMusic", Thresholds: []float32{0.5}, Handler: "count"}}
+	if err = eb.WatchRules(path, defaults, testVocabs, makers); err != nil {
+		t.Fatal(err)
+	}
+	hasAction := func(name string) bool {
+		eb.mutex.Lock()
+		defer eb.mutex.Unlock()
+		for _, key := range eb.ruleKeys {
+			if key.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasAction("play0.5") {
+		t.Fatal("the default rules should be loaded when there is no rules file")
+	}
+	rulesBytes := []byte(`[{"name": "pause", "vocab": "intent", "state": "PauseMusic", "thresholds": [0.8], "handler": "count"}]`)
+	if err = ioutil.WriteFile(path, rulesBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor := func(name string) {
+		for start := time.Now(); !hasAction(name); time.Sleep(time.Millisecond) {
+			if time.Since(start) > time.Second {
+				t.Fatal(name, "was not loaded")
+			}
+		}
+	}
+	waitFor("pause0.8")
+	if hasAction("play0.5") {
+		t.Fatal("the default rules should be replaced by the rules file")
+	}
+	if err = ioutil.WriteFile(path, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)) // make sure the change is seen, even if the file system has coarse times.
+	time.Sleep(100 * time.Millisecond)
+	if !hasAction("pause0.8") {
+		t.Fatal("bad rules should not replace the old rules")
+	}
+}
+
+// makeHandlerRule makes a rule of the handler type, with the options given as JSON.
+func makeHandlerRule(handler, options string) Rule {
+	return Rule{Name: "play", Vocab: "intent", State: "PlayMusic", Thresholds: []float32{0.9}, Handler: handler, Options: json.RawMessage(options)}
+}
+
+func TestExecHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out")
+	// the command fails the first time it is run, so that it must be retried.
+	script := `if [ -f "$0.ran" ]; then echo {{.Name}} {{.State}} > "$0"; else touch "$0.ran"; exit 1; fi`
+	options, _ := json.Marshal(map[string]interface{}{"command": "sh", "args": []string{"-c", script, path}, "backoff": "1ms"})
+	rule := makeHandlerRule("exec", string(options))
+	handler, err := BuiltinHandlers["exec"](rule.ActionName(0.9), rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler(0.95)
+	output, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "play0.9 PlayMusic\n" {
+		t.Fatal("wrong output:", string(output))
+	}
+	rule = makeHandlerRule("exec", `{"command": "sleep", "args": ["10"], "timeout": "10ms", "attempts": 2, "backoff": "1ms"}`)
+	if handler, err = BuiltinHandlers["exec"]("play0.9", rule); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	handler(0.95)
+	if time.Since(start) > time.Second {
+		t.Fatal("the command should have been killed after its timeout")
+	}
+	for _, bad := range []string{``, `{"args": ["play"]}`, `{"command": "echo", "args": ["{{.Nope"]}`, `{"command": "echo", "timeout": "soon"}`, `{"command": "echo", "shell": true}`} {
+		if _, err = BuiltinHandlers["exec"]("play0.9", makeHandlerRule("exec", bad)); err == nil {
+			t.Fatal(bad, "should not be allowed")
+		}
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	var requests int
+	events := make(chan Event, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 { // fail the first request, so that it must be retried.
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Path != "/intent/PlayMusic" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		events <- event
+	}))
+	defer server.Close()
+	rule := makeHandlerRule("webhook", `{"url": "`+server.URL+`/{{.Vocab}}/{{.State}}", "headers": {"Authorization": "Bearer secret"}, "backoff": "1ms"}`)
+	handler, err := BuiltinHandlers["webhook"]("play0.9", rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler(0.95)
+	if requests != 2 || len(events) != 1 {
+		t.Fatal("expected 2 requests and 1 event, got", requests, "and", len(events))
+	}
+	if event := <-events; event.Name != "play0.9" || event.Rule != "play" || event.Vocab != "intent" || event.Prob != 0.95 {
+		t.Fatal("wrong event:", event)
+	}
+	requests = 1
+	rule = makeHandlerRule("webhook", `{"url": "`+server.URL+`/missing", "backoff": "1ms"}`)
+	if handler, err = BuiltinHandlers["webhook"]("play0.9", rule); err != nil {
+		t.Fatal(err)
+	}
+	handler(0.95)
+	if requests != 2 {
+		t.Fatal("a 404 should not be retried, got", requests-1, "requests")
+	}
+}
+
+// mqttMessage is a message received by the stand-in MQTT broker.
+type mqttMessage struct {
+	clientID string
+	topic    string
+	qos      byte
+	payload  []byte
+}
+
+// startMQTTBroker starts a stand-in MQTT broker which accepts publishes. It drops the first connection, so that publishes must be retried.
+func startMQTTBroker(t *testing.T) (addr string, messages chan mqttMessage, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages = make(chan mqttMessage, 10)
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if i == 0 {
+				conn.Close()
+				continue
+			}
+			reader := bufio.NewReader(conn)
+			connect, err := readMQTTPacket(reader)
+			if err != nil || connect.header != mqttConnect || string(connect.body[2:6]) != "MQTT" || connect.body[6] != 4 {
+				t.Error("expected CONNECT of MQTT 3.1.1", err)
+				conn.Close()
+				continue
+			}
+			var message mqttMessage
+			message.clientID = string(connect.body[12:]) // after the protocol name, level, flags and keep alive, and the length of the client ID.
+			(mqttPacket{header: mqttConnack, body: []byte{0, 0}}).write(conn)
+			publish, err := readMQTTPacket(reader)
+			if err != nil || publish.header&0xF0 != mqttPublish {
+				t.Error("expected PUBLISH", err)
+				conn.Close()
+				continue
+			}
+			message.qos = publish.header >> 1 & 3
+			topicLen := int(binary.BigEndian.Uint16(publish.body))
+			message.topic = string(publish.body[2 : 2+topicLen])
+			message.payload = publish.body[2+topicLen:]
+			if message.qos == 1 {
+				packetID := message.payload[:2]
+				message.payload = message.payload[2:]
+				(mqttPacket{header: mqttPuback, body: packetID}).write(conn)
+			}
+			if disconnect, err := readMQTTPacket(reader); err != nil || disconnect.header != mqttDisconnect {
+				t.Error("expected DISCONNECT", err)
+			}
+			conn.Close()
+			messages <- message
+		}
+	}()
+	return l.Addr().String(), messages, func() { l.Close() }
+}
+
+func TestMQTTHandler(t *testing.T) {
+	addr, messages, stop := startMQTTBroker(t)
+	defer stop()
+	rule := makeHandlerRule("mqtt", `{"broker": "tcp://`+addr+`", "topic": "aural2/{{.Vocab}}/{{.State}}", "qos": 1, "client_id": "kitchen", "backoff": "1ms"}`)
+	handler, err := BuiltinHandlers["mqtt"]("play0.9", rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler(0.95)
+	var message mqttMessage
+	select {
+	case message = <-messages:
+	case <-time.After(time.Second):
+		t.Fatal("no message was published")
+	}
+	if message.topic != "aural2/intent/PlayMusic" || message.qos != 1 || message.clientID != "kitchen" {
+		t.Fatal("wrong message:", message)
+	}
+	var event Event
+	if err = json.Unmarshal(message.payload, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Name != "play0.9" || event.Prob != 0.95 {
+		t.Fatal("wrong event:", event)
+	}
+	rule = makeHandlerRule("mqtt", `{"broker": "`+addr+`", "topic": "aural2/{{.Rule}}", "payload": "{{.Prob}}"}`)
+	if handler, err = BuiltinHandlers["mqtt"]("play0.9", rule); err != nil {
+		t.Fatal(err)
+	}
+	handler(0.5)
+	message = <-messages
+	if message.topic != "aural2/play" || message.qos != 0 || string(message.payload) != "0.5" {
+		t.Fatal("wrong message:", message)
+	}
+	if _, err = BuiltinHandlers["mqtt"]("play0.9", makeHandlerRule("mqtt", `{"broker": "`+addr+`", "topic": "aural2", "qos": 2}`)); err == nil {
+		t.Fatal("QoS 2 is not supported")
+	}
+	if _, err = BuiltinHandlers["mqtt"]("play0.9", makeHandlerRule("mqtt", `{"broker": "`+addr+`", "topic": "aural2", "password": "secret"}`)); err == nil {
+		t.Fatal("a password without a username is not allowed")
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	vocabs := map[libaural2.VocabName]*libaural2.Vocabulary{word.Vocabulary.Name: &word.Vocabulary}
+	matcher, err := ParseGrammar([]byte(`{
+		"vocab": "word",
+		"timeout": "1s",
+		"commands": [
+			{"name": "play", "pattern": ["Mpc", "Play"]},
+			{"name": "play_genre", "pattern": ["Mpc", "Play", "Genre", "$genre"], "slots": {"genre": ["Rock", "Classical"]}},
+			{"name": "stop", "pattern": ["Stop"]}
+		]
+	}`), vocabs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	say := func(words ...libaural2.State) (events []CommandEvent) {
+		for i, state := range words {
+			events = append(events, matcher.Word(state, 0.9, at(i*500))...)
+		}
+		return
+	}
+	events := say(word.Mpc, word.Play, word.Genre, word.Rock)
+	if len(events) != 1 || events[0].Command != "play_genre" || events[0].Slots["genre"] != "Rock" || len(events[0].Words) != 4 {
+		t.Fatal("expected play_genre Rock, got", events)
+	}
+	if !events[0].Start.Equal(at(0)) || !events[0].End.Equal(at(1500)) {
+		t.Fatal("wrong times", events[0].Start, events[0].End)
+	}
+	if events = say(word.Mpc, word.Play); len(events) != 0 {
+		t.Fatal("play should wait to see if play_genre matches, got", events)
+	}
+	if events = matcher.Tick(at(3000)); len(events) != 1 || events[0].Command != "play" {
+		t.Fatal("play should be heard once play_genre times out, got", events)
+	}
+	if events = say(word.Mpc, word.Play, word.Stop); len(events) != 2 || events[0].Command != "play" || events[1].Command != "stop" {
+		t.Fatal("expected play then stop, got", events)
+	}
+	events = matcher.Word(word.Mpc, 0.9, at(10000))
+	events = append(events, matcher.Word(word.Play, 0.9, at(12000))...) // too long after Mpc.
+	events = append(events, matcher.Tick(at(20000))...)
+	if len(events) != 0 {
+		t.Fatal("words too far apart should not match, got", events)
+	}
+
+	probs := make([]float32, word.Vocabulary.Size)
+	step := func(state libaural2.State, prob float32, ms int) []CommandEvent {
+		for i := range probs {
+			probs[i] = 0
+		}
+		probs[state] = prob
+		return matcher.Handle(Result{Probs: map[libaural2.VocabName][]float32{"word": probs}}, at(30000+ms))
+	}
+	events = nil
+	for i := 0; i < 5; i++ { // a word which stays likely for many strides is only heard once.
+		events = append(events, step(word.Stop, 0.95, i*32)...)
+	}
+	if len(events) != 1 || events[0].Command != "stop" || events[0].Prob != 0.95 {
+		t.Fatal("expected one stop, got", events)
+	}
+	step(word.Stop, 0.5, 200) // not low enough to reset,
+	if events = step(word.Stop, 0.95, 232); len(events) != 0 {
+		t.Fatal("stop should not be heard again before its prob falls below the reset prob, got", events)
+	}
+	step(word.Stop, 0.1, 264)
+	if events = step(word.Stop, 0.95, 296); len(events) != 1 {
+		t.Fatal("stop should be heard again after its prob falls, got", events)
+	}
+
+	for _, bad := range []string{
+		`{"vocab": "intent", "commands": [{"name": "stop", "pattern": ["Stop"]}]}`,
+		`{"vocab": "word", "commands": [{"name": "dance", "pattern": ["Dance"]}]}`,
+		`{"vocab": "word", "commands": [{"name": "genre", "pattern": ["Genre", "$genre"]}]}`,
+		`{"vocab": "word", "commands": [{"name": "stop", "pattern": ["Stop"]}, {"name": "stop", "pattern": ["Pause"]}]}`,
+		`{"vocab": "word", "commands": [{"name": "stop", "pattern": []}]}`,
+		`{"vocab": "word", "threshold": 0.2, "commands": [{"name": "stop", "pattern": ["Stop"]}]}`,
+		`{"vocab": "word", "commands": [{"name": "stop", "words": ["Stop"]}]}`,
+	} {
+		if _, err = ParseGrammar([]byte(bad), vocabs); err == nil {
+			t.Fatal(bad, "should not parse")
+		}
+	}
+}
+
+func TestCommandsInOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grammar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/grammar.json"
+	grammarBytes := []byte(`{"vocab": "word", "commands": [{"name": "stop", "pattern": ["Stop"]}, {"name": "play", "pattern": ["Play"]}]}`)
+	if err = ioutil.WriteFile(path, grammarBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	vocabs := map[libaural2.VocabName]*libaural2.Vocabulary{word.Vocabulary.Name: &word.Vocabulary}
+	eb := NewEventBroker(make(chan Result))
+	commands := make(chan CommandEvent) // unbuffered, so that commands heard while it is not being read pile up.
+	if err = eb.WatchGrammar(path, vocabs, commands); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	words := []libaural2.State{word.Stop, word.Play}
+	for i := 0; i < 20; i++ { // a command in each stride.
+		probs := make([]float32, word.Vocabulary.Size)
+		probs[words[i%2]] = 0.95
+		eb.HandleAt(Result{Probs: map[libaural2.VocabName][]float32{"word": probs}}, start.Add(time.Duration(i)*32*time.Millisecond))
+	}
+	for i := 0; i < 20; i++ {
+		expected := []string{"stop", "play"}[i%2]
+		if event := <-commands; event.Command != expected {
+			t.Fatal("command", i, "should be", expected, "got", event.Command)
+		}
+	}
+}
+
+func TestConfirmation(t *testing.T) {
+	eb := NewEventBroker(make(chan Result))
+	events := make(chan ConfirmEvent, 100)
+	eb.SetConfirmation(DefaultConfirmation, events)
+	var seen []ConfirmStatus
+	eb.OnConfirm(func(event ConfirmEvent) {
+		seen = append(seen, event.Status)
+	})
+	ran := make(chan float32, 10)
+	eb.Register(intent.Vocabulary.Name, intent.ShutDown, "shutdown", Action{
+		MinActivationProb: 0.99,
+		MaxResetProb:      0.5,
+		ConfirmWindow:     5 * time.Second,
+		HandlerFunction: func(prob float32) {
+			ran <- prob
+		},
+	})
+	now := time.Now()
+	step := func(ms int, probs map[libaural2.State]float32) {
+		result := Result{Probs: map[libaural2.VocabName][]float32{intent.Vocabulary.Name: make([]float32, intent.Vocabulary.Size)}}
+		for state, prob := range probs {
+			result.Probs[intent.Vocabulary.Name][state] = prob
+		}
+		eb.HandleAt(result, now.Add(time.Duration(ms)*time.Millisecond))
+	}
+	expect := func(statuses ...ConfirmStatus) {
+		for _, status := range statuses {
+			select {
+			case event := <-events:
+				if event.Status != status || event.Action != "shutdown" {
+					t.Fatal("expected", status, "got", event)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("expected", status)
+			}
+		}
+		if len(ran) > 0 {
+			t.Fatal("the action should not have run")
+		}
+	}
+	say := func(ms int, state libaural2.State) {
+		step(ms, nil) // the prob of the state must fall, so that it is heard again.
+		step(ms+32, map[libaural2.State]float32{state: 0.995})
+	}
+
+	say(0, intent.ShutDown)
+	if len(seen) != 1 || seen[0] != ConfirmPrompt {
+		t.Fatal("OnConfirm should be called as the user is asked, got", seen)
+	}
+	expect(ConfirmPrompt)
+	say(1000, intent.DoIt)
+	if prob := <-ran; prob != 0.995 {
+		t.Fatal("the action should run with the prob which activated it, got", prob)
+	}
+	expect(Confirmed)
+
+	say(10000, intent.ShutDown)
+	say(11000, intent.DontDoIt)
+	expect(ConfirmPrompt, ConfirmCancelled)
+
+	say(20000, intent.ShutDown)
+	step(26000, nil)
+	say(27000, intent.DoIt) // too late
+	expect(ConfirmPrompt, ConfirmTimeout)
+
+	step(30000, nil)
+	step(30032, map[libaural2.State]float32{intent.ShutDown: 0.995, intent.DoIt: 0.995}) // a DoIt heard before the user was asked does not count.
+	step(30064, map[libaural2.State]float32{intent.DoIt: 0.995})
+	expect(ConfirmPrompt)
+	say(31000, intent.DoIt)
+	<-ran
+	expect(Confirmed)
+	expected := []ConfirmStatus{ConfirmPrompt, Confirmed, ConfirmPrompt, ConfirmCancelled, ConfirmPrompt, ConfirmTimeout, ConfirmPrompt, Confirmed}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Fatal("expected OnConfirm to see", expected, "got", seen)
+	}
+
+	rule := Rule{Name: "shutdown", Vocab: "intent", State: "PlayMusic", Thresholds: []float32{0.99}, Confirm: "soon", Handler: "count"}
+	makers, _ := makeCountingMakers()
+	if err := eb.LoadRules([]Rule{rule}, testVocabs, makers); err == nil {
+		t.Fatal("confirm must be a duration")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	decoder, err := decode.New(decode.Config{Strategy: decode.HMM, MinDuration: 2, SwitchPenalty: 2, Lag: 3}, intent.Vocabulary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan Result)
+	UtteranceUpdateInterval = 0
+	defer func() { UtteranceUpdateInterval = 250 * time.Millisecond }()
+	vocabs := map[libaural2.VocabName]*libaural2.Vocabulary{intent.Vocabulary.Name: &intent.Vocabulary}
+	decoded, utterances, err := Decode(results, vocabs, map[libaural2.VocabName]decode.Decoder{intent.Vocabulary.Name: decoder})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		results <- Result{Probs: map[libaural2.VocabName][]float32{intent.Vocabulary.Name: nil}} // the model has not been run yet.
+		for i := 0; i < 20; i++ {
+			probs := make([]float32, intent.Vocabulary.Size)
+			if i >= 5 && i < 9 {
+				probs[intent.PlayMusic] = 0.95
+			} else {
+				probs[libaural2.Nil] = 0.95
+			}
+			results <- Result{Probs: map[libaural2.VocabName][]float32{intent.Vocabulary.Name: probs}}
+		}
+		close(results)
+	}()
+	var decidedStrides int
+	for result := range decoded {
+		if len(result.Probs[intent.Vocabulary.Name]) > 0 {
+			decidedStrides++
+		}
+	}
+	if decidedStrides != 20-decoder.Lag() {
+		t.Fatal("expected", 20-decoder.Lag(), "decided strides, got", decidedStrides)
+	}
+	var phases []UtterancePhase
+	for utterance := range utterances {
+		phases = append(phases, utterance.Phase)
+		if utterance.State != intent.PlayMusic || utterance.Name != "PlayMusic" || utterance.StartStride != 6 { // counting the stride before the model was run.
+			t.Fatal("expected PlayMusic from stride 6, got", utterance)
+		}
+		if utterance.Start.After(utterance.End) || utterance.Peak != 0.95 {
+			t.Fatal("wrong utterance", utterance)
+		}
+		if utterance.Phase == UtteranceEnd && utterance.EndStride != 10 {
+			t.Fatal("expected PlayMusic to end at stride 10, got", utterance.EndStride)
+		}
+	}
+	expected := []UtterancePhase{UtteranceBegin, UtteranceUpdate, UtteranceUpdate, UtteranceUpdate, UtteranceEnd}
+	if fmt.Sprint(phases) != fmt.Sprint(expected) {
+		t.Fatal("expected", expected, "got", phases)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var calls int
+	stepInference := func(*tf.Tensor) ([]float32, error) {
+		calls++
+		if calls > 5 {
+			return []float32{0.1, 0.9, 0}, nil
+		}
+		return []float32{1, 0, 0}, nil
+	}
+	audio := make([]byte, 10*libaural2.StrideWidth*2+libaural2.StrideWidth) // ten strides, and half of one.
+	results, err := Replay(bytes.NewReader(audio), map[libaural2.VocabName]func(*tf.Tensor) ([]float32, error){"intent": stepInference}, nil, VAD{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eb := NewEventBroker(make(chan Result))
+	eb.Register("intent", 1, "play", Action{MinActivationProb: 0.5, MaxResetProb: 0.2, HandlerFunction: func(float32) {}})
+	var fired []ActionEvent
+	eb.OnAction(func(event ActionEvent) {
+		fired = append(fired, event)
+	})
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	var strides int
+	for result := range results { // the results end with the audio.
+		eb.HandleAt(result, start.Add(time.Duration(strides)*32*time.Millisecond))
+		strides++
+	}
+	if strides != 10 {
+		t.Fatal("expected 10 strides, the half stride should be dropped, got", strides)
+	}
+	if len(fired) != 1 || fired[0].Action != "play" || fired[0].Prob != 0.9 || !fired[0].TS.Equal(start.Add(5*32*time.Millisecond)) {
+		t.Fatal("expected play to fire once, at the simulated time of stride 5, got", fired)
+	}
+}
+
+func TestReplayRules(t *testing.T) {
+	makers, _ := makeCountingMakers()
+	rules, err := ParseRules([]byte(`[
+		{"name": "play", "vocab": "intent", "state": "PlayMusic", "thresholds": [0.5], "reset_prob": 0.2, "handler": "count"},
+		{"name": "pause", "vocab": "intent", "state": "PauseMusic", "thresholds": [0.5], "reset_prob": 0.2, "cooldown": "1s", "handler": "count"}
+	]`), testVocabs, makers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int
+	stepInference := func(*tf.Tensor) ([]float32, error) {
+		stride := calls
+		calls++
+		switch {
+		case stride >= 5 && stride < 10:
+			return []float32{0.1, 0.9, 0}, nil
+		case stride >= 15 && stride < 20: // too soon after the rules were loaded,
+			return []float32{0.1, 0, 0.9}, nil
+		case stride >= 40 && stride < 45: // but not now.
+			return []float32{0.1, 0, 0.9}, nil
+		}
+		return []float32{1, 0, 0}, nil
+	}
+	audio := make([]byte, 50*libaural2.StrideWidth*2)
+	results, err := Replay(bytes.NewReader(audio), map[libaural2.VocabName]func(*tf.Tensor) ([]float32, error){"intent": stepInference}, nil, VAD{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eb := NewEventBroker(make(chan Result))
+	if err = eb.LoadRules(rules, testVocabs, makers); err != nil {
+		t.Fatal(err)
+	}
+	var fired []ActionEvent
+	eb.OnAction(func(event ActionEvent) {
+		fired = append(fired, event)
+	})
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC) // long before the rules were loaded, by the wall clock.
+	var strides int
+	for result := range results {
+		eb.HandleAt(result, start.Add(time.Duration(strides)*32*time.Millisecond))
+		strides++
+	}
+	if len(fired) != 2 || fired[0].Action != "play0.5" || fired[1].Action != "pause0.5" || !fired[1].TS.Equal(start.Add(40*32*time.Millisecond)) {
+		t.Fatal("expected play, then pause once its cooldown from the first result had passed, got", fired)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/base64"
+	"strconv"
+
+	"github.com/gopherjs/gopherjs/js"
+	la "github.ibm.com/Blue-Horizon/aural2/libaural2"
+	"honnef.co/go/js/dom"
+	"honnef.co/go/js/xhr"
+)
+
+// liveStrides is the number of strides shown on the live page, as many as the ring buffer holds.
+const liveStrides = la.StridesPerClip
+
+// liveTrace draws the probs of each state of one vocab.
+type liveTrace struct {
+	vocab   *la.Vocabulary
+	canvas  *dom.HTMLCanvasElement
+	ctx     *dom.CanvasRenderingContext2D
+	history [][]float64 // probs of the last liveStrides strides, oldest first
+}
+
+// liveMarker marks where an action fired, a command was heard, or an utterance ended.
+type liveMarker struct {
+	stride int // value of liveStride when it happened
+	name   string
+	color  string
+}
+
+var liveStride int // number of strides heard since the page was opened
+var liveTraces = map[la.VocabName]*liveTrace{}
+var liveMarkers []liveMarker
+var liveThreshold = 0.9 // prob at which to draw the threshold line, to tune the thresholds of the rules by.
+
+// newLiveTrace makes the canvas for the probs of a vocab.
+func newLiveTrace(vocab *la.Vocabulary) (trace *liveTrace) {
+	d := dom.GetWindow().Document()
+	heading := d.CreateElement("h2")
+	heading.SetTextContent(string(vocab.Name))
+	canvas := d.CreateElement("canvas").(*dom.HTMLCanvasElement)
+	canvas.Width = liveStrides
+	canvas.Height = 100
+	canvas.SetClass("timeviz live-trace")
+	traces := d.GetElementByID("live-traces")
+	traces.AppendChild(heading)
+	traces.AppendChild(canvas)
+	legend := d.CreateElement("p")
+	for state := la.State(0); int(state) < vocab.Size; state++ {
+		name := d.CreateElement("span")
+		name.SetTextContent(vocab.Names[state] + " ")
+		name.(*dom.HTMLSpanElement).Style().SetProperty("color", colorToCSSstring(vocab.Color(state)), "")
+		legend.AppendChild(name)
+	}
+	traces.AppendChild(legend)
+	trace = &liveTrace{vocab: vocab, canvas: canvas, ctx: canvas.GetContext2d()}
+	return
+}
+
+// draw the probs of the last strides, the markers, and the threshold line.
+func (trace *liveTrace) draw() {
+	ctx := trace.ctx
+	width, height := float64(trace.canvas.Width), float64(trace.canvas.Height)
+	ctx.ClearRect(0, 0, width, height)
+	offset := liveStrides - len(trace.history)
+	for state := 1; state < trace.vocab.Size; state++ { // Nil is left out, it would hide the rest.
+		ctx.StrokeStyle = colorToCSSstring(trace.vocab.Color(la.State(state)))
+		ctx.BeginPath()
+		for i, probs := range trace.history {
+			if state >= len(probs) {
+				continue
+			}
+			y := height * (1 - probs[state])
+			if i == 0 {
+				ctx.MoveTo(float64(offset+i), y)
+			} else {
+				ctx.LineTo(float64(offset+i), y)
+			}
+		}
+		ctx.Stroke()
+	}
+	ctx.StrokeStyle = "gray"
+	ctx.BeginPath()
+	ctx.MoveTo(0, height*(1-liveThreshold))
+	ctx.LineTo(width, height*(1-liveThreshold))
+	ctx.Stroke()
+	for _, marker := range liveMarkers {
+		x := float64(liveStrides - (liveStride - marker.stride))
+		ctx.StrokeStyle = marker.color
+		ctx.BeginPath()
+		ctx.MoveTo(x, 0)
+		ctx.LineTo(x, height)
+		ctx.Stroke()
+		ctx.FillStyle = marker.color
+		ctx.FillText(marker.name, x+2, 10, -1)
+	}
+}
+
+// addProbs adds the probs of one stride to the trace of a vocab.
+func addProbs(vocabName la.VocabName, probsObj *js.Object) {
+	trace, prs := liveTraces[vocabName]
+	if !prs {
+		vocab, prs := vocabs[string(vocabName)]
+		if !prs {
+			return
+		}
+		trace = newLiveTrace(vocab)
+		liveTraces[vocabName] = trace
+	}
+	probs := make([]float64, probsObj.Length())
+	for i := range probs {
+		probs[i] = probsObj.Index(i).Float()
+	}
+	trace.history = append(trace.history, probs)
+	if len(trace.history) > liveStrides {
+		trace.history = trace.history[1:]
+	}
+	trace.draw()
+}
+
+// addSpectrum scrolls the spectrogram one stride, and draws the spectrum of the latest stride at the right edge.
+func addSpectrum(canvas *dom.HTMLCanvasElement, spectrum []byte) {
+	liveStride++
+	ctx := canvas.GetContext2d()
+	ctx.Call("drawImage", canvas.Underlying(), -1, 0)
+	column := ctx.Call("createImageData", 1, canvas.Height)
+	data := column.Get("data")
+	for y := 0; y < canvas.Height && y < len(spectrum); y++ {
+		level := spectrum[len(spectrum)-1-y] // low frequencies at the bottom
+		data.SetIndex(y*4, level)
+		data.SetIndex(y*4+1, level)
+		data.SetIndex(y*4+2, level)
+		data.SetIndex(y*4+3, 255)
+	}
+	ctx.Call("putImageData", column, canvas.Width-1, 0)
+	var alive []liveMarker
+	for _, marker := range liveMarkers { // markers which have scrolled off the page are dropped.
+		if liveStride-marker.stride < liveStrides {
+			alive = append(alive, marker)
+		}
+	}
+	liveMarkers = alive
+}
+
+// addMarker adds a marker at the latest stride, and redraws the traces.
+func addMarker(marker liveMarker) {
+	liveMarkers = append(liveMarkers, marker)
+	for _, trace := range liveTraces {
+		trace.draw()
+	}
+}
+
+// addAction marks an action which ran, whatever the handler of its rule.
+func addAction(event *js.Object) {
+	addMarker(liveMarker{stride: liveStride, name: event.Get("action").String(), color: "white"})
+}
+
+// addIntent marks an intent on the traces. Updates and starts of utterances are not marked, only their end.
+// Intents sent by the actions of rules are not marked again, as their action already is.
+func addIntent(msg *js.Object) {
+	marker := liveMarker{stride: liveStride, name: msg.Get("name").String(), color: "lime"}
+	if confirm := msg.Get("confirm"); confirm != js.Undefined {
+		marker.name += " " + confirm.String()
+		marker.color = "yellow"
+	}
+	if utterance := msg.Get("utterance"); utterance != js.Undefined {
+		if utterance.Get("phase").String() != "end" {
+			return
+		}
+		marker.color = "cyan"
+	}
+	if marker.color == "lime" {
+		for _, action := range liveMarkers {
+			if action.name == marker.name && action.color == "white" && liveStride-action.stride <= 1 {
+				return
+			}
+		}
+	}
+	addMarker(marker)
+}
+
+// saveLastClip saves the last 10 seconds of audio, and links to it in the tag UI.
+func saveLastClip() {
+	d := dom.GetWindow().Document()
+	resp, err := xhr.Send("POST", "/saveclip", nil)
+	if err != nil {
+		print(err)
+		return
+	}
+	link := d.CreateElement("a").(*dom.HTMLAnchorElement)
+	link.Href = "/tagui/intent/" + string(resp)
+	link.Target = "_blank"
+	link.SetTextContent("saved " + string(resp[:8]) + " ")
+	d.GetElementByID("live-saved").AppendChild(link)
+}
+
+// startLive streams the live events, and draws them as they come.
+func startLive() {
+	d := dom.GetWindow().Document()
+	spectrogram := d.GetElementByID("live-spectrogram").(*dom.HTMLCanvasElement)
+	spectrogram.Width = liveStrides
+	spectrogram.Height = 128
+	threshold := d.GetElementByID("live-threshold").(*dom.HTMLInputElement)
+	threshold.AddEventListener("input", false, func(event dom.Event) {
+		liveThreshold, _ = strconv.ParseFloat(threshold.Value, 64)
+		for _, trace := range liveTraces {
+			trace.draw()
+		}
+	})
+	d.GetElementByID("live-save").AddEventListener("click", false, func(event dom.Event) {
+		go saveLastClip()
+	})
+	source := js.Global.Get("EventSource").New("/live/events?types=intent,action,decoded,spectrum")
+	parse := func(event *js.Object) *js.Object {
+		return js.Global.Get("JSON").Call("parse", event.Get("data"))
+	}
+	source.Call("addEventListener", "spectrum", func(event *js.Object) {
+		spectrum, err := base64.StdEncoding.DecodeString(parse(event).Get("data").String())
+		if err != nil {
+			print(err)
+			return
+		}
+		addSpectrum(spectrogram, spectrum)
+	})
+	source.Call("addEventListener", "decoded", func(event *js.Object) { // the probs the rules are thresholded against.
+		liveEvent := parse(event)
+		addProbs(la.VocabName(liveEvent.Get("vocab").String()), liveEvent.Get("data"))
+	})
+	source.Call("addEventListener", "intent", func(event *js.Object) {
+		addIntent(parse(event).Get("data"))
+	})
+	source.Call("addEventListener", "action", func(event *js.Object) {
+		addAction(parse(event).Get("data"))
+	})
+}
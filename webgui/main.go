@@ -62,6 +62,71 @@ func createLabelMarker(label la.Label) (setEnd func(float64)) {
 	return
 }
 
+// createDraftMarker shows one label proposed by the model.
+// Click to accept it, shift click to reject it, and ctrl click to move its nearest edge to the curser.
+func createDraftMarker(label la.Label) {
+	d := dom.GetWindow().Document()
+	draftsContainer := d.GetElementByID("drafts").(*dom.HTMLDivElement)
+	draftDiv := d.CreateElement("div").(*dom.HTMLDivElement)
+	draftDiv.SetClass("label draft")
+	draftDiv.SetInnerHTML("<p class='state_label'>" + vocab.Names[label.State] + "</p>")
+	draftDiv.Style().SetProperty("background-color", colorToCSSstring(label.State), "")
+	setEdges := func() {
+		left := label.Start / float64(la.Duration)
+		width := (label.End - label.Start) / float64(la.Duration)
+		draftDiv.Style().Set("left", strconv.FormatFloat(left*100, 'f', 8, 64)+"%")
+		draftDiv.Style().Set("width", strconv.FormatFloat(width*100, 'f', 8, 64)+"%")
+	}
+	setEdges()
+	draftsContainer.AppendChild(draftDiv)
+	draftDiv.AddEventListener("click", false, func(event dom.Event) {
+		me := event.(*dom.MouseEvent)
+		if me.CtrlKey { // adjust
+			currentTime := d.GetElementByID("audio").(*dom.HTMLAudioElement).Get("currentTime").Float()
+			if currentTime-label.Start < label.End-currentTime {
+				label.Start = currentTime
+			} else {
+				label.End = currentTime
+			}
+			if label.End > label.Start {
+				setEdges()
+			}
+			return
+		}
+		draftsContainer.RemoveChild(draftDiv)
+		if me.ShiftKey { // reject
+			return
+		}
+		if label.End <= label.Start {
+			return
+		}
+		labelsSet.Labels = append(labelsSet.Labels, label) // accept
+		createLabelMarker(label)
+	})
+}
+
+// getDraft loads the labels proposed by the current model.
+func getDraft() {
+	d := dom.GetWindow().Document()
+	draftsElm := d.GetElementByID("drafts").(*dom.HTMLDivElement)
+	for draftsElm.Call("hasChildNodes").Bool() {
+		draftsElm.Call("removeChild", draftsElm.Get("lastChild"))
+	}
+	resp, err := xhr.Send("GET", "/draft/"+string(vocab.Name)+"/"+clipID.FSsafeString(), nil)
+	if err != nil {
+		print(err)
+		return
+	}
+	draft, err := la.DeserializeLabelSet(resp)
+	if err != nil {
+		print(err)
+		return
+	}
+	for _, label := range draft.Labels {
+		createDraftMarker(label)
+	}
+}
+
 func postLabelsSet(labels la.LabelSet) (err error) {
 	print("posting")
 	serialised, err := labels.Serialize()
@@ -90,6 +155,9 @@ func getLabelsSet() {
 	for _, label := range labelsSet.Labels {
 		createLabelMarker(label)
 	}
+	if len(labelsSet.Labels) == 0 { // if no human has labeled the clip yet, start from what the model thinks.
+		getDraft()
+	}
 	return
 }
 
@@ -200,6 +268,10 @@ func start() {
 			print("saving")
 			go postLabelsSet(labelsSet)
 		}
+		if ke.Key == "d" && ke.AltKey {
+			print("loading draft")
+			go getDraft()
+		}
 		if ke.Key == "Delete" {
 			labelsSet.Labels = []la.Label{}
 			labelsElm := d.GetElementByID("labels").(*dom.HTMLDivElement)
@@ -242,9 +314,16 @@ func main() {
 	fmt.Println("Audio vis GUI version 0.1.6")
 	w := dom.GetWindow()
 	w.AddEventListener("DOMContentLoaded", true, func(event dom.Event) {
+		if w.Document().GetElementByID("live") != nil { // the live page, not the tag UI
+			go startLive()
+			return
+		}
 		go start()
 	})
 	w.AddEventListener("beforeunload", true, func(event dom.Event) {
+		if vocab == nil { // no clip is being labeled.
+			return
+		}
 		fmt.Println("unloading")
 		postLabelsSet(labelsSet)
 	})